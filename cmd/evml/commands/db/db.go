@@ -0,0 +1,45 @@
+package db
+
+import (
+	"github.com/mosaicnetworks/evm-lite/cmd/evml/commands/utils"
+	_config "github.com/mosaicnetworks/evm-lite/src/config"
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+)
+
+var (
+	config = _config.DefaultConfig()
+	logger = logrus.New()
+)
+
+//DbCmd groups the maintenance commands that operate on the database of a
+//stopped node
+var DbCmd = &cobra.Command{
+	Use:   "db",
+	Short: "Maintenance operations on the database of a stopped node",
+	PersistentPreRunE: func(cmd *cobra.Command, args []string) (err error) {
+		config, err = utils.LoadConfig(cmd, logger)
+		if err != nil {
+			return err
+		}
+
+		logger.Level = utils.LogLevel(config.LogLevel)
+
+		logger.WithFields(logrus.Fields{
+			"Base": config}).Debug("Config")
+
+		return nil
+	},
+}
+
+func init() {
+	//Subcommands
+	DbCmd.AddCommand(
+		NewRollbackCmd(),
+		NewPruneCmd(),
+		NewPinCmd(),
+		NewMigrateCmd())
+
+	utils.AddBaseFlags(DbCmd, config)
+	utils.AddEthFlags(DbCmd, config)
+}
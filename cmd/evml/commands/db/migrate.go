@@ -0,0 +1,52 @@
+package db
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/mosaicnetworks/evm-lite/cmd/evml/commands/utils"
+	_state "github.com/mosaicnetworks/evm-lite/src/state"
+	"github.com/spf13/cobra"
+)
+
+//NewMigrateCmd returns the command that upgrades the database of a stopped
+//node to the current schema
+func NewMigrateCmd() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "migrate",
+		Short: "Upgrade the database of a stopped node to the current schema",
+		Long: `Upgrade the database of a stopped node to the current schema.
+
+Migrations are also applied automatically when a node starts. This command
+makes it possible to run them ahead of time, and to check the schema version.`,
+		RunE: runMigrate,
+	}
+
+	return cmd
+}
+
+func runMigrate(cmd *cobra.Command, args []string) error {
+	if _, err := os.Stat(config.DbFile); err != nil {
+		return fmt.Errorf("No database at %s: %v", config.DbFile, err)
+	}
+
+	db, err := utils.OpenDatabase(config)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	from, to, err := _state.Migrate(db, logger.WithField("component", "state"))
+	if err != nil {
+		return err
+	}
+
+	if from == to {
+		fmt.Printf("Database is up to date (schema version %d)\n", to)
+		return nil
+	}
+
+	fmt.Printf("Migrated database from schema version %d to %d\n", from, to)
+
+	return nil
+}
@@ -0,0 +1,119 @@
+package db
+
+import (
+	"fmt"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/mosaicnetworks/evm-lite/cmd/evml/commands/utils"
+	_state "github.com/mosaicnetworks/evm-lite/src/state"
+	"github.com/spf13/cobra"
+)
+
+var (
+	pruneKeep   uint64
+	prunePinned []string
+	pruneDryRun bool
+	pinRemove   bool
+)
+
+//NewPruneCmd returns the command that garbage-collects the old states of a
+//stopped node
+func NewPruneCmd() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "prune",
+		Short: "Delete the old states from the database of a stopped node",
+		Long: `Delete the old states from the database of a stopped node.
+
+Only the trie nodes and contract code reachable from the state of the last
+--keep commits, or from a pinned root, are kept. Roots can be pinned
+permanently with 'evml db pin', or for this run only with --pin. The state can
+no longer be rolled back to a pruned commit.`,
+		RunE: runPrune,
+	}
+
+	cmd.Flags().Uint64Var(&pruneKeep, "keep", 128, "Number of recent commits whose state is kept")
+	cmd.Flags().StringSliceVar(&prunePinned, "pin", nil, "Additional state roots to keep")
+	cmd.Flags().BoolVar(&pruneDryRun, "dry-run", false, "Only report what would be deleted")
+
+	return cmd
+}
+
+//NewPinCmd returns the command that pins a state root, so that it is never
+//pruned
+func NewPinCmd() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "pin [root]",
+		Short: "Pin a state root so that it is never pruned",
+		Long: `Pin a state root so that it is never pruned. Without arguments, list the
+pinned roots.`,
+		Args: cobra.MaximumNArgs(1),
+		RunE: runPin,
+	}
+
+	cmd.Flags().BoolVar(&pinRemove, "remove", false, "Unpin the root")
+
+	return cmd
+}
+
+func runPrune(cmd *cobra.Command, args []string) error {
+	state, err := utils.OpenState(config, logger)
+	if err != nil {
+		return err
+	}
+	defer state.Close()
+
+	opts := _state.PruneOptions{
+		Keep:   pruneKeep,
+		DryRun: pruneDryRun,
+	}
+	for _, root := range prunePinned {
+		opts.Pinned = append(opts.Pinned, common.HexToHash(root))
+	}
+
+	result, err := state.Prune(opts)
+	if err != nil {
+		return err
+	}
+
+	verb := "Deleted"
+	if pruneDryRun {
+		verb = "Would delete"
+	}
+
+	fmt.Printf("Kept %d roots (%d nodes). %s %d nodes (%d bytes) in %v\n",
+		len(result.Roots),
+		result.Live,
+		verb,
+		result.Deleted,
+		result.Size,
+		result.Elapsed)
+
+	return nil
+}
+
+func runPin(cmd *cobra.Command, args []string) error {
+	state, err := utils.OpenState(config, logger)
+	if err != nil {
+		return err
+	}
+	defer state.Close()
+
+	if len(args) == 0 {
+		roots, err := state.GetPinnedRoots()
+		if err != nil {
+			return err
+		}
+		for _, root := range roots {
+			fmt.Println(root.Hex())
+		}
+		return nil
+	}
+
+	root := common.HexToHash(args[0])
+
+	if pinRemove {
+		return state.UnpinRoot(root)
+	}
+
+	return state.PinRoot(root)
+}
@@ -0,0 +1,86 @@
+package db
+
+import (
+	"fmt"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/mosaicnetworks/evm-lite/cmd/evml/commands/utils"
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+)
+
+var (
+	rollbackTo      uint64
+	rollbackRoot    string
+	rollbackConfirm bool
+)
+
+//NewRollbackCmd returns the command that rolls the state of a stopped node back
+//to a previous commit
+func NewRollbackCmd() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "rollback",
+		Short: "Roll the state of a stopped node back to a previous commit",
+		Long: `Roll the state of a stopped node back to a previous commit.
+
+The commit is identified by its number (--to) or its state root (--root). The
+transactions and receipts of the later commits are deleted from the database.
+This cannot be undone, so the command only lists what would be removed unless
+--confirm is set.`,
+		RunE: runRollback,
+	}
+
+	cmd.Flags().Uint64Var(&rollbackTo, "to", 0, "Number of the commit to roll back to")
+	cmd.Flags().StringVar(&rollbackRoot, "root", "", "State root of the commit to roll back to")
+	cmd.Flags().BoolVar(&rollbackConfirm, "confirm", false, "Actually delete the later commits")
+
+	return cmd
+}
+
+func runRollback(cmd *cobra.Command, args []string) error {
+	if cmd.Flags().Changed("to") == (rollbackRoot != "") {
+		return fmt.Errorf("Exactly one of --to and --root is required")
+	}
+
+	state, err := utils.OpenState(config, logger)
+	if err != nil {
+		return err
+	}
+	defer state.Close()
+
+	target := rollbackTo
+	if rollbackRoot != "" {
+		target, err = state.FindCommit(common.HexToHash(rollbackRoot))
+		if err != nil {
+			return err
+		}
+	}
+
+	head, _ := state.GetCommitNumber()
+	if target > head {
+		return fmt.Errorf("Commit %d is after the last commit %d", target, head)
+	}
+
+	if !rollbackConfirm {
+		for n := head; n > target; n-- {
+			record, err := state.GetCommit(n)
+			if err != nil {
+				return err
+			}
+			fmt.Printf("commit %d\troot %s\t%d txs\n", n, record.Root.Hex(), len(record.TxHashes))
+		}
+		return fmt.Errorf("%d commits would be removed. Run again with --confirm to roll back to commit %d", head-target, target)
+	}
+
+	root, err := state.RollbackTo(target)
+	if err != nil {
+		return err
+	}
+
+	logger.WithFields(logrus.Fields{
+		"commit": target,
+		"root":   root.Hex(),
+	}).Info("Rolled back")
+
+	return nil
+}
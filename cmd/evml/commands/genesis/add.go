@@ -0,0 +1,76 @@
+package genesis
+
+import (
+	"fmt"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/common/math"
+	bcommon "github.com/mosaicnetworks/evm-lite/src/common"
+	"github.com/mosaicnetworks/evm-lite/src/currency"
+	"github.com/spf13/cobra"
+)
+
+var (
+	addBalance     string
+	addAuthorising bool
+)
+
+//NewAddAccountCmd returns the command that adds pre-funded accounts to the
+//genesis file
+func NewAddAccountCmd() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "add-account [address...]",
+		Short: "Add pre-funded accounts to the genesis file",
+		Long: `Add pre-funded accounts to the genesis file.
+
+The balance is expressed in atoms, or in currency units with a suffix, for
+example 100T for 100 tokens, or 1.5m for 0.0015 tokens. It is written to the
+genesis file in atoms. --authorising marks the accounts as authorised by the
+POA contract, which is used when the contract cannot enumerate its whitelist.`,
+		Args: cobra.MinimumNArgs(1),
+		RunE: runAddAccount,
+	}
+
+	cmd.Flags().StringVar(&addBalance, "balance", "0", "Balance of the accounts, ex: 100T")
+	cmd.Flags().BoolVar(&addAuthorising, "authorising", false, "Mark the accounts as authorised")
+
+	return cmd
+}
+
+func runAddAccount(cmd *cobra.Command, args []string) error {
+	balance, ok := math.ParseBig256(currency.ExpandCurrencyString(addBalance))
+	if !ok {
+		return fmt.Errorf("Invalid balance %q", addBalance)
+	}
+
+	genesis, err := readGenesis(config.Genesis)
+	if err != nil {
+		return err
+	}
+
+	existing := make(map[common.Address]bool)
+	for addr := range genesis.Alloc {
+		existing[common.HexToAddress(addr)] = true
+	}
+
+	for _, arg := range args {
+		if !common.IsHexAddress(arg) {
+			return fmt.Errorf("Invalid address %q", arg)
+		}
+
+		addr := common.HexToAddress(arg)
+		if existing[addr] {
+			return fmt.Errorf("Account %s is already in the genesis file", addr.Hex())
+		}
+		existing[addr] = true
+
+		genesis.Alloc[common.Bytes2Hex(addr.Bytes())] = bcommon.GenesisAccount{
+			Balance:     balance.String(),
+			Authorising: addAuthorising,
+		}
+
+		logger.WithField("address", addr.Hex()).Info("Added account")
+	}
+
+	return writeGenesis(config.Genesis, genesis)
+}
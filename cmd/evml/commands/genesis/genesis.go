@@ -0,0 +1,108 @@
+package genesis
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"github.com/mosaicnetworks/evm-lite/cmd/evml/commands/utils"
+	bcommon "github.com/mosaicnetworks/evm-lite/src/common"
+	_config "github.com/mosaicnetworks/evm-lite/src/config"
+	_state "github.com/mosaicnetworks/evm-lite/src/state"
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+)
+
+var (
+	config = _config.DefaultConfig()
+	logger = logrus.New()
+)
+
+//GenesisCmd groups the commands that build and validate the genesis file
+var GenesisCmd = &cobra.Command{
+	Use:   "genesis",
+	Short: "Build and validate the genesis file",
+	Long: `Build and validate the genesis file.
+
+The genesis file (--eth.genesis) is created with 'evml genesis init', and
+completed with the other commands. Every command validates the genesis file
+before writing it.`,
+	PersistentPreRunE: func(cmd *cobra.Command, args []string) (err error) {
+		config, err = utils.LoadConfig(cmd, logger)
+		if err != nil {
+			return err
+		}
+
+		logger.Level = utils.LogLevel(config.LogLevel)
+
+		logger.WithFields(logrus.Fields{
+			"Base": config}).Debug("Config")
+
+		return nil
+	},
+}
+
+func init() {
+	//Subcommands
+	GenesisCmd.AddCommand(
+		NewInitCmd(),
+		NewAddAccountCmd(),
+		NewPoaCmd(),
+		NewSetCmd(),
+		NewValidateCmd())
+
+	utils.AddBaseFlags(GenesisCmd, config)
+	GenesisCmd.PersistentFlags().String("eth.genesis", config.Genesis, "Location of genesis file")
+}
+
+//readGenesis reads a genesis file
+func readGenesis(path string) (bcommon.Genesis, error) {
+	contents, err := ioutil.ReadFile(path)
+	if err != nil {
+		return bcommon.Genesis{}, err
+	}
+
+	var genesis bcommon.Genesis
+	if err := json.Unmarshal(contents, &genesis); err != nil {
+		return bcommon.Genesis{}, fmt.Errorf("Parsing genesis file %s: %v", path, err)
+	}
+
+	if genesis.Alloc == nil {
+		genesis.Alloc = make(bcommon.AccountMap)
+	}
+
+	return genesis, nil
+}
+
+//writeGenesis validates a genesis file and writes it. The file is replaced
+//atomically, so it is never left half written.
+func writeGenesis(path string, genesis bcommon.Genesis) error {
+	if err := _state.ValidateGenesis(genesis); err != nil {
+		return err
+	}
+
+	js, err := json.MarshalIndent(genesis, "", "\t")
+	if err != nil {
+		return err
+	}
+
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+
+	tmp := path + ".tmp"
+	if err := ioutil.WriteFile(tmp, append(js, '\n'), 0644); err != nil {
+		return err
+	}
+
+	if err := os.Rename(tmp, path); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+
+	logger.WithField("file", path).Info("Wrote genesis file")
+
+	return nil
+}
@@ -0,0 +1,54 @@
+package genesis
+
+import (
+	"fmt"
+	"os"
+
+	bcommon "github.com/mosaicnetworks/evm-lite/src/common"
+	"github.com/spf13/cobra"
+)
+
+//defaultGasLimit is the block gas limit of the new genesis files. Without one,
+//the blocks are practically unbounded.
+const defaultGasLimit = 100000000
+
+var (
+	initChainID  uint64
+	initGasLimit uint64
+	initForce    bool
+)
+
+//NewInitCmd returns the command that creates an empty genesis file
+func NewInitCmd() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "init",
+		Short: "Create an empty genesis file",
+		Long: `Create an empty genesis file.
+
+The genesis file has no accounts and no POA contract. The chain ID defaults to
+1, and the block gas limit to 100,000,000. An existing genesis file is only
+overwritten with --force.`,
+		Args: cobra.NoArgs,
+		RunE: runInit,
+	}
+
+	cmd.Flags().Uint64Var(&initChainID, "chain-id", 0, "Chain ID (default 1)")
+	cmd.Flags().Uint64Var(&initGasLimit, "gas-limit", defaultGasLimit, "Block gas limit")
+	cmd.Flags().BoolVar(&initForce, "force", false, "Overwrite an existing genesis file")
+
+	return cmd
+}
+
+func runInit(cmd *cobra.Command, args []string) error {
+	if _, err := os.Stat(config.Genesis); err == nil && !initForce {
+		return fmt.Errorf("Genesis file %s already exists. Use --force to overwrite it", config.Genesis)
+	}
+
+	genesis := bcommon.Genesis{
+		Alloc:    make(bcommon.AccountMap),
+		ChainID:  initChainID,
+		GasLimit: initGasLimit,
+	}
+
+	return writeGenesis(config.Genesis, genesis)
+}
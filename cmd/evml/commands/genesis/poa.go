@@ -0,0 +1,128 @@
+package genesis
+
+import (
+	"bytes"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+
+	"github.com/ethereum/go-ethereum/accounts/abi"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/common/math"
+	bcommon "github.com/mosaicnetworks/evm-lite/src/common"
+	"github.com/mosaicnetworks/evm-lite/src/currency"
+	_state "github.com/mosaicnetworks/evm-lite/src/state"
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+)
+
+var (
+	poaBinFile   string
+	poaABIFile   string
+	poaAddress   string
+	poaBalance   string
+	poaWhitelist []string
+)
+
+//NewPoaCmd returns the command that embeds the POA contract in the genesis
+//file
+func NewPoaCmd() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "poa",
+		Short: "Embed a compiled POA contract in the genesis file",
+		Long: `Embed a compiled POA contract in the genesis file.
+
+--bin is the creation bytecode of the contract, in hex, as output by solc --bin,
+and --abi its ABI. The constructor is executed, with the --whitelist addresses
+as its address[] argument if it takes one, and the resulting code and storage
+are written to the genesis file. The constructor is executed by the zero
+address, and must not depend on the address of the contract.`,
+		Args: cobra.NoArgs,
+		RunE: runPoa,
+	}
+
+	cmd.Flags().StringVar(&poaBinFile, "bin", "", "File containing the creation bytecode of the contract")
+	cmd.Flags().StringVar(&poaABIFile, "abi", "", "File containing the ABI of the contract")
+	cmd.Flags().StringVar(&poaAddress, "address", "0xabbaabbaabbaabbaabbaabbaabbaabbaabbaabba", "Address of the contract")
+	cmd.Flags().StringVar(&poaBalance, "balance", "0", "Balance of the contract, ex: 100T")
+	cmd.Flags().StringSliceVar(&poaWhitelist, "whitelist", nil, "Initial whitelist, passed to the constructor")
+
+	cmd.MarkFlagRequired("bin")
+	cmd.MarkFlagRequired("abi")
+
+	return cmd
+}
+
+func runPoa(cmd *cobra.Command, args []string) error {
+	if !common.IsHexAddress(poaAddress) {
+		return fmt.Errorf("Invalid address %q", poaAddress)
+	}
+
+	balance, ok := math.ParseBig256(currency.ExpandCurrencyString(poaBalance))
+	if !ok {
+		return fmt.Errorf("Invalid balance %q", poaBalance)
+	}
+
+	bin, err := ioutil.ReadFile(poaBinFile)
+	if err != nil {
+		return err
+	}
+
+	creationCode, err := hex.DecodeString(string(bytes.TrimPrefix(bytes.TrimSpace(bin), []byte("0x"))))
+	if err != nil {
+		return fmt.Errorf("Invalid bytecode in %s: %v", poaBinFile, err)
+	}
+
+	abiJSON, err := ioutil.ReadFile(poaABIFile)
+	if err != nil {
+		return err
+	}
+
+	contractABI, err := abi.JSON(bytes.NewReader(abiJSON))
+	if err != nil {
+		return fmt.Errorf("Invalid ABI in %s: %v", poaABIFile, err)
+	}
+
+	whitelist := make([]common.Address, len(poaWhitelist))
+	for i, addr := range poaWhitelist {
+		if !common.IsHexAddress(addr) {
+			return fmt.Errorf("Invalid whitelist address %q", addr)
+		}
+		whitelist[i] = common.HexToAddress(addr)
+	}
+
+	if len(contractABI.Constructor.Inputs) > 0 {
+		constructorArgs, err := contractABI.Pack("", whitelist)
+		if err != nil {
+			return fmt.Errorf("The constructor must take the whitelist as an address[]: %v", err)
+		}
+		creationCode = append(creationCode, constructorArgs...)
+	} else if len(whitelist) > 0 {
+		return fmt.Errorf("The constructor does not take a whitelist")
+	}
+
+	code, storage, err := _state.DeployGenesisContract(creationCode)
+	if err != nil {
+		return err
+	}
+
+	genesis, err := readGenesis(config.Genesis)
+	if err != nil {
+		return err
+	}
+
+	genesis.Poa = bcommon.PoaMap{
+		Address: common.HexToAddress(poaAddress).Hex(),
+		Balance: balance.String(),
+		Storage: storage,
+		Abi:     string(bytes.TrimSpace(abiJSON)),
+		Code:    code,
+	}
+
+	logger.WithFields(logrus.Fields{
+		"address":   genesis.Poa.Address,
+		"whitelist": len(whitelist),
+	}).Info("Embedded POA contract")
+
+	return writeGenesis(config.Genesis, genesis)
+}
@@ -0,0 +1,56 @@
+package genesis
+
+import (
+	"fmt"
+
+	"github.com/spf13/cobra"
+)
+
+var (
+	setChainID  uint64
+	setGasLimit uint64
+)
+
+//NewSetCmd returns the command that sets the chain parameters of the genesis
+//file
+func NewSetCmd() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "set",
+		Short: "Set the chain ID or the block gas limit of the genesis file",
+		Long: `Set the chain ID or the block gas limit of the genesis file.
+
+Only the flags which are set are changed. 0 restores the default value. A
+genesis file without a block gas limit does not bound the blocks in practice,
+and the node warns about it on startup.`,
+		Args: cobra.NoArgs,
+		RunE: runSet,
+	}
+
+	cmd.Flags().Uint64Var(&setChainID, "chain-id", 0, "Chain ID (0 for the default, 1)")
+	cmd.Flags().Uint64Var(&setGasLimit, "gas-limit", 0, "Block gas limit (0 for no practical limit, 10^18)")
+
+	return cmd
+}
+
+func runSet(cmd *cobra.Command, args []string) error {
+	chainIDChanged := cmd.Flags().Changed("chain-id")
+	gasLimitChanged := cmd.Flags().Changed("gas-limit")
+
+	if !chainIDChanged && !gasLimitChanged {
+		return fmt.Errorf("At least one of --chain-id and --gas-limit is required")
+	}
+
+	genesis, err := readGenesis(config.Genesis)
+	if err != nil {
+		return err
+	}
+
+	if chainIDChanged {
+		genesis.ChainID = setChainID
+	}
+	if gasLimitChanged {
+		genesis.GasLimit = setGasLimit
+	}
+
+	return writeGenesis(config.Genesis, genesis)
+}
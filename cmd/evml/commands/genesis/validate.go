@@ -0,0 +1,57 @@
+package genesis
+
+import (
+	"fmt"
+
+	_state "github.com/mosaicnetworks/evm-lite/src/state"
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+)
+
+//NewValidateCmd returns the command that validates a genesis file
+func NewValidateCmd() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "validate [file]",
+		Short: "Validate a genesis file",
+		Long: `Validate a genesis file.
+
+The file defaults to the configured genesis file. Its accounts, POA contract,
+precompile addresses, and fee policy are checked. The names of the precompiles
+are not checked, because they are registered by the application embedding
+EVM-Lite.`,
+		Args: cobra.MaximumNArgs(1),
+		RunE: runValidate,
+	}
+
+	return cmd
+}
+
+func runValidate(cmd *cobra.Command, args []string) error {
+	path := config.Genesis
+	if len(args) > 0 {
+		path = args[0]
+	}
+
+	genesis, err := readGenesis(path)
+	if err != nil {
+		return err
+	}
+
+	if err := _state.ValidateGenesis(genesis); err != nil {
+		return fmt.Errorf("Invalid genesis file %s: %v", path, err)
+	}
+
+	if genesis.GasLimit == 0 {
+		logger.WithField("file", path).Warn("No block gas limit. Set one with evml genesis set --gas-limit")
+	}
+
+	logger.WithFields(logrus.Fields{
+		"file":      path,
+		"accounts":  len(genesis.Alloc),
+		"poa":       genesis.Poa.Address,
+		"chain_id":  genesis.ChainID,
+		"gas_limit": genesis.GasLimit,
+	}).Info("Valid genesis file")
+
+	return nil
+}
@@ -0,0 +1,98 @@
+package keys
+
+import (
+	"io"
+	"io/ioutil"
+	"os"
+
+	"github.com/ethereum/go-ethereum/accounts/keystore"
+	"github.com/ethereum/go-ethereum/common/hexutil"
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/spf13/cobra"
+)
+
+var (
+	exportOut     string
+	exportPrivate bool
+)
+
+//NewExportCmd returns the command that exports an account of the keystore
+func NewExportCmd() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "export [address]",
+		Short: "Export an account of the keystore",
+		Long: `Export an account of the keystore.
+
+By default, the key is written as a JSON key file, encrypted with a new password
+read with --key-pwd or prompted for. With --private, the unencrypted private key
+is written in hex instead.`,
+		Args: cobra.ExactArgs(1),
+		RunE: runExport,
+	}
+
+	cmd.Flags().StringVarP(&exportOut, "out", "o", "", "Output file (default stdout)")
+	cmd.Flags().StringVar(&keyPwdFile, "key-pwd", "", "File containing the password of the exported JSON key file (default prompt)")
+	cmd.Flags().BoolVar(&exportPrivate, "private", false, "Export the unencrypted private key")
+
+	return cmd
+}
+
+func runExport(cmd *cobra.Command, args []string) error {
+	ks, err := openKeyStore()
+	if err != nil {
+		return err
+	}
+
+	account, err := findAccount(ks, args[0])
+	if err != nil {
+		return err
+	}
+
+	password, err := getPassword(pwdFile, "Password: ", false)
+	if err != nil {
+		return err
+	}
+
+	var exported []byte
+	if exportPrivate {
+		keyJSON, err := ioutil.ReadFile(account.URL.Path)
+		if err != nil {
+			return err
+		}
+
+		key, err := keystore.DecryptKey(keyJSON, password)
+		if err != nil {
+			return err
+		}
+
+		exported = []byte(hexutil.Encode(crypto.FromECDSA(key.PrivateKey)) + "\n")
+	} else {
+		newPassword, err := getPassword(keyPwdFile, "Password of the key file: ", true)
+		if err != nil {
+			return err
+		}
+
+		exported, err = ks.Export(account, password, newPassword)
+		if err != nil {
+			return err
+		}
+	}
+
+	var out io.Writer = os.Stdout
+	if exportOut != "" {
+		f, err := os.OpenFile(exportOut, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0600)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		out = f
+	}
+
+	if _, err := out.Write(exported); err != nil {
+		return err
+	}
+
+	logger.WithField("address", account.Address.Hex()).Info("Exported account")
+
+	return nil
+}
@@ -0,0 +1,85 @@
+package keys
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"strings"
+
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/spf13/cobra"
+)
+
+//NewImportCmd returns the command that imports a key into the keystore
+func NewImportCmd() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "import [keyfile]",
+		Short: "Import a raw private key or a JSON key file into the keystore",
+		Long: `Import a raw private key or a JSON key file into the keystore.
+
+The file contains either an unencrypted private key, in hex, or an encrypted
+JSON key file, whose password is read with --key-pwd or prompted for. The key
+is written to the keystore encrypted with the password of the account.`,
+		Args: cobra.ExactArgs(1),
+		RunE: runImport,
+	}
+
+	cmd.Flags().StringVar(&keyPwdFile, "key-pwd", "", "File containing the password of the JSON key file (default prompt)")
+
+	return cmd
+}
+
+func runImport(cmd *cobra.Command, args []string) error {
+	data, err := ioutil.ReadFile(args[0])
+	if err != nil {
+		return err
+	}
+	data = bytes.TrimSpace(data)
+
+	ks, err := openKeyStore()
+	if err != nil {
+		return err
+	}
+
+	if bytes.HasPrefix(data, []byte("{")) {
+		keyPassword, err := getPassword(keyPwdFile, "Password of the key file: ", false)
+		if err != nil {
+			return err
+		}
+
+		password, err := getPassword(pwdFile, "Password: ", true)
+		if err != nil {
+			return err
+		}
+
+		account, err := ks.Import(data, keyPassword, password)
+		if err != nil {
+			return err
+		}
+
+		fmt.Printf("Address: %s\n", account.Address.Hex())
+		fmt.Printf("File:    %s\n", account.URL.Path)
+
+		return nil
+	}
+
+	key, err := crypto.HexToECDSA(strings.TrimPrefix(string(data), "0x"))
+	if err != nil {
+		return fmt.Errorf("Invalid private key: %v", err)
+	}
+
+	password, err := getPassword(pwdFile, "Password: ", true)
+	if err != nil {
+		return err
+	}
+
+	account, err := ks.ImportECDSA(key, password)
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("Address: %s\n", account.Address.Hex())
+	fmt.Printf("File:    %s\n", account.URL.Path)
+
+	return nil
+}
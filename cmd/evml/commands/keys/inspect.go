@@ -0,0 +1,89 @@
+package keys
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+
+	"github.com/ethereum/go-ethereum/accounts/keystore"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/common/hexutil"
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/spf13/cobra"
+)
+
+var inspectPrivate bool
+
+//NewInspectCmd returns the command that prints the details of a key file
+func NewInspectCmd() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "inspect [address|keyfile]",
+		Short: "Print the details of a key file",
+		Long: `Print the details of a key file.
+
+The key file is given by its path, or by the address of an account of the
+keystore. With --private, the key is decrypted, and its public and private keys
+are printed as well.`,
+		Args: cobra.ExactArgs(1),
+		RunE: runInspect,
+	}
+
+	cmd.Flags().BoolVar(&inspectPrivate, "private", false, "Decrypt the key and print the private key")
+
+	return cmd
+}
+
+func runInspect(cmd *cobra.Command, args []string) error {
+	path := args[0]
+
+	if common.IsHexAddress(path) {
+		ks, err := openKeyStore()
+		if err != nil {
+			return err
+		}
+
+		account, err := findAccount(ks, path)
+		if err != nil {
+			return err
+		}
+		path = account.URL.Path
+	}
+
+	keyJSON, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+
+	var keyFile struct {
+		Address string `json:"address"`
+		ID      string `json:"id"`
+		Version int    `json:"version"`
+	}
+	if err := json.Unmarshal(keyJSON, &keyFile); err != nil {
+		return fmt.Errorf("Invalid key file %s: %v", path, err)
+	}
+
+	fmt.Printf("Address: %s\n", common.HexToAddress(keyFile.Address).Hex())
+	fmt.Printf("File:    %s\n", path)
+	fmt.Printf("ID:      %s\n", keyFile.ID)
+	fmt.Printf("Version: %d\n", keyFile.Version)
+
+	if !inspectPrivate {
+		return nil
+	}
+
+	password, err := getPassword(pwdFile, "Password: ", false)
+	if err != nil {
+		return err
+	}
+
+	key, err := keystore.DecryptKey(keyJSON, password)
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("Public key:  %s\n", hexutil.Encode(crypto.FromECDSAPub(&key.PrivateKey.PublicKey)))
+	fmt.Printf("Private key: %s\n", hexutil.Encode(crypto.FromECDSA(key.PrivateKey)))
+
+	return nil
+}
@@ -0,0 +1,120 @@
+package keys
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/ethereum/go-ethereum/accounts"
+	"github.com/ethereum/go-ethereum/accounts/keystore"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/console"
+	"github.com/mosaicnetworks/evm-lite/cmd/evml/commands/utils"
+	_config "github.com/mosaicnetworks/evm-lite/src/config"
+	"github.com/mosaicnetworks/evm-lite/src/service"
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+)
+
+var (
+	config = _config.DefaultConfig()
+	logger = logrus.New()
+
+	// pwdFile contains the password of the accounts in the keystore
+	pwdFile string
+	// keyPwdFile contains the password of a key file which is imported or
+	// exported
+	keyPwdFile string
+)
+
+//KeysCmd groups the commands that manage the encrypted key files of the
+//keystore
+var KeysCmd = &cobra.Command{
+	Use:   "keys",
+	Short: "Create, import, export and inspect the accounts of the keystore",
+	Long: `Create, import, export and inspect the accounts of the keystore.
+
+Accounts are stored in the keystore directory (--eth.keystore) as encrypted JSON
+key files, in the format used by go-ethereum. Passwords are prompted for, unless
+they are read from the first non-empty line of a file with --pwd.`,
+	PersistentPreRunE: func(cmd *cobra.Command, args []string) (err error) {
+		config, err = utils.LoadConfig(cmd, logger)
+		if err != nil {
+			return err
+		}
+
+		// Log to stderr, so that an export can be written to stdout
+		logger.Level = utils.LogLevel(config.LogLevel)
+
+		logger.WithFields(logrus.Fields{
+			"Base": config}).Debug("Config")
+
+		return nil
+	},
+}
+
+func init() {
+	//Subcommands
+	KeysCmd.AddCommand(
+		NewNewCmd(),
+		NewListCmd(),
+		NewImportCmd(),
+		NewExportCmd(),
+		NewInspectCmd())
+
+	utils.AddBaseFlags(KeysCmd, config)
+	KeysCmd.PersistentFlags().String("eth.keystore", config.Keystore, "Keystore directory")
+	KeysCmd.PersistentFlags().StringVar(&pwdFile, "pwd", "", "File containing the password of the account (default prompt)")
+}
+
+//openKeyStore opens the configured keystore directory, creating it if needed
+func openKeyStore() (*keystore.KeyStore, error) {
+	if err := os.MkdirAll(config.Keystore, 0700); err != nil {
+		return nil, err
+	}
+
+	return keystore.NewKeyStore(config.Keystore, keystore.StandardScryptN, keystore.StandardScryptP), nil
+}
+
+//findAccount returns the account of the keystore with the given address
+func findAccount(ks *keystore.KeyStore, addr string) (accounts.Account, error) {
+	if !common.IsHexAddress(addr) {
+		return accounts.Account{}, fmt.Errorf("Invalid address %q", addr)
+	}
+
+	account, err := ks.Find(accounts.Account{Address: common.HexToAddress(addr)})
+	if err != nil {
+		return accounts.Account{}, fmt.Errorf("Account %s is not in keystore %s", addr, config.Keystore)
+	}
+
+	return account, nil
+}
+
+//getPassword reads a password from the first non-empty line of a file, like
+//the Signer of the node, or prompts for it if file is empty. New passwords are
+//prompted for twice.
+func getPassword(file string, prompt string, confirm bool) (string, error) {
+	if file != "" {
+		passwords, err := service.ReadPasswords(file)
+		if err != nil {
+			return "", err
+		}
+		return passwords[0], nil
+	}
+
+	password, err := console.Stdin.PromptPassword(prompt)
+	if err != nil {
+		return "", err
+	}
+
+	if confirm {
+		repeat, err := console.Stdin.PromptPassword("Repeat password: ")
+		if err != nil {
+			return "", err
+		}
+		if password != repeat {
+			return "", fmt.Errorf("Passwords do not match")
+		}
+	}
+
+	return password, nil
+}
@@ -0,0 +1,125 @@
+package keys
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"testing"
+)
+
+// runKeys executes the keys command with the given arguments, and returns what
+// it printed on stdout
+func runKeys(t *testing.T, args ...string) (string, error) {
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	stdout := os.Stdout
+	os.Stdout = w
+	defer func() { os.Stdout = stdout }()
+
+	out := make(chan []byte)
+	go func() {
+		var buf bytes.Buffer
+		io.Copy(&buf, r)
+		out <- buf.Bytes()
+	}()
+
+	KeysCmd.SetArgs(args)
+	err = KeysCmd.Execute()
+
+	w.Close()
+	return string(<-out), err
+}
+
+var _addressRegexp = regexp.MustCompile(`Address: (0x[0-9a-fA-F]{40})`)
+
+// TestKeysRoundTrip creates an account, lists it, exports its private key, and
+// imports it in another keystore
+func TestKeysRoundTrip(t *testing.T) {
+	dir, err := ioutil.TempDir("", "evml-keys")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	keystoreDir := filepath.Join(dir, "keystore")
+	otherDir := filepath.Join(dir, "other")
+	keyFile := filepath.Join(dir, "key.txt")
+
+	// Empty lines are skipped, like in the password file of the node
+	pwd := filepath.Join(dir, "pwd.txt")
+	if err := ioutil.WriteFile(pwd, []byte("\r\n\npassword\r\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	out, err := runKeys(t, "new", "--datadir", dir, "--eth.keystore", keystoreDir, "--pwd", pwd)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	match := _addressRegexp.FindStringSubmatch(out)
+	if match == nil {
+		t.Fatalf("new should print the address of the account, not %q", out)
+	}
+	address := match[1]
+
+	out, err = runKeys(t, "list", "--datadir", dir, "--eth.keystore", keystoreDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !regexp.MustCompile(`Account #0: ` + address).MatchString(out) {
+		t.Fatalf("list should print account %s, not %q", address, out)
+	}
+
+	// The password is the first non-empty line
+	onlyPwd := filepath.Join(dir, "only-pwd.txt")
+	if err := ioutil.WriteFile(onlyPwd, []byte("password"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := runKeys(t, "export", address, "--private", "--out", keyFile, "--datadir", dir, "--eth.keystore", keystoreDir, "--pwd", onlyPwd); err != nil {
+		t.Fatal(err)
+	}
+
+	out, err = runKeys(t, "import", keyFile, "--datadir", dir, "--eth.keystore", otherDir, "--pwd", pwd)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	match = _addressRegexp.FindStringSubmatch(out)
+	if match == nil || match[1] != address {
+		t.Fatalf("import should print address %s, not %q", address, out)
+	}
+}
+
+// TestEmptyPasswordFile checks that a password file without a password is
+// rejected, instead of encrypting the key with an empty password
+func TestEmptyPasswordFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "evml-keys")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	keystoreDir := filepath.Join(dir, "keystore")
+
+	pwd := filepath.Join(dir, "pwd.txt")
+	if err := ioutil.WriteFile(pwd, []byte("\n\r\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := runKeys(t, "new", "--datadir", dir, "--eth.keystore", keystoreDir, "--pwd", pwd); err == nil {
+		t.Fatal("new should fail with an empty password file")
+	}
+
+	files, _ := ioutil.ReadDir(keystoreDir)
+	if len(files) != 0 {
+		t.Fatalf("No account should be created, not %d", len(files))
+	}
+}
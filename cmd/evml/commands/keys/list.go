@@ -0,0 +1,32 @@
+package keys
+
+import (
+	"fmt"
+
+	"github.com/spf13/cobra"
+)
+
+//NewListCmd returns the command that lists the accounts of the keystore
+func NewListCmd() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "list",
+		Short: "List the accounts of the keystore",
+		Args:  cobra.NoArgs,
+		RunE:  runList,
+	}
+
+	return cmd
+}
+
+func runList(cmd *cobra.Command, args []string) error {
+	ks, err := openKeyStore()
+	if err != nil {
+		return err
+	}
+
+	for i, account := range ks.Accounts() {
+		fmt.Printf("Account #%d: %s %s\n", i, account.Address.Hex(), account.URL.Path)
+	}
+
+	return nil
+}
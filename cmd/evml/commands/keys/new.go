@@ -0,0 +1,45 @@
+package keys
+
+import (
+	"fmt"
+
+	"github.com/spf13/cobra"
+)
+
+//NewNewCmd returns the command that creates an account in the keystore
+func NewNewCmd() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "new",
+		Short: "Create a new account in the keystore",
+		Long: `Create a new account in the keystore.
+
+A new private key is generated and written to the keystore, encrypted with the
+password. The address and the key file of the account are printed.`,
+		Args: cobra.NoArgs,
+		RunE: runNew,
+	}
+
+	return cmd
+}
+
+func runNew(cmd *cobra.Command, args []string) error {
+	ks, err := openKeyStore()
+	if err != nil {
+		return err
+	}
+
+	password, err := getPassword(pwdFile, "Password: ", true)
+	if err != nil {
+		return err
+	}
+
+	account, err := ks.NewAccount(password)
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("Address: %s\n", account.Address.Hex())
+	fmt.Printf("File:    %s\n", account.URL.Path)
+
+	return nil
+}
@@ -1,7 +1,11 @@
 package commands
 
 import (
+	"github.com/mosaicnetworks/evm-lite/cmd/evml/commands/db"
+	"github.com/mosaicnetworks/evm-lite/cmd/evml/commands/genesis"
+	"github.com/mosaicnetworks/evm-lite/cmd/evml/commands/keys"
 	"github.com/mosaicnetworks/evm-lite/cmd/evml/commands/run"
+	"github.com/mosaicnetworks/evm-lite/cmd/evml/commands/state"
 	"github.com/spf13/cobra"
 )
 
@@ -14,6 +18,10 @@ var RootCmd = &cobra.Command{
 func init() {
 	RootCmd.AddCommand(
 		run.RunCmd,
+		state.StateCmd,
+		db.DbCmd,
+		keys.KeysCmd,
+		genesis.GenesisCmd,
 	)
 	//do not print usage when error occurs
 	RootCmd.SilenceUsage = true
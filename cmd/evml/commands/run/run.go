@@ -1,11 +1,11 @@
 package run
 
 import (
+	"github.com/mosaicnetworks/evm-lite/cmd/evml/commands/utils"
 	_config "github.com/mosaicnetworks/evm-lite/src/config"
 	"github.com/mosaicnetworks/evm-lite/src/version"
 	"github.com/sirupsen/logrus"
 	"github.com/spf13/cobra"
-	"github.com/spf13/viper"
 )
 
 var (
@@ -19,22 +19,16 @@ var RunCmd = &cobra.Command{
 	Short:            "Run a node",
 	TraverseChildren: true,
 	PersistentPreRunE: func(cmd *cobra.Command, args []string) (err error) {
-		if err := bindFlagsLoadViper(cmd); err != nil {
-			return err
-		}
-
-		config, err = parseConfig()
+		config, err = utils.LoadConfig(cmd, logger)
 		if err != nil {
 			return err
 		}
 
 		logger = logrus.New()
-		logger.Level = logLevel(config.LogLevel)
+		logger.Level = utils.LogLevel(config.LogLevel)
 
 		logger.WithField("Version", version.Version).Info("Run")
 
-		config.SetDataDir(config.DataDir)
-
 		logger.WithFields(logrus.Fields{
 			"Base": config}).Debug("Config")
 
@@ -48,68 +42,22 @@ func init() {
 		NewSoloCmd())
 
 	//Base config
-	RunCmd.PersistentFlags().StringP("datadir", "d", config.DataDir, "Top-level directory for configuration and data")
-	RunCmd.PersistentFlags().String("log", config.LogLevel, "debug, info, warn, error, fatal, panic")
+	utils.AddBaseFlags(RunCmd, config)
 
 	//Eth config
-	RunCmd.PersistentFlags().String("eth.genesis", config.Genesis, "Location of genesis file")
-	RunCmd.PersistentFlags().String("eth.db", config.DbFile, "Eth database file")
+	utils.AddEthFlags(RunCmd, config)
 	RunCmd.PersistentFlags().String("eth.listen", config.EthAPIAddr, "Address of HTTP API service")
-	RunCmd.PersistentFlags().Int("eth.cache", config.Cache, "Megabytes of memory allocated to internal caching (min 16MB / database forced)")
-
-}
-
-//------------------------------------------------------------------------------
-
-//Retrieve the default environment configuration.
-func parseConfig() (*_config.Config, error) {
-	conf := _config.DefaultConfig()
-	err := viper.Unmarshal(conf)
-	if err != nil {
-		return nil, err
-	}
-	return conf, err
-}
-
-//Bind all flags and read the config into viper
-func bindFlagsLoadViper(cmd *cobra.Command) error {
-	// cmd.Flags() includes flags from this command and all persistent flags from the parent
-	if err := viper.BindPFlags(cmd.Flags()); err != nil {
-		return err
-	}
-
-	viper.SetConfigName("evml")         // name of config file (without extension)
-	viper.AddConfigPath(config.DataDir) // search root directory
-
-	// If a config file is found, read it in.
-	if err := viper.ReadInConfig(); err == nil {
-		// stderr, so if we redirect output to json file, this doesn't appear
-		logger.Debugf("Using config file: %s", viper.ConfigFileUsed())
-	} else if _, ok := err.(viper.ConfigFileNotFoundError); ok {
-		logger.Debugf("No config file found in %s", config.DataDir)
-	} else {
-
-		return err
-	}
-
-	return nil
-}
-
-func logLevel(l string) logrus.Level {
-	switch l {
-	case "debug":
-		return logrus.DebugLevel
-	case "info":
-		return logrus.InfoLevel
-	case "warn":
-		return logrus.WarnLevel
-	case "error":
-		return logrus.ErrorLevel
-	case "fatal":
-		return logrus.FatalLevel
-	case "panic":
-		return logrus.PanicLevel
-	default:
-		return logrus.DebugLevel
-	}
+	RunCmd.PersistentFlags().Int("eth.parallel", config.Parallel, "Number of workers executing the transactions of a block in parallel (0 to disable)")
+	RunCmd.PersistentFlags().Bool("eth.state-diffs", config.StateDiffs, "Record the state diff of every transaction")
+	RunCmd.PersistentFlags().Bool("eth.internal-txs", config.InternalTxs, "Record the internal transactions of every transaction")
+	RunCmd.PersistentFlags().Uint64("eth.block-gas-limit", config.BlockGasLimit, "Expected block gas limit. The node does not start if it differs from the genesis file (0 to skip the check)")
+	RunCmd.PersistentFlags().Uint64("eth.call-gas-cap", config.CallGasCap, "Maximum gas of a call (0 to use the block gas limit)")
+	RunCmd.PersistentFlags().Duration("eth.call-timeout", config.CallTimeout, "Maximum execution time of a call (0 for no limit)")
+	RunCmd.PersistentFlags().Int("eth.max-calls", config.MaxCalls, "Maximum number of concurrent calls (0 for no limit)")
+	RunCmd.PersistentFlags().Bool("eth.signer", config.Signer, "Sign the unsigned transactions submitted to the API with the unlocked accounts of the keystore")
+	RunCmd.PersistentFlags().String("eth.keystore", config.Keystore, "Keystore directory of the signer")
+	RunCmd.PersistentFlags().String("eth.pwd", config.PwdFile, "Password file of the signer, with one password per account")
+	RunCmd.PersistentFlags().StringSlice("eth.unlock", config.Unlock, "Accounts unlocked by the signer (default all the accounts of the keystore)")
+	RunCmd.PersistentFlags().Bool("eth.vm-debug", config.VMDebug, "Trace every transaction to a rotating file (slow)")
+	RunCmd.PersistentFlags().String("eth.vm-debug-file", config.VMDebugFile, "File to which transactions are traced with --eth.vm-debug")
 }
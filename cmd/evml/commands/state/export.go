@@ -0,0 +1,88 @@
+package state
+
+import (
+	"io"
+	"os"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/mosaicnetworks/evm-lite/cmd/evml/commands/utils"
+	_state "github.com/mosaicnetworks/evm-lite/src/state"
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+)
+
+var (
+	exportOut    string
+	exportRoot   string
+	exportFormat string
+	exportPrefix string
+)
+
+//NewExportCmd returns the command that exports the state of a stopped node
+func NewExportCmd() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "export",
+		Short: "Export the state from the database of a stopped node",
+		Long: `Export the state from the database of a stopped node.
+
+By default, the state at the last committed root is written to stdout in the
+genesis format, which can be reused as a genesis file or imported with
+'evml state import'.`,
+		RunE: runExport,
+	}
+
+	cmd.Flags().StringVarP(&exportOut, "out", "o", "", "Output file (default stdout)")
+	cmd.Flags().StringVar(&exportRoot, "root", "", "State root to export (default last committed root)")
+	cmd.Flags().StringVar(&exportFormat, "format", "genesis", "genesis or ndjson")
+	cmd.Flags().StringVar(&exportPrefix, "prefix", "", "Only export accounts whose address starts with this hex prefix")
+
+	return cmd
+}
+
+func runExport(cmd *cobra.Command, args []string) error {
+	format, err := _state.ParseExportFormat(exportFormat)
+	if err != nil {
+		return err
+	}
+
+	state, err := utils.OpenState(config, logger)
+	if err != nil {
+		return err
+	}
+	defer state.Close()
+
+	var out io.Writer = os.Stdout
+	if exportOut != "" {
+		f, err := os.Create(exportOut)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		out = f
+	}
+
+	opts := _state.ExportOptions{
+		Format: format,
+		Prefix: exportPrefix,
+		Progress: func(p _state.ExportProgress) {
+			logger.WithFields(logrus.Fields{
+				"visited":  p.Visited,
+				"exported": p.Exported,
+				"elapsed":  p.Elapsed,
+			}).Info("Exporting")
+		},
+	}
+
+	if exportRoot != "" {
+		opts.Root = common.HexToHash(exportRoot)
+	}
+
+	root, err := state.Export(out, opts)
+	if err != nil {
+		return err
+	}
+
+	logger.WithField("root", root.Hex()).Info("Exported state")
+
+	return nil
+}
@@ -0,0 +1,90 @@
+package state
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"github.com/mosaicnetworks/evm-lite/cmd/evml/commands/utils"
+	"github.com/mosaicnetworks/evm-lite/src/common"
+	_state "github.com/mosaicnetworks/evm-lite/src/state"
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+)
+
+var importFile string
+
+//NewImportCmd returns the command that creates the database of a new node from
+//an exported state
+func NewImportCmd() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "import",
+		Short: "Create the database of a new node from an exported state",
+		Long: `Create the database of a new node from a state exported with
+'evml state export' in the genesis format.
+
+The database must not contain a committed state already. If the export
+records its root, the root of the imported state must match it. If there is no
+genesis file, one is created with the poa section and the chain parameters of
+the export (chain ID, gas limit, fee policy, and precompiles), so that the node
+finds the POA smart-contract and runs with the same parameters when it starts.`,
+		RunE: runImport,
+	}
+
+	cmd.Flags().StringVarP(&importFile, "file", "f", "", "Exported state to import")
+	cmd.MarkFlagRequired("file")
+
+	return cmd
+}
+
+func runImport(cmd *cobra.Command, args []string) error {
+	f, err := os.Open(importFile)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	if err := os.MkdirAll(filepath.Dir(config.DbFile), 0755); err != nil {
+		return err
+	}
+
+	db, err := utils.OpenDatabase(config)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	result, err := _state.ImportState(db,
+		f,
+		logger.WithField("component", "state"))
+	if err != nil {
+		return fmt.Errorf("Error importing state: %s", err)
+	}
+
+	if _, err := os.Stat(config.Genesis); os.IsNotExist(err) {
+		if err := writeGenesis(config.Genesis, result.Genesis()); err != nil {
+			return err
+		}
+		logger.WithField("file", config.Genesis).Info("Created genesis file")
+	}
+
+	logger.WithFields(logrus.Fields{
+		"root":     result.Root.Hex(),
+		"accounts": result.Accounts,
+	}).Info("Imported state")
+
+	return nil
+}
+
+// writeGenesis writes the genesis file of an imported state. The accounts are
+// already in the imported database.
+func writeGenesis(genesisFile string, genesis common.Genesis) error {
+	js, err := json.MarshalIndent(genesis, "", "\t")
+	if err != nil {
+		return err
+	}
+
+	return ioutil.WriteFile(genesisFile, js, 0644)
+}
@@ -0,0 +1,44 @@
+package state
+
+import (
+	"github.com/mosaicnetworks/evm-lite/cmd/evml/commands/utils"
+	_config "github.com/mosaicnetworks/evm-lite/src/config"
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+)
+
+var (
+	config = _config.DefaultConfig()
+	logger = logrus.New()
+)
+
+//StateCmd groups the commands that operate on the state of a stopped node,
+//directly on its database
+var StateCmd = &cobra.Command{
+	Use:   "state",
+	Short: "Export and import the state of a stopped node",
+	PersistentPreRunE: func(cmd *cobra.Command, args []string) (err error) {
+		config, err = utils.LoadConfig(cmd, logger)
+		if err != nil {
+			return err
+		}
+
+		// Log to stderr, so that an export can be written to stdout
+		logger.Level = utils.LogLevel(config.LogLevel)
+
+		logger.WithFields(logrus.Fields{
+			"Base": config}).Debug("Config")
+
+		return nil
+	},
+}
+
+func init() {
+	//Subcommands
+	StateCmd.AddCommand(
+		NewExportCmd(),
+		NewImportCmd())
+
+	utils.AddBaseFlags(StateCmd, config)
+	utils.AddEthFlags(StateCmd, config)
+}
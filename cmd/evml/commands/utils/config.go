@@ -0,0 +1,149 @@
+package utils
+
+import (
+	"fmt"
+
+	_config "github.com/mosaicnetworks/evm-lite/src/config"
+	"github.com/mosaicnetworks/evm-lite/src/database"
+	_state "github.com/mosaicnetworks/evm-lite/src/state"
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+)
+
+//AddBaseFlags adds the datadir and log flags to a command and its children
+func AddBaseFlags(cmd *cobra.Command, config *_config.Config) {
+	cmd.PersistentFlags().StringP("datadir", "d", config.DataDir, "Top-level directory for configuration and data")
+	cmd.PersistentFlags().String("log", config.LogLevel, "debug, info, warn, error, fatal, panic")
+}
+
+//AddEthFlags adds the flags that locate the Ethereum data of a node to a
+//command and its children
+func AddEthFlags(cmd *cobra.Command, config *_config.Config) {
+	cmd.PersistentFlags().String("eth.genesis", config.Genesis, "Location of genesis file")
+	cmd.PersistentFlags().String("eth.db", config.DbFile, "Eth database file")
+	cmd.PersistentFlags().String("eth.db-engine", config.DbEngine, "Eth database engine: leveldb, memory, or badger")
+	cmd.PersistentFlags().Int("eth.cache", config.Cache, "Megabytes of memory allocated to internal caching (min 16MB / database forced)")
+}
+
+//LoadConfig binds the flags of a command, reads the evml config file in the
+//datadir if there is one, and returns the resulting configuration with the
+//eth directories set relative to the datadir.
+func LoadConfig(cmd *cobra.Command, logger *logrus.Logger) (*_config.Config, error) {
+	// cmd.Flags() includes flags from this command and all persistent flags from the parent
+	if err := viper.BindPFlags(cmd.Flags()); err != nil {
+		return nil, err
+	}
+
+	viper.SetConfigName("evml")                     // name of config file (without extension)
+	viper.AddConfigPath(viper.GetString("datadir")) // search root directory
+
+	// If a config file is found, read it in.
+	if err := viper.ReadInConfig(); err == nil {
+		// stderr, so if we redirect output to json file, this doesn't appear
+		logger.Debugf("Using config file: %s", viper.ConfigFileUsed())
+	} else if _, ok := err.(viper.ConfigFileNotFoundError); ok {
+		logger.Debugf("No config file found in %s", viper.GetString("datadir"))
+	} else {
+		return nil, err
+	}
+
+	config := _config.DefaultConfig()
+	if err := viper.Unmarshal(config); err != nil {
+		return nil, err
+	}
+
+	// viper nests the eth.* keys under eth, so they are not picked up by
+	// Unmarshal
+	if viper.IsSet("eth.genesis") {
+		config.Genesis = viper.GetString("eth.genesis")
+	}
+	if viper.IsSet("eth.db") {
+		config.DbFile = viper.GetString("eth.db")
+	}
+	if viper.IsSet("eth.db-engine") {
+		config.DbEngine = viper.GetString("eth.db-engine")
+	}
+	if viper.IsSet("eth.listen") {
+		config.EthAPIAddr = viper.GetString("eth.listen")
+	}
+	if viper.IsSet("eth.cache") {
+		config.Cache = viper.GetInt("eth.cache")
+	}
+	if viper.IsSet("eth.parallel") {
+		config.Parallel = viper.GetInt("eth.parallel")
+	}
+	if viper.IsSet("eth.state-diffs") {
+		config.StateDiffs = viper.GetBool("eth.state-diffs")
+	}
+	if viper.IsSet("eth.internal-txs") {
+		config.InternalTxs = viper.GetBool("eth.internal-txs")
+	}
+	if viper.IsSet("eth.block-gas-limit") {
+		config.BlockGasLimit = viper.GetUint64("eth.block-gas-limit")
+	}
+	if viper.IsSet("eth.call-gas-cap") {
+		config.CallGasCap = viper.GetUint64("eth.call-gas-cap")
+	}
+	if viper.IsSet("eth.call-timeout") {
+		config.CallTimeout = viper.GetDuration("eth.call-timeout")
+	}
+	if viper.IsSet("eth.max-calls") {
+		config.MaxCalls = viper.GetInt("eth.max-calls")
+	}
+	if viper.IsSet("eth.signer") {
+		config.Signer = viper.GetBool("eth.signer")
+	}
+	if viper.IsSet("eth.keystore") {
+		config.Keystore = viper.GetString("eth.keystore")
+	}
+	if viper.IsSet("eth.pwd") {
+		config.PwdFile = viper.GetString("eth.pwd")
+	}
+	if viper.IsSet("eth.unlock") {
+		config.Unlock = viper.GetStringSlice("eth.unlock")
+	}
+	if viper.IsSet("eth.vm-debug") {
+		config.VMDebug = viper.GetBool("eth.vm-debug")
+	}
+	if viper.IsSet("eth.vm-debug-file") {
+		config.VMDebugFile = viper.GetString("eth.vm-debug-file")
+	}
+
+	config.SetDataDir(config.DataDir)
+
+	return config, nil
+}
+
+//OpenDatabase opens the database of a node with the configured engine
+func OpenDatabase(config *_config.Config) (database.Database, error) {
+	db, err := database.Open(config.DbEngine, config.DbFile, config.Cache)
+	if err != nil {
+		return nil, fmt.Errorf("Error opening database: %s", err)
+	}
+	return db, nil
+}
+
+//OpenState opens the state of a stopped node, which must contain a committed
+//state
+func OpenState(config *_config.Config, logger *logrus.Logger) (*_state.State, error) {
+	db, err := OpenDatabase(config)
+	if err != nil {
+		return nil, err
+	}
+
+	state, err := _state.OpenState(db,
+		config.Genesis,
+		logger.WithField("component", "state"))
+	if err != nil {
+		db.Close()
+		return nil, fmt.Errorf("Error opening state: %s", err)
+	}
+
+	return state, nil
+}
+
+//LogLevel converts a string to a logrus Level
+func LogLevel(l string) logrus.Level {
+	return _config.LogLevel(l)
+}
@@ -0,0 +1,101 @@
+package common
+
+import (
+	"fmt"
+	"os"
+	"sync"
+)
+
+// RotatingFile is a file writer which rotates the file when it reaches a
+// maximum size. The current file is renamed with the suffix .1, the previous
+// ones are shifted, and only the given number of backups are kept.
+type RotatingFile struct {
+	sync.Mutex
+	path    string
+	maxSize int64
+	backups int
+	file    *os.File
+	size    int64
+}
+
+// NewRotatingFile opens a RotatingFile, appending to the file if it exists
+func NewRotatingFile(path string, maxSize int64, backups int) (*RotatingFile, error) {
+	f := &RotatingFile{
+		path:    path,
+		maxSize: maxSize,
+		backups: backups,
+	}
+
+	if err := f.open(); err != nil {
+		return nil, err
+	}
+
+	return f, nil
+}
+
+// Write implements io.Writer. The file is rotated before a write which would
+// make it exceed the maximum size, unless it is empty.
+func (f *RotatingFile) Write(p []byte) (int, error) {
+	f.Lock()
+	defer f.Unlock()
+
+	if f.size > 0 && f.size+int64(len(p)) > f.maxSize {
+		if err := f.rotate(); err != nil {
+			return 0, err
+		}
+	}
+
+	n, err := f.file.Write(p)
+	f.size += int64(n)
+
+	return n, err
+}
+
+// Close closes the current file
+func (f *RotatingFile) Close() error {
+	f.Lock()
+	defer f.Unlock()
+
+	return f.file.Close()
+}
+
+func (f *RotatingFile) open() error {
+	file, err := os.OpenFile(f.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return err
+	}
+
+	f.file = file
+	f.size = info.Size()
+
+	return nil
+}
+
+func (f *RotatingFile) rotate() error {
+	if err := f.file.Close(); err != nil {
+		return err
+	}
+
+	if f.backups > 0 {
+		for i := f.backups - 1; i > 0; i-- {
+			os.Rename(f.backup(i), f.backup(i+1))
+		}
+		if err := os.Rename(f.path, f.backup(1)); err != nil {
+			return err
+		}
+	} else if err := os.Remove(f.path); err != nil {
+		return err
+	}
+
+	return f.open()
+}
+
+func (f *RotatingFile) backup(i int) string {
+	return fmt.Sprintf("%s.%d", f.path, i)
+}
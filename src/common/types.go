@@ -1,18 +1,31 @@
 package common
 
 import (
+	"math/big"
+
 	ethcommon "github.com/ethereum/go-ethereum/common"
 	ethTypes "github.com/ethereum/go-ethereum/core/types"
 )
 
-//Genesis File Structure
+//Genesis File Structure. Precompiles maps addresses to the names of the
+//registered precompiles enabled at these addresses. GasLimit is the block gas
+//limit. It defaults to 10^18, which does not bound the blocks in practice, so
+//genesis files should set it. ChainID is the EIP155 chain ID with which
+//transactions are signed, and defaults to 1.
 type Genesis struct {
-	Alloc AccountMap
-	Poa   PoaMap
+	Alloc       AccountMap
+	Poa         PoaMap
+	Precompiles map[string]string `json:"precompiles,omitempty"`
+	Fees        *FeeMap           `json:"fees,omitempty"`
+	GasLimit    uint64            `json:"gasLimit,omitempty"`
+	ChainID     uint64            `json:"chainId,omitempty"`
 }
 
 //AccountMap holds the alloc section of the genesis file
-type AccountMap map[string]struct {
+type AccountMap map[string]GenesisAccount
+
+//GenesisAccount is an account in the alloc section of the genesis file
+type GenesisAccount struct {
 	Code        string            `json:"code"`
 	Storage     map[string]string `json:"storage"`
 	Balance     string            `json:"balance"`
@@ -30,6 +43,14 @@ type PoaMap struct {
 	Nonce   uint64 `json:"nonce,omitempty"`
 }
 
+//FeeMap holds the fees section of the genesis file. Policy is coinbase
+//(default), burn, treasury, or validators. Treasury is required by the treasury
+//policy, and optional with the validators policy, which falls back to it.
+type FeeMap struct {
+	Policy   string `json:"policy"`
+	Treasury string `json:"treasury,omitempty"`
+}
+
 //JSONReceipt is the JSON structure for the return receipt from the tx end
 //point
 type JSONReceipt struct {
@@ -70,3 +91,35 @@ func ToJSONReceipt(receipt *ethTypes.Receipt, tx *ethTypes.Transaction, signer e
 
 	return &jsonReceipt
 }
+
+//Info is the JSON structure returned by the info endpoint. The consensus system
+//populates the consensus-related fields and may add its own values to Extras;
+//the service populates StateRoot, PendingTxs and MinGasPrice.
+type Info struct {
+	// Type is the name of the consensus system (ex: solo, babble, raft)
+	Type string `json:"type"`
+
+	// LastCommittedIndex is the index of the last commit (-1 if none)
+	LastCommittedIndex int64 `json:"last_committed_index"`
+
+	// LastBlockIndex is the index of the last block produced by consensus (-1
+	// if none)
+	LastBlockIndex int64 `json:"last_block_index"`
+
+	// NumPeers is the number of peers in the consensus network, including
+	// this node
+	NumPeers int `json:"num_peers"`
+
+	// StateRoot is the state root of the last commit
+	StateRoot ethcommon.Hash `json:"state_root"`
+
+	// PendingTxs is the number of transactions submitted to consensus by this
+	// node's service which are not committed yet
+	PendingTxs int `json:"pending_txs"`
+
+	// MinGasPrice is the minimum gas price accepted by this node's service
+	MinGasPrice *big.Int `json:"min_gas_price"`
+
+	// Extras holds consensus-specific values
+	Extras map[string]interface{} `json:"extras,omitempty"`
+}
@@ -6,6 +6,7 @@ import (
 	"os/user"
 	"path/filepath"
 	"runtime"
+	"time"
 
 	"github.com/sirupsen/logrus"
 	prefixed "github.com/x-cray/logrus-prefixed-formatter"
@@ -19,8 +20,21 @@ var (
 	defaultCache       = 128
 	defaultEthDir      = fmt.Sprintf("%s/eth", defaultDataDir)
 	defaultGenesisFile = fmt.Sprintf("%s/genesis.json", defaultEthDir)
+	defaultKeystore    = fmt.Sprintf("%s/keystore", defaultEthDir)
+	defaultPwdFile     = fmt.Sprintf("%s/pwd.txt", defaultEthDir)
+	defaultSigner      = false
 	defaultDbFile      = fmt.Sprintf("%s/chaindata", defaultEthDir)
+	defaultDbEngine    = "leveldb"
 	defaultMinGasPrice = "0"
+	defaultParallel    = 0
+	defaultStateDiffs  = false
+	defaultInternalTxs = false
+	defaultVMDebug     = false
+	defaultVMDebugFile = fmt.Sprintf("%s/vm-debug.log", defaultEthDir)
+	defaultGasLimit    = uint64(0)
+	defaultCallGasCap  = uint64(50000000)
+	defaultCallTimeout = 5 * time.Second
+	defaultMaxCalls    = 64
 )
 
 // Config contains de configuration for an EVM-Lite node
@@ -37,12 +51,23 @@ type Config struct {
 	// Location of ethereum account keys
 	Keystore string `mapstructure:"keystore"`
 
-	// File containing passwords to unlock ethereum accounts
+	// File containing passwords to unlock ethereum accounts, one per line
 	PwdFile string `mapstructure:"pwd"`
 
+	// Sign the unsigned transactions submitted to the API with the unlocked
+	// accounts of the keystore
+	Signer bool `mapstructure:"signer"`
+
+	// Addresses of the accounts unlocked by the signer. All the accounts of
+	// the keystore are unlocked if it is empty.
+	Unlock []string `mapstructure:"unlock"`
+
 	// File containing the levelDB database
 	DbFile string `mapstructure:"db"`
 
+	// Database engine: leveldb, memory, or badger
+	DbEngine string `mapstructure:"db-engine"`
+
 	// Address of HTTP API Service
 	EthAPIAddr string `mapstructure:"listen"`
 
@@ -53,19 +78,64 @@ type Config struct {
 	// Minimum gasprice for transactions submitted through this node's service
 	MinGasPrice string `mapstructure:"min-gas-price"`
 
+	// Number of workers executing the transactions of a block speculatively in
+	// parallel. Blocks are executed sequentially if it is lower than 2.
+	Parallel int `mapstructure:"parallel"`
+
+	// Record and persist the state diff of every transaction
+	StateDiffs bool `mapstructure:"state-diffs"`
+
+	// Record and persist the internal transactions of every transaction, and
+	// index them by address
+	InternalTxs bool `mapstructure:"internal-txs"`
+
+	// Expected block gas limit. The node refuses to start if it is not 0 and
+	// differs from the gas limit of the genesis file, which is the only source
+	// of the block gas limit.
+	BlockGasLimit uint64 `mapstructure:"block-gas-limit"`
+
+	// Maximum gas of a call made through the API, which is also the gas of
+	// calls which do not set it. The block gas limit is used if it is 0.
+	CallGasCap uint64 `mapstructure:"call-gas-cap"`
+
+	// Maximum execution time of a call made through the API (0 for no limit)
+	CallTimeout time.Duration `mapstructure:"call-timeout"`
+
+	// Maximum number of calls executed concurrently (0 for no limit)
+	MaxCalls int `mapstructure:"max-calls"`
+
+	// Trace every transaction to a rotating file, for troubleshooting
+	VMDebug bool `mapstructure:"vm-debug"`
+
+	// File to which transactions are traced if VMDebug is set
+	VMDebugFile string `mapstructure:"vm-debug-file"`
+
 	logger *logrus.Logger
 }
 
 // DefaultConfig returns the default configuration for an EVM-Lite node
 func DefaultConfig() *Config {
 	return &Config{
-		DataDir:     defaultDataDir,
-		LogLevel:    defaultLogLevel,
-		Genesis:     defaultGenesisFile,
-		DbFile:      defaultDbFile,
-		EthAPIAddr:  defaultEthAPIAddr,
-		Cache:       defaultCache,
-		MinGasPrice: defaultMinGasPrice,
+		DataDir:       defaultDataDir,
+		LogLevel:      defaultLogLevel,
+		Genesis:       defaultGenesisFile,
+		Keystore:      defaultKeystore,
+		PwdFile:       defaultPwdFile,
+		Signer:        defaultSigner,
+		DbFile:        defaultDbFile,
+		DbEngine:      defaultDbEngine,
+		EthAPIAddr:    defaultEthAPIAddr,
+		Cache:         defaultCache,
+		MinGasPrice:   defaultMinGasPrice,
+		Parallel:      defaultParallel,
+		StateDiffs:    defaultStateDiffs,
+		InternalTxs:   defaultInternalTxs,
+		BlockGasLimit: defaultGasLimit,
+		CallGasCap:    defaultCallGasCap,
+		CallTimeout:   defaultCallTimeout,
+		MaxCalls:      defaultMaxCalls,
+		VMDebug:       defaultVMDebug,
+		VMDebugFile:   defaultVMDebugFile,
 	}
 }
 
@@ -77,9 +147,18 @@ func (c *Config) SetDataDir(datadir string) {
 	if c.Genesis == defaultGenesisFile {
 		c.Genesis = fmt.Sprintf("%s/eth/genesis.json", datadir)
 	}
+	if c.Keystore == defaultKeystore {
+		c.Keystore = fmt.Sprintf("%s/eth/keystore", datadir)
+	}
+	if c.PwdFile == defaultPwdFile {
+		c.PwdFile = fmt.Sprintf("%s/eth/pwd.txt", datadir)
+	}
 	if c.DbFile == defaultDbFile {
 		c.DbFile = fmt.Sprintf("%s/eth/chaindata", datadir)
 	}
+	if c.VMDebugFile == defaultVMDebugFile {
+		c.VMDebugFile = fmt.Sprintf("%s/eth/vm-debug.log", datadir)
+	}
 }
 
 // Logger returns a formatted logrus Entry that supports nested prefixes.
@@ -1,6 +1,7 @@
 package consensus
 
 import (
+	"github.com/mosaicnetworks/evm-lite/src/common"
 	"github.com/mosaicnetworks/evm-lite/src/service"
 	"github.com/mosaicnetworks/evm-lite/src/state"
 )
@@ -9,5 +10,13 @@ import (
 type Consensus interface {
 	Init(*state.State, *service.Service) error
 	Run() error
-	Info() (map[string]string, error)
+	Info() (*common.Info, error)
+}
+
+// ValidatorSetListener is an optional interface for consensus systems which
+// need to reconfigure their membership when the POA whitelist changes. The
+// Engine registers OnValidatorSetUpdate with the State, which calls it after
+// every Commit that changed the validator set.
+type ValidatorSetListener interface {
+	OnValidatorSetUpdate(state.ValidatorSetUpdate)
 }
@@ -2,10 +2,10 @@ package solo
 
 import (
 	"fmt"
-	"strconv"
 	"time"
 
 	geth_common "github.com/ethereum/go-ethereum/common"
+	"github.com/mosaicnetworks/evm-lite/src/common"
 	"github.com/mosaicnetworks/evm-lite/src/service"
 	"github.com/mosaicnetworks/evm-lite/src/state"
 	"github.com/sirupsen/logrus"
@@ -70,17 +70,18 @@ func (s *Solo) Run() error {
 	}
 }
 
-// Info returns the current transaction index
-func (s *Solo) Info() (map[string]string, error) {
-	info := map[string]string{
-		"type":                   "solo",
-		"tx_index":               strconv.Itoa(s.txIndex),
-		"consensus_transactions": strconv.Itoa(s.txIndex),
-		"consensus_events":       "0",
-		"last_block_index":       "0",
-		"last_consensus_round":   "0",
-		"num_peers":              "1",
-		"time":                   strconv.FormatInt(time.Now().UnixNano(), 10),
+// Info returns the current transaction index. Solo commits every transaction
+// in its own block.
+func (s *Solo) Info() (*common.Info, error) {
+	info := &common.Info{
+		Type:               "solo",
+		LastCommittedIndex: int64(s.txIndex) - 1,
+		LastBlockIndex:     int64(s.txIndex) - 1,
+		NumPeers:           1,
+		Extras: map[string]interface{}{
+			"consensus_transactions": s.txIndex,
+			"time":                   time.Now().UnixNano(),
+		},
 	}
 	return info, nil
 }
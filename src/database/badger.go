@@ -0,0 +1,222 @@
+package database
+
+import (
+	"github.com/dgraph-io/badger"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/ethdb"
+)
+
+// badgerGCRatio is the ratio of discardable data above which a value log file
+// is rewritten by Compact
+const badgerGCRatio = 0.5
+
+// BadgerDB is the BadgerDB backend, an embedded key-value store optimised for
+// SSDs.
+type BadgerDB struct {
+	db *badger.DB
+}
+
+// NewBadgerDB opens or creates a BadgerDB database in a directory
+func NewBadgerDB(path string) (*BadgerDB, error) {
+	opts := badger.DefaultOptions(path)
+	opts.Logger = nil
+
+	db, err := badger.Open(opts)
+	if err != nil {
+		return nil, err
+	}
+
+	return &BadgerDB{db: db}, nil
+}
+
+// Put implements ethdb.Putter
+func (db *BadgerDB) Put(key []byte, value []byte) error {
+	return db.db.Update(func(txn *badger.Txn) error {
+		return txn.Set(key, value)
+	})
+}
+
+// Delete implements ethdb.Deleter
+func (db *BadgerDB) Delete(key []byte) error {
+	return db.db.Update(func(txn *badger.Txn) error {
+		return txn.Delete(key)
+	})
+}
+
+// Get implements ethdb.Database
+func (db *BadgerDB) Get(key []byte) ([]byte, error) {
+	var value []byte
+
+	err := db.db.View(func(txn *badger.Txn) error {
+		item, err := txn.Get(key)
+		if err != nil {
+			return err
+		}
+		value, err = item.ValueCopy(nil)
+		return err
+	})
+
+	return value, err
+}
+
+// Has implements ethdb.Database
+func (db *BadgerDB) Has(key []byte) (bool, error) {
+	_, err := db.Get(key)
+	if err == badger.ErrKeyNotFound {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+// Close implements ethdb.Database
+func (db *BadgerDB) Close() {
+	db.db.Close()
+}
+
+// NewBatch implements ethdb.Database. A batch is written in a single
+// transaction, so it is atomic, unless it exceeds Badger's maximum transaction
+// size. A larger batch is split in consecutive transactions, in the order of
+// its operations, and is NOT atomic. The State relies on small batches only for
+// atomicity: it writes the records which make a commit visible last, in a batch
+// of their own.
+func (db *BadgerDB) NewBatch() ethdb.Batch {
+	return &badgerBatch{db: db.db}
+}
+
+// NewIteratorWithPrefix implements Database. The iterator reads from a
+// snapshot of the database.
+func (db *BadgerDB) NewIteratorWithPrefix(prefix []byte) Iterator {
+	return db.NewIteratorWithStart(prefix, nil)
+}
+
+// NewIteratorWithStart implements Database
+func (db *BadgerDB) NewIteratorWithStart(prefix []byte, start []byte) Iterator {
+	txn := db.db.NewTransaction(false)
+
+	it := txn.NewIterator(badger.DefaultIteratorOptions)
+	it.Seek(prefixRange(prefix, start).Start)
+
+	return &badgerIterator{txn: txn, it: it, prefix: prefix}
+}
+
+// Compact implements Database. It rewrites the value log files which are mostly
+// made of deleted values.
+func (db *BadgerDB) Compact() error {
+	for {
+		err := db.db.RunValueLogGC(badgerGCRatio)
+		if err == badger.ErrNoRewrite {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+type badgerIterator struct {
+	txn     *badger.Txn
+	it      *badger.Iterator
+	prefix  []byte
+	started bool
+	key     []byte
+	value   []byte
+	err     error
+}
+
+func (it *badgerIterator) Next() bool {
+	if it.err != nil {
+		return false
+	}
+
+	if it.started {
+		it.it.Next()
+	}
+	it.started = true
+
+	if !it.it.ValidForPrefix(it.prefix) {
+		it.key, it.value = nil, nil
+		return false
+	}
+
+	item := it.it.Item()
+	it.key = item.KeyCopy(nil)
+	it.value, it.err = item.ValueCopy(nil)
+
+	return it.err == nil
+}
+
+func (it *badgerIterator) Key() []byte {
+	return it.key
+}
+
+func (it *badgerIterator) Value() []byte {
+	return it.value
+}
+
+func (it *badgerIterator) Release() {
+	it.it.Close()
+	it.txn.Discard()
+}
+
+func (it *badgerIterator) Error() error {
+	return it.err
+}
+
+// badgerBatch records the operations of a batch, and applies them in a single
+// transaction on Write.
+type badgerBatch struct {
+	db   *badger.DB
+	ops  []batchOp
+	size int
+}
+
+func (b *badgerBatch) Put(key []byte, value []byte) error {
+	b.ops = append(b.ops, batchOp{key: common.CopyBytes(key), value: common.CopyBytes(value)})
+	b.size += len(value)
+	return nil
+}
+
+func (b *badgerBatch) Delete(key []byte) error {
+	b.ops = append(b.ops, batchOp{key: common.CopyBytes(key), delete: true})
+	b.size++
+	return nil
+}
+
+func (b *badgerBatch) ValueSize() int {
+	return b.size
+}
+
+func (b *badgerBatch) Write() error {
+	txn := b.db.NewTransaction(true)
+	defer func() { txn.Discard() }()
+
+	for _, op := range b.ops {
+		err := applyBadgerOp(txn, op)
+		if err == badger.ErrTxnTooBig {
+			// Commit what fits, and carry on in a new transaction
+			if err := txn.Commit(); err != nil {
+				return err
+			}
+			txn = b.db.NewTransaction(true)
+			err = applyBadgerOp(txn, op)
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	return txn.Commit()
+}
+
+// applyBadgerOp applies an operation of a batch to a transaction
+func applyBadgerOp(txn *badger.Txn, op batchOp) error {
+	if op.delete {
+		return txn.Delete(op.key)
+	}
+	return txn.Set(op.key, op.value)
+}
+
+func (b *badgerBatch) Reset() {
+	b.ops = b.ops[:0]
+	b.size = 0
+}
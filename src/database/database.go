@@ -0,0 +1,86 @@
+// Package database provides the storage backends of the State. Every backend
+// implements go-ethereum's ethdb.Database, with the ability to iterate over keys
+// in order.
+package database
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+
+	"github.com/ethereum/go-ethereum/ethdb"
+	"github.com/syndtr/goleveldb/leveldb/util"
+)
+
+// Names of the supported engines
+const (
+	LevelDB = "leveldb"
+	Memory  = "memory"
+	Badger  = "badger"
+)
+
+// DefaultEngine is the engine used when none is configured
+const DefaultEngine = LevelDB
+
+// fdLimit is the number of file descriptors allocated to LevelDB
+const fdLimit = 8192
+
+// Database is an ethdb.Database which can iterate over its keys
+type Database interface {
+	ethdb.Database
+
+	// NewIteratorWithPrefix returns an iterator over the keys which start
+	// with prefix, in lexicographic order. The iterator must be released
+	// after use.
+	NewIteratorWithPrefix(prefix []byte) Iterator
+
+	// NewIteratorWithStart is like NewIteratorWithPrefix, but skips the keys
+	// lower than start.
+	NewIteratorWithStart(prefix []byte, start []byte) Iterator
+
+	// Compact reclaims the space used by deleted keys, if the engine supports
+	// it.
+	Compact() error
+}
+
+// Iterator iterates over key-value pairs. Key and Value are only valid until
+// the next call to Next.
+type Iterator interface {
+	Next() bool
+	Key() []byte
+	Value() []byte
+	Release()
+	Error() error
+}
+
+// Engines returns the names of the supported engines
+func Engines() []string {
+	return []string{LevelDB, Memory, Badger}
+}
+
+// Open opens the database of an engine. path is ignored by the memory engine,
+// and cache is the number of megabytes allocated to caching.
+func Open(engine string, path string, cache int) (Database, error) {
+	switch strings.ToLower(engine) {
+	case "", LevelDB:
+		return NewLevelDB(path, cache)
+	case Memory:
+		return NewMemoryDB(), nil
+	case Badger:
+		return NewBadgerDB(path)
+	default:
+		return nil, fmt.Errorf("Unknown database engine %s. Supported engines: %s",
+			engine,
+			strings.Join(Engines(), ", "))
+	}
+}
+
+// prefixRange returns the range of the keys which start with prefix, and are
+// not lower than start
+func prefixRange(prefix []byte, start []byte) *util.Range {
+	r := util.BytesPrefix(prefix)
+	if bytes.Compare(start, r.Start) > 0 {
+		r.Start = start
+	}
+	return r
+}
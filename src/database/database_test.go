@@ -0,0 +1,211 @@
+package database
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func testDatabases(t *testing.T, fn func(t *testing.T, db Database)) {
+	for _, engine := range Engines() {
+		t.Run(engine, func(t *testing.T) {
+			dir, err := ioutil.TempDir("", "evml-db")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer os.RemoveAll(dir)
+
+			db, err := Open(engine, filepath.Join(dir, "chaindata"), 16)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer db.Close()
+
+			fn(t, db)
+		})
+	}
+}
+
+func TestOpenUnknownEngine(t *testing.T) {
+	if _, err := Open("unknown", "", 16); err == nil {
+		t.Fatal("Opening an unknown engine should fail")
+	}
+}
+
+func TestPutGetDelete(t *testing.T) {
+	testDatabases(t, func(t *testing.T, db Database) {
+		key, value := []byte("key"), []byte("value")
+
+		if has, _ := db.Has(key); has {
+			t.Fatal("Key should not exist yet")
+		}
+
+		if _, err := db.Get(key); err == nil {
+			t.Fatal("Get should fail for a missing key")
+		}
+
+		if err := db.Put(key, value); err != nil {
+			t.Fatal(err)
+		}
+
+		got, err := db.Get(key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(got, value) {
+			t.Fatalf("Value should be %s, not %s", value, got)
+		}
+
+		if err := db.Delete(key); err != nil {
+			t.Fatal(err)
+		}
+
+		if has, _ := db.Has(key); has {
+			t.Fatal("Key should be deleted")
+		}
+
+		// Deleting a missing key is not an error
+		if err := db.Delete(key); err != nil {
+			t.Fatal(err)
+		}
+	})
+}
+
+func TestBatch(t *testing.T) {
+	testDatabases(t, func(t *testing.T, db Database) {
+		if err := db.Put([]byte("deleted"), []byte("x")); err != nil {
+			t.Fatal(err)
+		}
+
+		batch := db.NewBatch()
+		batch.Put([]byte("a"), []byte("1"))
+		batch.Put([]byte("b"), []byte("22"))
+		batch.Delete([]byte("deleted"))
+
+		if batch.ValueSize() < 3 {
+			t.Fatalf("Batch size should be at least 3, not %d", batch.ValueSize())
+		}
+
+		// Nothing is visible before Write
+		if has, _ := db.Has([]byte("a")); has {
+			t.Fatal("Batch should not be written yet")
+		}
+
+		if err := batch.Write(); err != nil {
+			t.Fatal(err)
+		}
+
+		if v, err := db.Get([]byte("b")); err != nil || string(v) != "22" {
+			t.Fatalf("Value should be 22, not %s (%v)", v, err)
+		}
+
+		if has, _ := db.Has([]byte("deleted")); has {
+			t.Fatal("Key should be deleted by the batch")
+		}
+
+		batch.Reset()
+		if batch.ValueSize() != 0 {
+			t.Fatal("Reset should empty the batch")
+		}
+	})
+}
+
+func TestIteratorWithPrefix(t *testing.T) {
+	testDatabases(t, func(t *testing.T, db Database) {
+		for i := 9; i >= 0; i-- {
+			db.Put([]byte(fmt.Sprintf("p-%d", i)), []byte{byte(i)})
+		}
+		db.Put([]byte("o"), []byte("before"))
+		db.Put([]byte("q"), []byte("after"))
+
+		it := db.NewIteratorWithPrefix([]byte("p-"))
+		defer it.Release()
+
+		count := 0
+		for it.Next() {
+			expected := fmt.Sprintf("p-%d", count)
+			if string(it.Key()) != expected {
+				t.Fatalf("Key %d should be %s, not %s", count, expected, it.Key())
+			}
+			if !bytes.Equal(it.Value(), []byte{byte(count)}) {
+				t.Fatalf("Value of %s should be %d, not %v", expected, count, it.Value())
+			}
+			count++
+		}
+
+		if err := it.Error(); err != nil {
+			t.Fatal(err)
+		}
+
+		if count != 10 {
+			t.Fatalf("Iterator should return 10 keys, not %d", count)
+		}
+
+		if err := db.Compact(); err != nil {
+			t.Fatal(err)
+		}
+	})
+}
+
+func TestIteratorWithStart(t *testing.T) {
+	testDatabases(t, func(t *testing.T, db Database) {
+		for i := 0; i < 10; i++ {
+			db.Put([]byte(fmt.Sprintf("p-%d", i)), []byte{byte(i)})
+		}
+		db.Put([]byte("q"), []byte("after"))
+
+		it := db.NewIteratorWithStart([]byte("p-"), []byte("p-5"))
+		defer it.Release()
+
+		count := 5
+		for it.Next() {
+			expected := fmt.Sprintf("p-%d", count)
+			if string(it.Key()) != expected {
+				t.Fatalf("Key should be %s, not %s", expected, it.Key())
+			}
+			count++
+		}
+
+		if err := it.Error(); err != nil {
+			t.Fatal(err)
+		}
+
+		if count != 10 {
+			t.Fatalf("Iterator should stop after p-9, not p-%d", count-1)
+		}
+
+		// A start lower than the prefix is ignored
+		low := db.NewIteratorWithStart([]byte("p-"), []byte("a"))
+		defer low.Release()
+
+		if !low.Next() || string(low.Key()) != "p-0" {
+			t.Fatalf("First key should be p-0, not %s", low.Key())
+		}
+	})
+}
+
+// TestLargeBatch writes a batch larger than Badger's maximum transaction size
+func TestLargeBatch(t *testing.T) {
+	testDatabases(t, func(t *testing.T, db Database) {
+		const n = 300000
+
+		batch := db.NewBatch()
+		for i := 0; i < n; i++ {
+			batch.Put([]byte(fmt.Sprintf("k-%08d", i)), []byte{byte(i)})
+		}
+
+		if err := batch.Write(); err != nil {
+			t.Fatal(err)
+		}
+
+		for _, i := range []int{0, n / 2, n - 1} {
+			v, err := db.Get([]byte(fmt.Sprintf("k-%08d", i)))
+			if err != nil || !bytes.Equal(v, []byte{byte(i)}) {
+				t.Fatalf("Value %d should be %d, not %v (%v)", i, byte(i), v, err)
+			}
+		}
+	})
+}
@@ -0,0 +1,35 @@
+package database
+
+import (
+	"github.com/ethereum/go-ethereum/ethdb"
+	"github.com/syndtr/goleveldb/leveldb/util"
+)
+
+// LevelDB is the LevelDB backend. It is go-ethereum's LDBDatabase.
+type LevelDB struct {
+	*ethdb.LDBDatabase
+}
+
+// NewLevelDB opens or creates a LevelDB database in a directory
+func NewLevelDB(path string, cache int) (*LevelDB, error) {
+	db, err := ethdb.NewLDBDatabase(path, cache, fdLimit)
+	if err != nil {
+		return nil, err
+	}
+	return &LevelDB{db}, nil
+}
+
+// NewIteratorWithPrefix implements Database
+func (db *LevelDB) NewIteratorWithPrefix(prefix []byte) Iterator {
+	return db.LDBDatabase.NewIteratorWithPrefix(prefix)
+}
+
+// NewIteratorWithStart implements Database
+func (db *LevelDB) NewIteratorWithStart(prefix []byte, start []byte) Iterator {
+	return db.LDB().NewIterator(prefixRange(prefix, start), nil)
+}
+
+// Compact implements Database
+func (db *LevelDB) Compact() error {
+	return db.LDB().CompactRange(util.Range{})
+}
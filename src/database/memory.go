@@ -0,0 +1,208 @@
+package database
+
+import (
+	"errors"
+	"sync"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/ethdb"
+	"github.com/syndtr/goleveldb/leveldb/comparer"
+	"github.com/syndtr/goleveldb/leveldb/memdb"
+)
+
+// errNotFound is returned by Get when the key does not exist, like
+// go-ethereum's MemDatabase
+var errNotFound = errors.New("not found")
+
+// MemoryDB is an in-memory backend, for tests and ephemeral nodes. Nothing is
+// persisted, and closing it does not discard the data. It is based on
+// LevelDB's sorted memtable, so it can be iterated in order.
+type MemoryDB struct {
+	lock sync.RWMutex
+	db   *memdb.DB
+}
+
+// NewMemoryDB returns an empty in-memory database
+func NewMemoryDB() *MemoryDB {
+	return &MemoryDB{
+		db: memdb.New(comparer.DefaultComparer, 0),
+	}
+}
+
+// Put implements ethdb.Putter
+func (db *MemoryDB) Put(key []byte, value []byte) error {
+	db.lock.Lock()
+	defer db.lock.Unlock()
+	return db.db.Put(key, value)
+}
+
+// Delete implements ethdb.Deleter
+func (db *MemoryDB) Delete(key []byte) error {
+	db.lock.Lock()
+	defer db.lock.Unlock()
+
+	err := db.db.Delete(key)
+	if err == memdb.ErrNotFound {
+		return nil
+	}
+	return err
+}
+
+// Get implements ethdb.Database. The returned value is a copy.
+func (db *MemoryDB) Get(key []byte) ([]byte, error) {
+	db.lock.RLock()
+	defer db.lock.RUnlock()
+
+	value, err := db.db.Get(key)
+	if err == memdb.ErrNotFound {
+		return nil, errNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	return common.CopyBytes(value), nil
+}
+
+// Has implements ethdb.Database
+func (db *MemoryDB) Has(key []byte) (bool, error) {
+	db.lock.RLock()
+	defer db.lock.RUnlock()
+	return db.db.Contains(key), nil
+}
+
+// Close implements ethdb.Database. The data is kept, so that a State can be
+// reopened on the same MemoryDB.
+func (db *MemoryDB) Close() {}
+
+// NewBatch implements ethdb.Database
+func (db *MemoryDB) NewBatch() ethdb.Batch {
+	return &memoryBatch{db: db}
+}
+
+// NewIteratorWithPrefix implements Database. The iterator works on a copy of
+// the matching keys, so the database can be modified while iterating.
+func (db *MemoryDB) NewIteratorWithPrefix(prefix []byte) Iterator {
+	return db.NewIteratorWithStart(prefix, nil)
+}
+
+// NewIteratorWithStart implements Database. Like NewIteratorWithPrefix, it
+// works on a copy of the matching keys.
+func (db *MemoryDB) NewIteratorWithStart(prefix []byte, start []byte) Iterator {
+	db.lock.RLock()
+	defer db.lock.RUnlock()
+
+	it := db.db.NewIterator(prefixRange(prefix, start))
+	defer it.Release()
+
+	snapshot := &memoryIterator{index: -1}
+	for it.Next() {
+		snapshot.keys = append(snapshot.keys, common.CopyBytes(it.Key()))
+		snapshot.values = append(snapshot.values, common.CopyBytes(it.Value()))
+	}
+	snapshot.err = it.Error()
+
+	return snapshot
+}
+
+// Compact implements Database. There is nothing to compact.
+func (db *MemoryDB) Compact() error {
+	return nil
+}
+
+// Len returns the number of keys in the database
+func (db *MemoryDB) Len() int {
+	db.lock.RLock()
+	defer db.lock.RUnlock()
+	return db.db.Len()
+}
+
+type memoryIterator struct {
+	keys   [][]byte
+	values [][]byte
+	index  int
+	err    error
+}
+
+func (it *memoryIterator) Next() bool {
+	if it.index < len(it.keys) {
+		it.index++
+	}
+	return it.index < len(it.keys)
+}
+
+func (it *memoryIterator) Key() []byte {
+	if it.index < 0 || it.index >= len(it.keys) {
+		return nil
+	}
+	return it.keys[it.index]
+}
+
+func (it *memoryIterator) Value() []byte {
+	if it.index < 0 || it.index >= len(it.values) {
+		return nil
+	}
+	return it.values[it.index]
+}
+
+func (it *memoryIterator) Release() {
+	it.keys = nil
+	it.values = nil
+}
+
+func (it *memoryIterator) Error() error {
+	return it.err
+}
+
+// memoryBatch records the operations of a batch, and applies them under the
+// database's lock on Write.
+type memoryBatch struct {
+	db   *MemoryDB
+	ops  []batchOp
+	size int
+}
+
+type batchOp struct {
+	key    []byte
+	value  []byte
+	delete bool
+}
+
+func (b *memoryBatch) Put(key []byte, value []byte) error {
+	b.ops = append(b.ops, batchOp{key: common.CopyBytes(key), value: common.CopyBytes(value)})
+	b.size += len(value)
+	return nil
+}
+
+func (b *memoryBatch) Delete(key []byte) error {
+	b.ops = append(b.ops, batchOp{key: common.CopyBytes(key), delete: true})
+	b.size++
+	return nil
+}
+
+func (b *memoryBatch) ValueSize() int {
+	return b.size
+}
+
+func (b *memoryBatch) Write() error {
+	b.db.lock.Lock()
+	defer b.db.lock.Unlock()
+
+	for _, op := range b.ops {
+		if op.delete {
+			if err := b.db.db.Delete(op.key); err != nil && err != memdb.ErrNotFound {
+				return err
+			}
+			continue
+		}
+		if err := b.db.db.Put(op.key, op.value); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (b *memoryBatch) Reset() {
+	b.ops = b.ops[:0]
+	b.size = 0
+}
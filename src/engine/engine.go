@@ -1,16 +1,25 @@
 package engine
 
 import (
+	"fmt"
 	"math/big"
 
 	"github.com/ethereum/go-ethereum/common/math"
+	bcommon "github.com/mosaicnetworks/evm-lite/src/common"
 	"github.com/mosaicnetworks/evm-lite/src/config"
 	"github.com/mosaicnetworks/evm-lite/src/consensus"
 	"github.com/mosaicnetworks/evm-lite/src/currency"
+	"github.com/mosaicnetworks/evm-lite/src/database"
 	"github.com/mosaicnetworks/evm-lite/src/service"
 	"github.com/mosaicnetworks/evm-lite/src/state"
 )
 
+const (
+	// The VM debug log is rotated every 100MB, and 5 old files are kept
+	_vmDebugFileSize = 100 * 1024 * 1024
+	_vmDebugBackups  = 5
+)
+
 // Engine is the actor that coordinates State, Service and Consensus
 type Engine struct {
 	state     *state.State
@@ -18,16 +27,34 @@ type Engine struct {
 	consensus consensus.Consensus
 }
 
-// NewEngine instantiates a new Engine with coupled State, Service, and Consensus
-func NewEngine(config config.Config, consensus consensus.Consensus) (*Engine, error) {
+// NewEngine instantiates a new Engine with coupled State, Service, and Consensus.
+// If it fails, the database and the VM debug file are closed, so that their
+// locks are released.
+func NewEngine(config config.Config, consensus consensus.Consensus) (_ *Engine, err error) {
 
 	logger := config.Logger()
 
 	submitCh := make(chan []byte)
 
+	db, err := database.Open(config.DbEngine, config.DbFile, config.Cache)
+	if err != nil {
+		logger.WithError(err).Error("engine.go:NewEngine() database.Open")
+		return nil, err
+	}
+
+	var vmDebugFile *bcommon.RotatingFile
+
+	defer func() {
+		if err != nil {
+			if vmDebugFile != nil {
+				vmDebugFile.Close()
+			}
+			db.Close()
+		}
+	}()
+
 	state, err := state.NewState(
-		config.DbFile,
-		config.Cache,
+		db,
 		config.Genesis,
 		logger.WithField("component", "state"))
 
@@ -36,12 +63,55 @@ func NewEngine(config config.Config, consensus consensus.Consensus) (*Engine, er
 		return nil, err
 	}
 
+	state.SetParallelism(config.Parallel)
+	state.SetStateDiffs(config.StateDiffs)
+	state.SetInternalTxs(config.InternalTxs)
+
+	// The block gas limit is a consensus rule, so it is only read from the
+	// genesis file. The configuration can only require a given value.
+	if config.BlockGasLimit != 0 && config.BlockGasLimit != state.GetGasLimit() {
+		err = fmt.Errorf("Block gas limit %d does not match the gas limit of the genesis file, %d",
+			config.BlockGasLimit,
+			state.GetGasLimit())
+		logger.WithError(err).Error("engine.go:NewEngine()")
+		return nil, err
+	}
+
+	state.SetCallLimits(config.CallGasCap, config.CallTimeout, config.MaxCalls)
+
+	if config.VMDebug {
+		vmDebugFile, err = bcommon.NewRotatingFile(config.VMDebugFile, _vmDebugFileSize, _vmDebugBackups)
+		if err != nil {
+			logger.WithError(err).Error("engine.go:NewEngine() bcommon.NewRotatingFile")
+			return nil, err
+		}
+
+		logger.WithField("file", config.VMDebugFile).Warn("VM debug log enabled")
+		state.SetVMDebug(vmDebugFile)
+	}
+
 	minGasPrice, ok := math.ParseBig256(currency.ExpandCurrencyString(config.MinGasPrice))
 	if !ok {
 		logger.WithField("min-gas-price", config.MinGasPrice).Debug("Could not parse min-gas-price")
 		minGasPrice = big.NewInt(0)
 	}
 
+	var signer *service.Signer
+	if config.Signer {
+		signer, err = service.NewSigner(
+			config.Keystore,
+			config.PwdFile,
+			config.Unlock,
+			logger.WithField("component", "signer"))
+
+		if err != nil {
+			logger.WithError(err).Error("engine.go:NewEngine() service.NewSigner")
+			return nil, err
+		}
+
+		logger.WithField("accounts", len(signer.Accounts())).Warn("Signer enabled")
+	}
+
 	service := service.NewService(
 		config.EthAPIAddr,
 		state,
@@ -49,6 +119,10 @@ func NewEngine(config config.Config, consensus consensus.Consensus) (*Engine, er
 		minGasPrice,
 		logger.WithField("component", "service"))
 
+	if signer != nil {
+		service.SetSigner(signer)
+	}
+
 	if err := consensus.Init(state, service); err != nil {
 		logger.WithError(err).Error("engine.go:NewEngine() Consensus.Init")
 		return nil, err
@@ -56,6 +130,8 @@ func NewEngine(config config.Config, consensus consensus.Consensus) (*Engine, er
 
 	service.SetInfoCallback(consensus.Info)
 
+	registerValidatorSetListener(state, consensus)
+
 	engine := &Engine{
 		state:     state,
 		service:   service,
@@ -65,6 +141,14 @@ func NewEngine(config config.Config, consensus consensus.Consensus) (*Engine, er
 	return engine, nil
 }
 
+// registerValidatorSetListener plugs the consensus system into the State's
+// validator set notifications if it implements ValidatorSetListener.
+func registerValidatorSetListener(s *state.State, c consensus.Consensus) {
+	if listener, ok := c.(consensus.ValidatorSetListener); ok {
+		s.SetValidatorSetCallback(listener.OnValidatorSetUpdate)
+	}
+}
+
 // Run starts the engine's Service asynchronously and starts the Consensus
 // system synchronously
 func (e *Engine) Run() error {
@@ -7,11 +7,14 @@ import (
 	"math/big"
 	"net/http"
 	"strconv"
+	"strings"
 	"time"
 
 	"github.com/ethereum/go-ethereum/common"
 	"github.com/ethereum/go-ethereum/common/hexutil"
 	ethTypes "github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/core/vm"
+	"github.com/ethereum/go-ethereum/rlp"
 	"github.com/mosaicnetworks/evm-lite/src/state"
 	"github.com/mosaicnetworks/evm-lite/src/version"
 	"github.com/sirupsen/logrus"
@@ -19,6 +22,28 @@ import (
 	comm "github.com/mosaicnetworks/evm-lite/src/common"
 )
 
+// accountHandler routes the /account/{address} requests and their
+// sub-resources.
+func accountHandler(w http.ResponseWriter, r *http.Request, m *Service) {
+	param := r.URL.Path[len("/account/"):]
+
+	resource := ""
+	if i := strings.Index(param, "/"); i >= 0 {
+		param, resource = param[:i], param[i+1:]
+	}
+
+	address := common.HexToAddress(param)
+
+	switch resource {
+	case "":
+		accountStateHandler(w, r, m, address)
+	case "internal":
+		accountInternalTxsHandler(w, r, m, address)
+	default:
+		http.Error(w, fmt.Sprintf("Unknown account resource %q", resource), http.StatusNotFound)
+	}
+}
+
 /*
 GET /account/{address}?frompool={true|false|t|f|T|F|1|0|TRUE|FALSE|True|False}
 example: /account/0x50bd8a037442af4cdf631495bcaa5443de19685d
@@ -27,7 +52,7 @@ returns: JSON JSONAccount
 This endpoint returns information about any account, taken by default from the
 main state, or on the TxPool's ethState if `frompool=true`.
 */
-func accountHandler(w http.ResponseWriter, r *http.Request, m *Service) {
+func accountStateHandler(w http.ResponseWriter, r *http.Request, m *Service, address common.Address) {
 	// ShowStorage is a boolean flag which controls whether the account
 	// endpoint outputs storage.
 	// It is currently used for debugging but it may be a desirable future
@@ -35,11 +60,7 @@ func accountHandler(w http.ResponseWriter, r *http.Request, m *Service) {
 	// This should be set to false in all commits and live releases.
 	ShowStorage := false
 
-	param := r.URL.Path[len("/account/"):]
-	address := common.HexToAddress(param)
-
 	if m.logger.Level > logrus.InfoLevel {
-		m.logger.WithField("param", param).Debug("GET account")
 		m.logger.WithField("address", address.Hex()).Debug("GET account")
 	}
 
@@ -89,7 +110,7 @@ func accountHandler(w http.ResponseWriter, r *http.Request, m *Service) {
 }
 
 /*
-POST /call
+POST /call?tracer={structlog}
 data: JSON SendTxArgs
 returns: JSON JSONCallRes
 
@@ -97,6 +118,14 @@ This endpoint allows calling SmartContract code for READONLY operations. These
 calls will NOT modify the EVM state.
 
 The data does NOT need to be signed.
+
+With `tracer=structlog`, the call is traced, and the response includes the
+struct logs of every opcode executed.
+
+Calls are subject to the node's call limits. A call whose gas exceeds the gas
+cap fails with 400, a call made while the maximum number of concurrent calls is
+running fails with 429, and a call which exceeds the timeout fails with 504. A
+call which does not set its gas gets the gas cap.
 */
 func callHandler(w http.ResponseWriter, r *http.Request, m *Service) {
 	if m.logger.Level > logrus.InfoLevel {
@@ -120,14 +149,33 @@ func callHandler(w http.ResponseWriter, r *http.Request, m *Service) {
 		return
 	}
 
-	data, err := m.state.Call(*callMessage)
+	var structLogger *vm.StructLogger
+
+	switch tracer := r.URL.Query().Get("tracer"); tracer {
+	case "":
+	case "structlog":
+		structLogger = vm.NewStructLogger(nil)
+	default:
+		http.Error(w, fmt.Sprintf("Unknown tracer %q", tracer), http.StatusBadRequest)
+		return
+	}
+
+	var tracer vm.Tracer
+	if structLogger != nil {
+		tracer = structLogger
+	}
+
+	data, err := m.state.LimitedCall(*callMessage, tracer)
 	if err != nil {
 		m.logger.WithError(err).Error("Executing Call")
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		http.Error(w, err.Error(), callErrorStatus(err))
 		return
 	}
 
 	res := JSONCallRes{Data: hexutil.Encode(data)}
+	if structLogger != nil {
+		res.StructLogs = structLogger.StructLogs()
+	}
 	js, err := json.Marshal(res)
 	if err != nil {
 		m.logger.WithError(err).Error("Marshaling JSON response")
@@ -139,6 +187,23 @@ func callHandler(w http.ResponseWriter, r *http.Request, m *Service) {
 	w.Write(js)
 }
 
+// callErrorStatus returns the HTTP status of a failed call, which tells clients
+// which call limit was exceeded, if any
+func callErrorStatus(err error) int {
+	if _, ok := err.(*state.CallGasCapError); ok {
+		return http.StatusBadRequest
+	}
+
+	switch err {
+	case state.ErrTooManyCalls:
+		return http.StatusTooManyRequests
+	case state.ErrCallTimeout:
+		return http.StatusGatewayTimeout
+	default:
+		return http.StatusInternalServerError
+	}
+}
+
 /*
 POST /rawtx
 data: STRING Hex representation of the raw transaction bytes
@@ -203,51 +268,106 @@ func rawTransactionHandler(w http.ResponseWriter, r *http.Request, m *Service) {
 		}).Debug("Service decoded tx")
 	}
 
-	// Check if gasPrice is above set limit
-	if m.minGasPrice != nil && tx.GasPrice().Cmp(m.minGasPrice) < 0 {
-		err := fmt.Errorf("Gasprice too low. Got %v, MIN: %v", tx.GasPrice(), m.minGasPrice)
-		m.logger.Debug(err)
+	if err := m.checkTransaction(tx); err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
 
-	if err := m.state.CheckTx(tx); err != nil {
-		m.logger.WithError(err).Error("Checking Transaction")
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+	promise := m.submitTransaction(tx.Hash(), rawTxBytes, true)
+
+	writeReceipt(w, promise, m)
+}
+
+/*
+POST /tx
+data: JSON SendTxArgs
+returns: JSON JSONReceipt
+
+This endpoint allows sending NON-READONLY transactions UNSIGNED, from an account
+unlocked by the node's signer. The nonce, gas and gasPrice are filled in if they
+are not set: the nonce is the next nonce of the account in the transaction
+pool, the gas is estimated against the last committed state, and the gasPrice
+is the node's minimum gas price.
+
+The signer is only enabled with the --eth.signer option. Otherwise this endpoint
+fails with 501.
+
+This is a SYNCHRONOUS request. We wait for the transaction to go through
+consensus, and return the corresponding receipt directly.
+*/
+func sendTransactionHandler(w http.ResponseWriter, r *http.Request, m *Service) {
+	if m.logger.Level > logrus.InfoLevel {
+		m.logger.WithField("request", r).Debug("POST tx")
+	}
+
+	if m.signer == nil {
+		http.Error(w, errSignerDisabled.Error(), http.StatusNotImplemented)
 		return
 	}
 
-	promise := m.state.CreateReceiptPromise(tx.Hash())
+	decoder := json.NewDecoder(r.Body)
+	var txArgs SendTxArgs
+	err := decoder.Decode(&txArgs)
+	if err != nil {
+		m.logger.WithError(err).Error("Decoding JSON txArgs")
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	defer r.Body.Close()
 
-	m.logger.Debug("submitting tx")
-	m.submitCh <- rawTxBytes
-	m.logger.Debug("submitted tx")
+	_, promise, err := m.sendTransaction(txArgs, true)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
 
-	timeout := time.After(15 * time.Second)
-	var receipt *comm.JSONReceipt
-	var respErr error
+	writeReceipt(w, promise, m)
+}
 
-	select {
-	case resp := <-promise.RespCh:
-		if resp.Error != nil {
-			respErr = resp.Error
-			break
-		}
-		receipt = resp.Receipt
-	case <-timeout:
-		respErr = fmt.Errorf("Timeout waiting for transaction to go through consensus")
-		break
+/*
+POST /rpc
+data: JSON JSONRPCRequest
+returns: JSON JSONRPCResponse
+
+This endpoint is a minimal JSON-RPC 2.0 interface for Ethereum tooling. The only
+supported method is eth_sendTransaction, which takes an RPCSendTxArgs with
+hex-encoded quantities, signs and submits the transaction like POST /tx, and
+returns its hash without waiting for it to go through consensus.
+*/
+func rpcHandler(w http.ResponseWriter, r *http.Request, m *Service) {
+	if m.logger.Level > logrus.InfoLevel {
+		m.logger.WithField("request", r).Debug("POST rpc")
 	}
 
-	if respErr != nil {
-		m.logger.Errorf("RespErr:  %v", respErr)
-		http.Error(w, respErr.Error(), http.StatusInternalServerError)
-		return
+	var req JSONRPCRequest
+	var res interface{}
+	var rpcErr *JSONRPCError
+
+	decoder := json.NewDecoder(r.Body)
+	defer r.Body.Close()
+
+	if err := decoder.Decode(&req); err != nil {
+		rpcErr = &JSONRPCError{Code: rpcParseError, Message: err.Error()}
+	} else {
+		switch req.Method {
+		case "eth_sendTransaction":
+			res, rpcErr = rpcSendTransaction(req.Params, m)
+		default:
+			rpcErr = &JSONRPCError{
+				Code:    rpcMethodNotFound,
+				Message: fmt.Sprintf("The method %s does not exist/is not available", req.Method),
+			}
+		}
 	}
 
-	js, err := json.Marshal(receipt)
+	js, err := json.Marshal(JSONRPCResponse{
+		Version: "2.0",
+		ID:      req.ID,
+		Result:  res,
+		Error:   rpcErr,
+	})
 	if err != nil {
-		m.logger.WithError(err).Error("Marshalling JSON Response")
+		m.logger.WithError(err).Error("Marshaling JSON response")
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
@@ -256,6 +376,52 @@ func rawTransactionHandler(w http.ResponseWriter, r *http.Request, m *Service) {
 	w.Write(js)
 }
 
+// rpcSendTransaction implements eth_sendTransaction
+func rpcSendTransaction(params json.RawMessage, m *Service) (interface{}, *JSONRPCError) {
+	if m.signer == nil {
+		return nil, &JSONRPCError{Code: rpcServerError, Message: errSignerDisabled.Error()}
+	}
+
+	var args []RPCSendTxArgs
+	if err := json.Unmarshal(params, &args); err != nil || len(args) != 1 {
+		return nil, &JSONRPCError{Code: rpcInvalidParams, Message: "Expected a single transaction object"}
+	}
+
+	// Nobody waits for the receipt, so no promise is created
+	hash, _, err := m.sendTransaction(args[0].toSendTxArgs(), false)
+	if err != nil {
+		return nil, &JSONRPCError{Code: rpcServerError, Message: err.Error()}
+	}
+
+	return hash, nil
+}
+
+// transactionHandler routes the /tx/{tx_hash} requests and their
+// sub-resources.
+func transactionHandler(w http.ResponseWriter, r *http.Request, m *Service) {
+	param := r.URL.Path[len("/tx/"):]
+
+	resource := ""
+	if i := strings.Index(param, "/"); i >= 0 {
+		param, resource = param[:i], param[i+1:]
+	}
+
+	txHash := common.HexToHash(param)
+
+	switch resource {
+	case "":
+		transactionReceiptHandler(w, r, m, txHash)
+	case "statediff":
+		stateDiffHandler(w, r, m, txHash)
+	case "trace":
+		traceHandler(w, r, m, txHash)
+	case "internal":
+		internalTxsHandler(w, r, m, txHash)
+	default:
+		http.Error(w, fmt.Sprintf("Unknown transaction resource %q", resource), http.StatusNotFound)
+	}
+}
+
 /*
 GET /tx/{tx_hash}
 ex: /tx/0xbfe1aa80eb704d6342c553ac9f423024f448f7c74b3e38559429d4b7c98ffb99
@@ -267,9 +433,7 @@ checking if/how the transaction affected the state. This is where one can see su
 information as the address of a newly created contract, how much gas was use and
 the EVM Logs produced by the execution of the transaction.
 */
-func transactionReceiptHandler(w http.ResponseWriter, r *http.Request, m *Service) {
-	param := r.URL.Path[len("/tx/"):]
-	txHash := common.HexToHash(param)
+func transactionReceiptHandler(w http.ResponseWriter, r *http.Request, m *Service, txHash common.Hash) {
 	m.logger.WithField("tx_hash", txHash.Hex()).Debug("GET tx")
 
 	tx, err := m.state.GetTransaction(txHash)
@@ -299,31 +463,192 @@ func transactionReceiptHandler(w http.ResponseWriter, r *http.Request, m *Servic
 	w.Write(js)
 }
 
+/*
+GET /tx/{tx_hash}/statediff
+returns: JSON StateDiff
+
+This endpoint returns every account and storage slot accessed by a transaction,
+with their values before and after it. State diffs are only available if the
+node records them (--eth.state-diffs) when the transaction is applied.
+*/
+func stateDiffHandler(w http.ResponseWriter, r *http.Request, m *Service, txHash common.Hash) {
+	m.logger.WithField("tx_hash", txHash.Hex()).Debug("GET tx statediff")
+
+	diff, err := m.state.GetStateDiff(txHash)
+	if err != nil {
+		m.logger.WithError(err).Error("Getting State Diff")
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+
+	js, err := json.Marshal(diff)
+	if err != nil {
+		m.logger.WithError(err).Error("Marshaling JSON response")
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(js)
+}
+
+/*
+GET /tx/{tx_hash}/internal
+returns: JSON []InternalTx
+
+This endpoint returns the internal transactions of a transaction: the message
+calls, contract creations, and self-destructs performed by contracts during its
+execution. They are only available if the node records them
+(--eth.internal-txs) when the transaction is applied.
+*/
+func internalTxsHandler(w http.ResponseWriter, r *http.Request, m *Service, txHash common.Hash) {
+	m.logger.WithField("tx_hash", txHash.Hex()).Debug("GET tx internal")
+
+	txs, err := m.state.GetInternalTxs(txHash)
+	if err != nil {
+		m.logger.WithError(err).Error("Getting Internal Transactions")
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+
+	js, err := json.Marshal(txs)
+	if err != nil {
+		m.logger.WithError(err).Error("Marshaling JSON response")
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(js)
+}
+
+/*
+GET /account/{address}/internal?start={commit}&limit={n}
+returns: JSON []AddressInternalTx
+
+This endpoint returns the recorded internal transactions from or to an address,
+in the commits from `start` (default 0), in order. At most `limit` transactions
+are returned, unless it is 0 (default).
+*/
+func accountInternalTxsHandler(w http.ResponseWriter, r *http.Request, m *Service, address common.Address) {
+	m.logger.WithField("address", address.Hex()).Debug("GET account internal")
+
+	var start uint64
+	if qs := r.URL.Query().Get("start"); qs != "" {
+		s, err := strconv.ParseUint(qs, 10, 64)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		start = s
+	}
+
+	var limit int
+	if qs := r.URL.Query().Get("limit"); qs != "" {
+		l, err := strconv.Atoi(qs)
+		if err != nil || l < 0 {
+			http.Error(w, fmt.Sprintf("Invalid limit %q", qs), http.StatusBadRequest)
+			return
+		}
+		limit = l
+	}
+
+	txs, err := m.state.GetAddressInternalTxs(address, start, limit)
+	if err != nil {
+		m.logger.WithError(err).Error("Getting Internal Transactions")
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	js, err := json.Marshal(txs)
+	if err != nil {
+		m.logger.WithError(err).Error("Marshaling JSON response")
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(js)
+}
+
+/*
+GET /tx/{tx_hash}/trace?tracer=prestate
+returns: JSON output of the tracer
+
+This endpoint returns the output of a tracer for a transaction. The prestate
+tracer returns the state of the accounts accessed by the transaction before it
+was applied, in the format of go-ethereum's prestateTracer. It is computed from
+the state diff of the transaction.
+*/
+func traceHandler(w http.ResponseWriter, r *http.Request, m *Service, txHash common.Hash) {
+	tracer := r.URL.Query().Get("tracer")
+
+	m.logger.WithFields(logrus.Fields{
+		"tx_hash": txHash.Hex(),
+		"tracer":  tracer,
+	}).Debug("GET tx trace")
+
+	var result interface{}
+
+	switch tracer {
+	case "prestate":
+		diff, err := m.state.GetStateDiff(txHash)
+		if err != nil {
+			m.logger.WithError(err).Error("Getting State Diff")
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		}
+		result = diff.Prestate()
+	default:
+		http.Error(w, fmt.Sprintf("Unknown tracer %q", tracer), http.StatusBadRequest)
+		return
+	}
+
+	js, err := json.Marshal(result)
+	if err != nil {
+		m.logger.WithError(err).Error("Marshaling JSON response")
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(js)
+}
+
 /*
 GET /info
-returns: JSON (depends on underlying consensus system)
+returns: JSON Info
 
-Info returns information about the consensus system. Each consensus system that
-plugs into evm-lite must implement an Info function.
+Info returns information about the consensus system and the state. Each
+consensus system that plugs into evm-lite must implement an Info function,
+which populates the consensus-related fields of the response and may add its
+own values in the extras field.
 */
 func infoHandler(w http.ResponseWriter, r *http.Request, m *Service) {
 	m.logger.Debug("GET info")
 
-	stats, err := m.getInfo()
+	info, err := m.getInfo()
 	if err != nil {
 		m.logger.WithError(err).Error("Getting Info")
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
 
+	if info == nil {
+		info = &comm.Info{}
+	}
+
+	info.StateRoot = m.state.GetRoot()
+	info.PendingTxs = m.state.PendingTxs()
+
 	// Add min_gas_price
 	if m.minGasPrice != nil {
-		stats["min_gas_price"] = m.minGasPrice.String()
+		info.MinGasPrice = m.minGasPrice
 	} else {
-		stats["min_gas_price"] = "0"
+		info.MinGasPrice = big.NewInt(0)
 	}
 
-	js, err := json.Marshal(stats)
+	js, err := json.Marshal(info)
 	if err != nil {
 		m.logger.WithError(err).Error("Marshaling JSON response")
 		http.Error(w, err.Error(), http.StatusInternalServerError)
@@ -360,6 +685,36 @@ func poaHandler(w http.ResponseWriter, r *http.Request, m *Service) {
 	w.Write(js)
 }
 
+/*
+GET /poa/validators
+returns: JSON []Validator
+
+Returns the current whitelist of the poa smart contract, with the moniker of
+each member when the contract provides it. If the contract does not expose the
+whitelist, only the accounts of the genesis file which are authorised are
+returned.
+*/
+func validatorsHandler(w http.ResponseWriter, r *http.Request, m *Service) {
+	m.logger.Debug("GET poa/validators")
+
+	validators, err := m.state.GetValidators()
+	if err != nil {
+		m.logger.WithError(err).Error("Getting Validators")
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	js, err := json.Marshal(validators)
+	if err != nil {
+		m.logger.WithError(err).Error("Marshaling JSON response")
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(js)
+}
+
 /*
 GET /version
 returns: JSON Version
@@ -380,6 +735,54 @@ func versionHandler(w http.ResponseWriter, r *http.Request, m *Service) {
 	w.Write(js)
 }
 
+/*
+GET /commit/{number}
+ex: /commit/12
+returns: JSON JSONCommit
+
+This endpoint returns a commit: its state root, the hashes of its transactions,
+and its metadata, which includes the total of the fees paid by the transactions
+and how they were distributed according to the fee policy.
+*/
+func commitHandler(w http.ResponseWriter, r *http.Request, m *Service) {
+	param := r.URL.Path[len("/commit/"):]
+
+	m.logger.WithField("number", param).Debug("GET commit")
+
+	number, err := strconv.ParseUint(param, 10, 64)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Invalid commit number %q", param), http.StatusBadRequest)
+		return
+	}
+
+	record, err := m.state.GetCommit(number)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+
+	commit := JSONCommit{
+		Number:   record.Number,
+		Root:     record.Root,
+		TxHashes: record.TxHashes,
+	}
+
+	// Commits made by older versions do not have metadata
+	if meta, err := m.state.GetCommitMeta(number); err == nil {
+		commit.Meta = meta
+	}
+
+	js, err := json.Marshal(commit)
+	if err != nil {
+		m.logger.WithError(err).Error("Marshaling JSON response")
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(js)
+}
+
 //------------------------------------------------------------------------------
 
 /*
@@ -412,24 +815,208 @@ func genesisHandler(w http.ResponseWriter, r *http.Request, m *Service) {
 //------------------------------------------------------------------------------
 
 /*
-GET /export
+GET /export?format={genesis|ndjson}&prefix={hex}&start={address}&end={address}
 returns: JSON Export of current state
 
-This endpoint returns a JSON snapshot of the state, containing all the accounts,
-including smart-contracts with their storage. The result can be reused as a
-genesis file.
+This endpoint streams a JSON snapshot of the state, containing all the accounts,
+including smart-contracts with their storage. With the default genesis format,
+the result can be reused as a genesis file. With the ndjson format, every
+account is written on its own line. The optional prefix, start, and end
+parameters restrict the export to addresses starting with prefix, and in the
+range [start, end).
 */
 func exportHandler(w http.ResponseWriter, r *http.Request, m *Service) {
 	m.logger.Debug("GET export")
 
-	js := m.state.DumpAllAccounts()
+	query := r.URL.Query()
 
-	w.Header().Set("Content-Type", "application/json")
-	w.Write(js)
+	format, err := state.ParseExportFormat(query.Get("format"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	opts := state.ExportOptions{
+		Format: format,
+		Prefix: query.Get("prefix"),
+		Progress: func(p state.ExportProgress) {
+			m.logger.WithFields(logrus.Fields{
+				"visited":  p.Visited,
+				"exported": p.Exported,
+				"elapsed":  p.Elapsed,
+			}).Debug("Exporting")
+		},
+	}
+
+	if start := query.Get("start"); start != "" {
+		addr := common.HexToAddress(start)
+		opts.Start = &addr
+	}
+
+	if end := query.Get("end"); end != "" {
+		addr := common.HexToAddress(end)
+		opts.End = &addr
+	}
+
+	if format == state.ExportNDJSON {
+		w.Header().Set("Content-Type", "application/x-ndjson")
+	} else {
+		w.Header().Set("Content-Type", "application/json")
+	}
+
+	// The response is streamed, so errors can only be logged once the first
+	// bytes are written.
+	if _, err := m.state.Export(w, opts); err != nil {
+		m.logger.WithError(err).Error("Exporting state")
+	}
 }
 
 //------------------------------------------------------------------------------
 
+// checkTransaction checks that a transaction pays at least the minimum gas
+// price, and that it can be applied to the transaction pool
+func (m *Service) checkTransaction(tx *state.EVMLTransaction) error {
+	// Check if gasPrice is above set limit
+	if m.minGasPrice != nil && tx.GasPrice().Cmp(m.minGasPrice) < 0 {
+		err := fmt.Errorf("Gasprice too low. Got %v, MIN: %v", tx.GasPrice(), m.minGasPrice)
+		m.logger.Debug(err)
+		return err
+	}
+
+	if err := m.state.CheckTx(tx); err != nil {
+		m.logger.WithError(err).Error("Checking Transaction")
+		return err
+	}
+
+	return nil
+}
+
+// submitTransaction submits a checked transaction to the consensus system. If
+// withReceipt is set, it returns the promise of its receipt, which the caller
+// must wait for with writeReceipt.
+func (m *Service) submitTransaction(hash common.Hash, rawTxBytes []byte, withReceipt bool) *state.ReceiptPromise {
+	var promise *state.ReceiptPromise
+	if withReceipt {
+		promise = m.state.CreateReceiptPromise(hash)
+	}
+
+	m.logger.Debug("submitting tx")
+	m.submitCh <- rawTxBytes
+	m.logger.Debug("submitted tx")
+
+	return promise
+}
+
+// sendTransaction fills in the missing fields of an unsigned transaction, signs
+// it with the Signer, checks it, and submits it like submitTransaction. It
+// returns the hash of the transaction. The Signer's lock is held until the
+// transaction is submitted, so that the next transaction from the same account
+// gets the next nonce.
+func (m *Service) sendTransaction(args SendTxArgs, withReceipt bool) (common.Hash, *state.ReceiptPromise, error) {
+	m.signer.Lock()
+	defer m.signer.Unlock()
+
+	nonce := m.state.GetNonce(args.From, true)
+	if args.Nonce != nil {
+		nonce = *args.Nonce
+	}
+
+	gasPrice := args.GasPrice
+	if gasPrice == nil {
+		gasPrice = big.NewInt(0)
+		if m.minGasPrice != nil {
+			gasPrice = m.minGasPrice
+		}
+	}
+
+	value := args.Value
+	if value == nil {
+		value = big.NewInt(0)
+	}
+
+	data := common.FromHex(args.Data)
+
+	gas := args.Gas
+	if gas == 0 {
+		msg := ethTypes.NewMessage(args.From, args.To, nonce, value, 0, gasPrice, data, false)
+
+		estimate, err := m.state.EstimateGas(msg)
+		if err != nil {
+			m.logger.WithError(err).Error("Estimating gas")
+			return common.Hash{}, nil, err
+		}
+		gas = estimate
+	}
+
+	var tx *ethTypes.Transaction
+	if args.To == nil {
+		tx = ethTypes.NewContractCreation(nonce, value, gas, gasPrice, data)
+	} else {
+		tx = ethTypes.NewTransaction(nonce, *args.To, value, gas, gasPrice, data)
+	}
+
+	signedTx, err := m.signer.SignTx(args.From, tx, m.state.GetSigner())
+	if err != nil {
+		m.logger.WithError(err).Error("Signing transaction")
+		return common.Hash{}, nil, err
+	}
+
+	rawTxBytes, err := rlp.EncodeToBytes(signedTx)
+	if err != nil {
+		m.logger.WithError(err).Error("Encoding transaction")
+		return common.Hash{}, nil, err
+	}
+
+	evmlTx, err := state.NewEVMLTransaction(rawTxBytes, m.state.GetSigner())
+	if err != nil {
+		m.logger.WithError(err).Error("Decoding Transaction")
+		return common.Hash{}, nil, err
+	}
+
+	if err := m.checkTransaction(evmlTx); err != nil {
+		return common.Hash{}, nil, err
+	}
+
+	return evmlTx.Hash(), m.submitTransaction(evmlTx.Hash(), rawTxBytes, withReceipt), nil
+}
+
+// writeReceipt waits for the receipt of a submitted transaction, and writes it
+// to the response. The promise is dropped if the wait times out.
+func writeReceipt(w http.ResponseWriter, promise *state.ReceiptPromise, m *Service) {
+	timeout := time.After(m.receiptTimeout)
+	var receipt *comm.JSONReceipt
+	var respErr error
+
+	select {
+	case resp := <-promise.RespCh:
+		if resp.Error != nil {
+			respErr = resp.Error
+			break
+		}
+		receipt = resp.Receipt
+	case <-timeout:
+		m.state.DropReceiptPromise(promise)
+		respErr = fmt.Errorf("Timeout waiting for transaction to go through consensus")
+		break
+	}
+
+	if respErr != nil {
+		m.logger.Errorf("RespErr:  %v", respErr)
+		http.Error(w, respErr.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	js, err := json.Marshal(receipt)
+	if err != nil {
+		m.logger.WithError(err).Error("Marshalling JSON Response")
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(js)
+}
+
 func prepareCallMessage(args SendTxArgs) (*ethTypes.Message, error) {
 
 	// Create Call Message
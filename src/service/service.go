@@ -4,12 +4,19 @@ import (
 	"math/big"
 	"net/http"
 	"os"
+	"time"
 
 	"github.com/mosaicnetworks/evm-lite/src/state"
 	"github.com/sirupsen/logrus"
+
+	comm "github.com/mosaicnetworks/evm-lite/src/common"
 )
 
-type infoCallback func() (map[string]string, error)
+type infoCallback func() (*comm.Info, error)
+
+//_receiptTimeout is how long the synchronous endpoints wait for a transaction
+//to go through consensus
+const _receiptTimeout = 15 * time.Second
 
 //Service controls the EVM-Lite endpoints
 type Service struct {
@@ -18,7 +25,12 @@ type Service struct {
 	apiAddr     string
 	minGasPrice *big.Int
 	getInfo     infoCallback
-	logger      *logrus.Entry
+	signer      *Signer
+	mux         *http.ServeMux
+
+	receiptTimeout time.Duration
+
+	logger *logrus.Entry
 }
 
 //NewService is a factory method that returns a new instance of Service
@@ -28,13 +40,19 @@ func NewService(apiAddr string,
 	minGasPrice *big.Int,
 	logger *logrus.Entry) *Service {
 
-	return &Service{
-		apiAddr:     apiAddr,
-		state:       state,
-		submitCh:    submitCh,
-		minGasPrice: minGasPrice,
-		logger:      logger,
+	service := &Service{
+		apiAddr:        apiAddr,
+		state:          state,
+		submitCh:       submitCh,
+		minGasPrice:    minGasPrice,
+		mux:            http.NewServeMux(),
+		receiptTimeout: _receiptTimeout,
+		logger:         logger,
 	}
+
+	service.registerHandlers()
+
+	return service
 }
 
 //Run starts the Service serving
@@ -54,27 +72,56 @@ func (m *Service) SetInfoCallback(f infoCallback) {
 	m.getInfo = f
 }
 
-// Serve registers the API handlers with the DefaultServerMux of the http
-// package, and calls ListenAndServe. It is possible that another module in the
-// application (ex: the consensus system) has registered other handlers with the
-// DefaultServeMux. In this case, those handlers will also be process by this
-// server.
-func (m *Service) serveAPI() {
-	// Add handlers to DefaultServerMux
-	http.HandleFunc("/account/", m.makeHandler(accountHandler))
-	http.HandleFunc("/call", m.makeHandler(callHandler))
-	http.HandleFunc("/rawtx", m.makeHandler(rawTransactionHandler))
-	http.HandleFunc("/tx/", m.makeHandler(transactionReceiptHandler))
-	http.HandleFunc("/info", m.makeHandler(infoHandler))
-	http.HandleFunc("/poa", m.makeHandler(poaHandler))
-	http.HandleFunc("/genesis", m.makeHandler(genesisHandler))
-	http.HandleFunc("/version", m.makeHandler(versionHandler))
+//SetSigner enables the signing of unsigned transactions submitted to the /tx
+//and /rpc endpoints, with the accounts unlocked by signer
+func (m *Service) SetSigner(signer *Signer) {
+	m.signer = signer
+}
+
+//Handler returns the http.Handler serving the API. It can be mounted by an
+//embedding application under a prefix, for example:
+//
+//	mux.Handle("/evm/", http.StripPrefix("/evm", service.Handler()))
+func (m *Service) Handler() http.Handler {
+	return m.mux
+}
+
+//HandleFunc registers an extra route on the Service's router. It is meant to
+//be used by consensus modules to expose their own endpoints alongside the API.
+//It panics if the pattern is already registered.
+func (m *Service) HandleFunc(pattern string, handler http.HandlerFunc) {
+	m.mux.HandleFunc(pattern, func(w http.ResponseWriter, r *http.Request) {
+		enableCors(&w)
+		handler(w, r)
+	})
+}
+
+// registerHandlers adds the API handlers to the Service's own ServeMux. We do
+// not use the DefaultServeMux of the http package, so that multiple Services
+// can live in the same process, and so that handlers registered elsewhere are
+// not exposed inadvertently.
+func (m *Service) registerHandlers() {
+	m.mux.HandleFunc("/account/", m.makeHandler(accountHandler))
+	m.mux.HandleFunc("/call", m.makeHandler(callHandler))
+	m.mux.HandleFunc("/rawtx", m.makeHandler(rawTransactionHandler))
+	m.mux.HandleFunc("/tx", m.makeHandler(sendTransactionHandler))
+	m.mux.HandleFunc("/tx/", m.makeHandler(transactionHandler))
+	m.mux.HandleFunc("/rpc", m.makeHandler(rpcHandler))
+	m.mux.HandleFunc("/info", m.makeHandler(infoHandler))
+	m.mux.HandleFunc("/commit/", m.makeHandler(commitHandler))
+	m.mux.HandleFunc("/poa", m.makeHandler(poaHandler))
+	m.mux.HandleFunc("/poa/validators", m.makeHandler(validatorsHandler))
+	m.mux.HandleFunc("/genesis", m.makeHandler(genesisHandler))
+	m.mux.HandleFunc("/version", m.makeHandler(versionHandler))
 
 	//TODO - this is experimental and placed on an endpoint for convenience.
-	http.HandleFunc("/export", m.makeHandler(exportHandler))
+	m.mux.HandleFunc("/export", m.makeHandler(exportHandler))
+}
 
+// serveAPI calls ListenAndServe with the Service's router.
+func (m *Service) serveAPI() {
 	// The call to ListenAndServe is a blocking operation
-	err := http.ListenAndServe(m.apiAddr, nil)
+	err := http.ListenAndServe(m.apiAddr, m.mux)
 	if err != nil {
 		m.logger.Error(err)
 	}
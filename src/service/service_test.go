@@ -0,0 +1,278 @@
+package service
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/common/hexutil"
+	ethTypes "github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/rlp"
+
+	comm "github.com/mosaicnetworks/evm-lite/src/common"
+	"github.com/mosaicnetworks/evm-lite/src/database"
+	"github.com/mosaicnetworks/evm-lite/src/state"
+)
+
+const (
+	_testGenesis  = "test_data/eth/genesis.json"
+	_testKeystore = "test_data/eth/keystore"
+	_testPwdFile  = "test_data/eth/pwd.txt"
+)
+
+var (
+	// _testFrom is the funded account of the test keystore
+	_testFrom = common.HexToAddress("0x59d6e09fde8bf65183ddd1e0ca06f3d618c44c57")
+	_testTo   = common.HexToAddress("0xd93535fcd9f7f119e9b741642a8e1353355de90a")
+)
+
+// newTestService returns a Service on a State created from the test genesis
+// file, in memory. Submitted transactions are buffered in the submit channel.
+func newTestService(t *testing.T) *Service {
+	logger := comm.NewTestEntry(t)
+
+	st, err := state.NewState(database.NewMemoryDB(), _testGenesis, logger.WithField("component", "state"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return NewService("", st, make(chan []byte, 16), big.NewInt(0), logger.WithField("component", "service"))
+}
+
+// newTestSigner returns a Signer with all the accounts of the test keystore
+func newTestSigner(t *testing.T) *Signer {
+	signer, err := NewSigner(_testKeystore, _testPwdFile, nil, comm.NewTestEntry(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return signer
+}
+
+// post sends a POST request with a JSON body to a handler, and returns the
+// response
+func post(t *testing.T, handler http.Handler, path string, body interface{}) *http.Response {
+	js, err := json.Marshal(body)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest("POST", path, bytes.NewReader(js)))
+	return rec.Result()
+}
+
+// get sends a GET request to a handler, and returns the response
+func get(t *testing.T, handler http.Handler, path string) *http.Response {
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest("GET", path, nil))
+	return rec.Result()
+}
+
+// TestHandler mounts the Service's handler in another router, under a prefix,
+// with a custom route registered on the Service
+func TestHandler(t *testing.T) {
+	service := newTestService(t)
+	defer service.state.Close()
+
+	service.HandleFunc("/custom", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("custom"))
+	})
+
+	mux := http.NewServeMux()
+	mux.Handle("/evm/", http.StripPrefix("/evm", service.Handler()))
+
+	res := get(t, mux, "/evm/custom")
+	body, _ := ioutil.ReadAll(res.Body)
+
+	if res.StatusCode != http.StatusOK || string(body) != "custom" {
+		t.Fatalf("Custom route should return 200 custom, not %d %s", res.StatusCode, body)
+	}
+
+	if cors := res.Header.Get("Access-Control-Allow-Origin"); cors != "*" {
+		t.Fatalf("Custom route should enable CORS, not %q", cors)
+	}
+
+	if res := get(t, mux, "/evm/version"); res.StatusCode != http.StatusOK {
+		t.Fatalf("Built-in route should return 200, not %d", res.StatusCode)
+	}
+
+	if res := get(t, mux, "/version"); res.StatusCode != http.StatusNotFound {
+		t.Fatalf("Routes should only be served under the prefix, not %d", res.StatusCode)
+	}
+}
+
+// TestReceiptTimeout checks that a transaction whose receipt is not produced in
+// time is no longer counted as pending
+func TestReceiptTimeout(t *testing.T) {
+	service := newTestService(t)
+	defer service.state.Close()
+
+	service.SetSigner(newTestSigner(t))
+	service.receiptTimeout = 10 * time.Millisecond
+
+	// Nothing consumes the submitted transactions
+	res := post(t, service.Handler(), "/tx", SendTxArgs{From: _testFrom, To: &_testTo, Value: big.NewInt(1)})
+	if res.StatusCode != http.StatusInternalServerError {
+		t.Fatalf("Waiting for the receipt should time out with 500, not %d", res.StatusCode)
+	}
+
+	if len(service.submitCh) != 1 {
+		t.Fatalf("The transaction should be submitted")
+	}
+
+	if pending := service.state.PendingTxs(); pending != 0 {
+		t.Fatalf("There should be no pending transactions after the timeout, not %d", pending)
+	}
+}
+
+// TestSignerDisabled checks that the endpoints which sign transactions fail
+// without a Signer
+func TestSignerDisabled(t *testing.T) {
+	service := newTestService(t)
+	defer service.state.Close()
+
+	res := post(t, service.Handler(), "/tx", SendTxArgs{From: _testFrom, To: &_testTo, Value: big.NewInt(1)})
+	if res.StatusCode != http.StatusNotImplemented {
+		t.Fatalf("POST /tx should return 501 without a signer, not %d", res.StatusCode)
+	}
+
+	_, rpcErr := sendRPCTransaction(t, service, RPCSendTxArgs{From: _testFrom, To: &_testTo})
+	if rpcErr == nil || rpcErr.Code != rpcServerError {
+		t.Fatalf("eth_sendTransaction should fail without a signer, not %v", rpcErr)
+	}
+
+	if len(service.submitCh) != 0 {
+		t.Fatalf("No transaction should be submitted")
+	}
+}
+
+// TestSendTransaction signs a transaction with an unlocked account, and waits
+// for its receipt while a fake consensus system applies and commits the
+// submitted transactions
+func TestSendTransaction(t *testing.T) {
+	service := newTestService(t)
+	defer service.state.Close()
+
+	service.SetSigner(newTestSigner(t))
+
+	stop := make(chan struct{})
+	stopped := make(chan struct{})
+
+	go func() {
+		defer close(stopped)
+		for {
+			select {
+			case raw := <-service.submitCh:
+				if err := service.state.ApplyTransaction(raw, 0, common.Hash{}, common.Address{}); err != nil {
+					t.Error(err)
+				}
+				if _, err := service.state.Commit(); err != nil {
+					t.Error(err)
+				}
+			case <-stop:
+				return
+			}
+		}
+	}()
+
+	defer func() {
+		close(stop)
+		<-stopped
+	}()
+
+	res := post(t, service.Handler(), "/tx", SendTxArgs{From: _testFrom, To: &_testTo, Value: big.NewInt(1)})
+	if res.StatusCode != http.StatusOK {
+		body, _ := ioutil.ReadAll(res.Body)
+		t.Fatalf("POST /tx should return 200, not %d %s", res.StatusCode, body)
+	}
+
+	var receipt comm.JSONReceipt
+	if err := json.NewDecoder(res.Body).Decode(&receipt); err != nil {
+		t.Fatal(err)
+	}
+
+	if receipt.From != _testFrom || receipt.To == nil || *receipt.To != _testTo {
+		t.Fatalf("Receipt should be for a transaction from %s to %s, not %s to %v", _testFrom.Hex(), _testTo.Hex(), receipt.From.Hex(), receipt.To)
+	}
+
+	if receipt.Status != ethTypes.ReceiptStatusSuccessful {
+		t.Fatalf("Transaction should succeed, not have status %d", receipt.Status)
+	}
+}
+
+// TestSendTransactionNonces checks that back-to-back transactions from the
+// same account get consecutive nonces, before they go through consensus
+func TestSendTransactionNonces(t *testing.T) {
+	service := newTestService(t)
+	defer service.state.Close()
+
+	service.SetSigner(newTestSigner(t))
+
+	nonce := service.state.GetNonce(_testFrom, false)
+	value := hexutil.Big(*big.NewInt(1))
+
+	var hashes []common.Hash
+	for i := 0; i < 2; i++ {
+		result, rpcErr := sendRPCTransaction(t, service, RPCSendTxArgs{From: _testFrom, To: &_testTo, Value: &value})
+		if rpcErr != nil {
+			t.Fatalf("eth_sendTransaction %d failed: %s", i, rpcErr.Message)
+		}
+
+		var hash common.Hash
+		if err := json.Unmarshal(result, &hash); err != nil {
+			t.Fatal(err)
+		}
+		hashes = append(hashes, hash)
+	}
+
+	if len(service.submitCh) != 2 {
+		t.Fatalf("2 transactions should be submitted, not %d", len(service.submitCh))
+	}
+
+	for i, hash := range hashes {
+		var tx ethTypes.Transaction
+		if err := rlp.DecodeBytes(<-service.submitCh, &tx); err != nil {
+			t.Fatal(err)
+		}
+
+		if tx.Hash() != hash {
+			t.Fatalf("Transaction %d should be %s, not %s", i, hash.Hex(), tx.Hash().Hex())
+		}
+
+		if tx.Nonce() != nonce+uint64(i) {
+			t.Fatalf("Nonce of transaction %d should be %d, not %d", i, nonce+uint64(i), tx.Nonce())
+		}
+	}
+}
+
+// sendRPCTransaction calls eth_sendTransaction, and returns the raw result or
+// the error of the response
+func sendRPCTransaction(t *testing.T, service *Service, args RPCSendTxArgs) (json.RawMessage, *JSONRPCError) {
+	params, err := json.Marshal([]RPCSendTxArgs{args})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	res := post(t, service.Handler(), "/rpc", JSONRPCRequest{
+		Version: "2.0",
+		ID:      json.RawMessage("1"),
+		Method:  "eth_sendTransaction",
+		Params:  params,
+	})
+
+	var rpcRes struct {
+		Result json.RawMessage `json:"result"`
+		Error  *JSONRPCError   `json:"error"`
+	}
+	if err := json.NewDecoder(res.Body).Decode(&rpcRes); err != nil {
+		t.Fatal(err)
+	}
+
+	return rpcRes.Result, rpcRes.Error
+}
@@ -0,0 +1,141 @@
+package service
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"strings"
+	"sync"
+
+	"github.com/ethereum/go-ethereum/accounts"
+	"github.com/ethereum/go-ethereum/accounts/keystore"
+	"github.com/ethereum/go-ethereum/common"
+	ethTypes "github.com/ethereum/go-ethereum/core/types"
+	"github.com/sirupsen/logrus"
+)
+
+var errSignerDisabled = errors.New("Signing is not enabled on this node")
+
+// Signer signs the transactions submitted unsigned to the Service, with the
+// accounts of a keystore which it unlocked. Its lock is held by the Service
+// while a transaction is prepared and submitted, so that concurrent
+// transactions from the same account get consecutive nonces.
+type Signer struct {
+	sync.Mutex
+	keyStore *keystore.KeyStore
+	accounts map[common.Address]accounts.Account
+	logger   *logrus.Entry
+}
+
+// NewSigner opens a keystore directory and unlocks accounts with the passwords
+// of pwdFile, which contains one password per line. The n-th account is
+// unlocked with the n-th password, or with the last one if there are fewer
+// passwords than accounts. If unlock is empty, all the accounts of the keystore
+// are unlocked.
+func NewSigner(keystoreDir string,
+	pwdFile string,
+	unlock []string,
+	logger *logrus.Entry) (*Signer, error) {
+
+	passwords, err := ReadPasswords(pwdFile)
+	if err != nil {
+		return nil, err
+	}
+
+	ks := keystore.NewKeyStore(keystoreDir, keystore.StandardScryptN, keystore.StandardScryptP)
+
+	var toUnlock []accounts.Account
+	if len(unlock) == 0 {
+		toUnlock = ks.Accounts()
+	} else {
+		for _, addr := range unlock {
+			if !common.IsHexAddress(addr) {
+				return nil, fmt.Errorf("Invalid account address %q", addr)
+			}
+
+			account := accounts.Account{Address: common.HexToAddress(addr)}
+			if !ks.HasAddress(account.Address) {
+				return nil, fmt.Errorf("Account %s is not in keystore %s", addr, keystoreDir)
+			}
+			toUnlock = append(toUnlock, account)
+		}
+	}
+
+	if len(toUnlock) == 0 {
+		return nil, fmt.Errorf("No accounts to unlock in keystore %s", keystoreDir)
+	}
+
+	signer := &Signer{
+		keyStore: ks,
+		accounts: make(map[common.Address]accounts.Account),
+		logger:   logger,
+	}
+
+	for i, account := range toUnlock {
+		pwd := passwords[len(passwords)-1]
+		if i < len(passwords) {
+			pwd = passwords[i]
+		}
+
+		if err := ks.Unlock(account, pwd); err != nil {
+			return nil, fmt.Errorf("Unlocking account %s: %v", account.Address.Hex(), err)
+		}
+
+		signer.accounts[account.Address] = account
+
+		logger.WithField("address", account.Address.Hex()).Debug("Unlocked account")
+	}
+
+	return signer, nil
+}
+
+// Accounts returns the addresses of the unlocked accounts
+func (s *Signer) Accounts() []common.Address {
+	addrs := make([]common.Address, 0, len(s.accounts))
+	for addr := range s.accounts {
+		addrs = append(addrs, addr)
+	}
+	return addrs
+}
+
+// SignTx signs a transaction with an unlocked account
+func (s *Signer) SignTx(from common.Address,
+	tx *ethTypes.Transaction,
+	signer ethTypes.Signer) (*ethTypes.Transaction, error) {
+
+	account, ok := s.accounts[from]
+	if !ok {
+		return nil, fmt.Errorf("Account %s is not unlocked", from.Hex())
+	}
+
+	sig, err := s.keyStore.SignHash(account, signer.Hash(tx).Bytes())
+	if err != nil {
+		return nil, err
+	}
+
+	return tx.WithSignature(signer, sig)
+}
+
+// ReadPasswords reads the non-empty lines of a password file. It fails if the
+// file has none, so that an empty line is never taken for a password.
+func ReadPasswords(pwdFile string) ([]string, error) {
+	text, err := ioutil.ReadFile(pwdFile)
+	if err != nil {
+		return nil, err
+	}
+
+	var passwords []string
+	for _, line := range strings.Split(string(text), "\n") {
+		// Sanitise DOS line endings.
+		line = strings.TrimRight(line, "\r")
+		if line != "" {
+			passwords = append(passwords, line)
+		}
+	}
+
+	if len(passwords) == 0 {
+		return nil, fmt.Errorf("No passwords in %s", pwdFile)
+	}
+
+	return passwords, nil
+}
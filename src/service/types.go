@@ -1,9 +1,13 @@
 package service
 
 import (
+	"encoding/json"
 	"math/big"
 
 	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/common/hexutil"
+	"github.com/ethereum/go-ethereum/core/vm"
+	"github.com/mosaicnetworks/evm-lite/src/state"
 )
 
 //JSONAccount is the JSON structure used for the account endpoint
@@ -32,9 +36,82 @@ type SendTxArgs struct {
 	Nonce    *uint64         `json:"nonce"`
 }
 
-//JSONCallRes is the JSON structure for the return from the call endpoint
+//RPCSendTxArgs are the arguments of eth_sendTransaction, with hex-encoded
+//quantities. The data can also be set as input.
+type RPCSendTxArgs struct {
+	From     common.Address  `json:"from"`
+	To       *common.Address `json:"to"`
+	Gas      *hexutil.Uint64 `json:"gas"`
+	GasPrice *hexutil.Big    `json:"gasPrice"`
+	Value    *hexutil.Big    `json:"value"`
+	Data     hexutil.Bytes   `json:"data"`
+	Input    hexutil.Bytes   `json:"input"`
+	Nonce    *hexutil.Uint64 `json:"nonce"`
+}
+
+func (args RPCSendTxArgs) toSendTxArgs() SendTxArgs {
+	res := SendTxArgs{
+		From: args.From,
+		To:   args.To,
+		Data: hexutil.Encode(args.Data),
+	}
+
+	if len(args.Data) == 0 {
+		res.Data = hexutil.Encode(args.Input)
+	}
+	if args.Gas != nil {
+		res.Gas = uint64(*args.Gas)
+	}
+	if args.GasPrice != nil {
+		res.GasPrice = args.GasPrice.ToInt()
+	}
+	if args.Value != nil {
+		res.Value = args.Value.ToInt()
+	}
+	if args.Nonce != nil {
+		nonce := uint64(*args.Nonce)
+		res.Nonce = &nonce
+	}
+
+	return res
+}
+
+//JSON-RPC 2.0 error codes
+const (
+	rpcParseError     = -32700
+	rpcMethodNotFound = -32601
+	rpcInvalidParams  = -32602
+	rpcServerError    = -32000
+)
+
+//JSONRPCRequest is a JSON-RPC 2.0 request
+type JSONRPCRequest struct {
+	Version string          `json:"jsonrpc"`
+	ID      json.RawMessage `json:"id"`
+	Method  string          `json:"method"`
+	Params  json.RawMessage `json:"params"`
+}
+
+//JSONRPCResponse is a JSON-RPC 2.0 response. Only one of Result and Error is
+//set.
+type JSONRPCResponse struct {
+	Version string          `json:"jsonrpc"`
+	ID      json.RawMessage `json:"id"`
+	Result  interface{}     `json:"result,omitempty"`
+	Error   *JSONRPCError   `json:"error,omitempty"`
+}
+
+//JSONRPCError is the error of a JSON-RPC 2.0 response
+type JSONRPCError struct {
+	Code    int    `json:"code"`
+	Message string `json:"message"`
+}
+
+//JSONCallRes is the JSON structure for the return from the call endpoint.
+//StructLogs are only set for traced calls.
 type JSONCallRes struct {
-	Data string `json:"data"`
+	Data       string         `json:"data"`
+	StructLogs []vm.StructLog `json:"structLogs,omitempty"`
 }
 
 //JSONTxRes has been replaced by JSONReceipt
@@ -42,6 +119,14 @@ type JSONTxRes struct {
 	TxHash string `json:"txHash"`
 }
 
+//JSONCommit is the JSON structure returned by the commit endpoint
+type JSONCommit struct {
+	Number   uint64            `json:"number"`
+	Root     common.Hash       `json:"root"`
+	TxHashes []common.Hash     `json:"txHashes"`
+	Meta     *state.CommitMeta `json:"meta,omitempty"`
+}
+
 //JSONContract is the JSON structure returned by the poa endpoint
 type JSONContract struct {
 	Address common.Address `json:"address"`
@@ -17,13 +17,13 @@ import (
 	"github.com/mosaicnetworks/evm-lite/src/currency"
 )
 
-var _receiptsPrefix = []byte("receipts-")
-
 // BaseState is a THREAD-SAFE wrapper around a StateDB. It contains the logic
 // to retrieve information from the DB, and apply new transactions.
 type BaseState struct {
 	sync.Mutex
 	db           ethdb.Database
+	trieDB       *batchDatabase
+	root         common.Hash
 	stateDB      *ethState.StateDB
 	signer       ethTypes.Signer
 	chainConfig  params.ChainConfig
@@ -31,6 +31,27 @@ type BaseState struct {
 	gasLimit     uint64
 	gp           *core.GasPool
 	totalUsedGas uint64
+
+	// fees is the total of the fees paid by the transactions applied since
+	// the last reset
+	fees *big.Int
+
+	// redirectFees is set to take the fees back from the coinbase, so that
+	// they can be distributed according to the fee policy
+	redirectFees bool
+
+	// recordStateDiffs is set to record the StateDiff of every transaction
+	recordStateDiffs bool
+
+	// recordInternalTxs is set to record the internal transactions of every
+	// transaction
+	recordInternalTxs bool
+
+	// debug traces every transaction, if set
+	debug *debugLogger
+
+	// precompiles are the precompiles enabled in the EVMs
+	precompiles precompileSet
 }
 
 // NewBaseState returns a BaseState initialized from a database and root hash.
@@ -41,16 +62,20 @@ func NewBaseState(db ethdb.Database,
 	vmConfig vm.Config,
 	gasLimit uint64) BaseState {
 
-	stateDB, _ := ethState.New(root, ethState.NewDatabase(db))
+	trieDB := newBatchDatabase(db)
+	stateDB, _ := ethState.New(root, ethState.NewDatabase(trieTable(trieDB)))
 
 	return BaseState{
 		db:          db,
+		trieDB:      trieDB,
+		root:        root,
 		stateDB:     stateDB,
 		signer:      signer,
 		chainConfig: chainConfig,
 		vmConfig:    vmConfig,
 		gasLimit:    gasLimit,
 		gp:          new(core.GasPool).AddGas(gasLimit),
+		fees:        new(big.Int),
 	}
 }
 
@@ -58,12 +83,16 @@ func NewBaseState(db ethdb.Database,
 func (bs *BaseState) Copy() BaseState {
 	return BaseState{
 		db:          bs.db,
+		trieDB:      bs.trieDB,
+		root:        bs.root,
 		stateDB:     bs.stateDB.Copy(),
 		signer:      bs.signer,
 		chainConfig: bs.chainConfig,
 		vmConfig:    bs.vmConfig,
 		gasLimit:    bs.gasLimit,
 		gp:          new(core.GasPool).AddGas(bs.gasLimit),
+		fees:        new(big.Int),
+		precompiles: bs.precompiles,
 	}
 }
 
@@ -96,12 +125,33 @@ func (bs *BaseState) ApplyTransaction(
 	coinbase common.Address,
 	noReceipt bool) error {
 
+	bs.Lock()
+	defer bs.Unlock()
+
+	return bs.applyTransaction(tx, txIndex, blockHash, coinbase, noReceipt)
+}
+
+// applyTransaction implements ApplyTransaction. The caller must hold the lock.
+func (bs *BaseState) applyTransaction(
+	tx *EVMLTransaction,
+	txIndex int,
+	blockHash common.Hash,
+	coinbase common.Address,
+	noReceipt bool) error {
+
 	msg := tx.Msg()
 
-	context := NewContext(msg.From(), coinbase, msg.Gas(), msg.GasPrice())
+	// CheckTx does not consume the gas of the block
+	gp := bs.gp
+	if noReceipt {
+		gp = new(core.GasPool).AddGas(bs.gasLimit)
+	}
 
-	bs.Lock()
-	defer bs.Unlock()
+	if err := bs.reserveGas(gp, msg.Gas()); err != nil {
+		return err
+	}
+
+	context := NewContext(msg.From(), coinbase, msg.Gas(), msg.GasPrice())
 
 	// Prepare the stateDB with transaction Hash so that it can be used in
 	// emitted logs. Not required for CheckTx with no receipt produced.
@@ -109,17 +159,64 @@ func (bs *BaseState) ApplyTransaction(
 		bs.stateDB.Prepare(tx.Hash(), blockHash, txIndex)
 	}
 
-	vmenv := vm.NewEVM(context, bs.stateDB, &bs.chainConfig, bs.vmConfig)
+	var stateDB vm.StateDB = bs.stateDB
+
+	var recorder *accessRecorder
+	if bs.recordStateDiffs && !noReceipt {
+		recorder = newDiffRecorder(bs.stateDB)
+		stateDB = recorder
+	}
+
+	var tracers []vm.Tracer
+
+	if bs.debug != nil && !noReceipt {
+		bs.debug.begin(tx.Hash())
+		tracers = append(tracers, bs.debug)
+	}
+
+	var tracer *callTracer
+	if bs.recordInternalTxs && !noReceipt {
+		tracer = newCallTracer()
+		tracers = append(tracers, tracer)
+	}
+
+	vmenv := newEVM(context, stateDB, &bs.chainConfig, bs.vmConfig, bs.precompiles, tracers...)
 
 	// Apply the transaction to the stateDB (included in the env)
-	_, gas, failed, err := core.ApplyMessage(vmenv, msg, bs.gp)
+	_, gas, failed, err := core.ApplyMessage(vmenv, msg, gp)
 	if (err != nil) || (noReceipt) {
 		// These are called "consensus" errors. Return immediately.
 		return err
 	}
 
+	bs.setReceipt(tx, coinbase, gas, failed)
+
+	if recorder != nil {
+		tx.stateDiff = recorder.stateDiff()
+	}
+
+	if tracer != nil {
+		tx.internalTxs = tracer.internalTxs()
+	}
+
+	return nil
+}
+
+// setReceipt sets the receipt of a transaction whose changes were just applied
+// to the stateDB, and collects its fee. The caller must hold the lock.
+func (bs *BaseState) setReceipt(tx *EVMLTransaction, coinbase common.Address, gas uint64, failed bool) {
 	bs.totalUsedGas += gas
 
+	msg := tx.Msg()
+
+	fee := new(big.Int).Mul(new(big.Int).SetUint64(gas), msg.GasPrice())
+	bs.fees.Add(bs.fees, fee)
+
+	// The EVM credited the fee to the coinbase
+	if bs.redirectFees && fee.Sign() > 0 {
+		bs.stateDB.SubBalance(coinbase, fee)
+	}
+
 	// Compute the current root hash of the state trie, which will go in the
 	// receipt. This has side effects; it updates StateObjects like
 	// smart-contract memory.
@@ -132,7 +229,7 @@ func (bs *BaseState) ApplyTransaction(
 	// if the transaction created a contract, store the creation address in the
 	// receipt.
 	if msg.To() == nil {
-		receipt.ContractAddress = crypto.CreateAddress(vmenv.Context.Origin, tx.Nonce())
+		receipt.ContractAddress = crypto.CreateAddress(msg.From(), tx.Nonce())
 	}
 
 	// Set the receipt logs
@@ -140,8 +237,6 @@ func (bs *BaseState) ApplyTransaction(
 
 	// set the EVMLTransaction's receipt
 	tx.receipt = receipt
-
-	return nil
 }
 
 // Call executes a readonly transaction on a copy of the stateDB. This is used
@@ -153,7 +248,7 @@ func (bs *BaseState) Call(callMsg ethTypes.Message) ([]byte, error) {
 
 	context := NewContext(callMsg.From(), common.Address{}, 0, big.NewInt(0))
 
-	vmenv := vm.NewEVM(context, bs.stateDB.Copy(), &bs.chainConfig, bs.vmConfig)
+	vmenv := newEVM(context, bs.stateDB.Copy(), &bs.chainConfig, bs.vmConfig, bs.precompiles)
 
 	res, _, _, err := core.ApplyMessage(vmenv, callMsg, new(core.GasPool).AddGas(bs.gasLimit))
 
@@ -170,29 +265,90 @@ func (bs *BaseState) Reset(root common.Hash) error {
 		return err
 	}
 
+	bs.root = root
 	bs.totalUsedGas = 0
+	bs.fees = new(big.Int)
 	bs.gp = new(core.GasPool).AddGas(bs.gasLimit)
 
 	return nil
 }
 
+// Fees returns the total of the fees paid by the transactions applied since the
+// last reset
+func (bs *BaseState) Fees() *big.Int {
+	bs.Lock()
+	defer bs.Unlock()
+
+	return new(big.Int).Set(bs.fees)
+}
+
+// setChainID changes the chain ID of the chain config and the signer. The chain
+// config is a copy, so CustomChainConfig is not modified.
+func (bs *BaseState) setChainID(chainID *big.Int) {
+	bs.Lock()
+	defer bs.Unlock()
+
+	bs.chainConfig.ChainID = chainID
+	bs.signer = ethTypes.NewEIP155Signer(chainID)
+}
+
 // Commit commits everything to the underlying database
 func (bs *BaseState) Commit() (common.Hash, error) {
+	batch := bs.db.NewBatch()
+
+	root, err := bs.CommitToBatch(batch)
+	if err != nil {
+		return common.Hash{}, err
+	}
+
+	if err := batch.Write(); err != nil {
+		return common.Hash{}, err
+	}
+	bs.BatchWritten()
+
+	return root, nil
+}
+
+// CommitToBatch commits the state changes and adds the resulting trie nodes to
+// batch. Nothing is persisted until the batch is written, and BatchWritten must
+// be called once it is. Until then, the trie nodes are kept in memory, and added
+// again to the batch of the next commit, so that a batch which is not written
+// does not lose them.
+func (bs *BaseState) CommitToBatch(batch ethdb.Batch) (common.Hash, error) {
 	bs.Lock()
-	bs.Unlock()
+	defer bs.Unlock()
 
 	root, err := bs.stateDB.Commit(true)
 	if err != nil {
 		return common.Hash{}, err
 	}
 
-	// FORCE DISK WRITE
-	// Apparenty Geth does something smarter here, but can't figure it out
-	bs.stateDB.Database().TrieDB().Commit(root, true)
+	// Flush the trie nodes from the trie database's memory to the batch
+	defer bs.trieDB.redirect(nil)
+	if err := bs.trieDB.redirect(batch); err != nil {
+		return common.Hash{}, err
+	}
+
+	if err := bs.stateDB.Database().TrieDB().Commit(root, false); err != nil {
+		return common.Hash{}, err
+	}
 
 	return root, nil
 }
 
+// BatchWritten releases the trie nodes of the batches filled by CommitToBatch,
+// once they are written to the database
+func (bs *BaseState) BatchWritten() {
+	bs.trieDB.written()
+}
+
+// GetRoot returns the root hash that the stateDB was last reset to
+func (bs *BaseState) GetRoot() common.Hash {
+	bs.Lock()
+	defer bs.Unlock()
+	return bs.root
+}
+
 // GetBalance returns an account's balance from the stateDB
 func (bs *BaseState) GetBalance(addr common.Address) *big.Int {
 	bs.Lock()
@@ -231,42 +387,37 @@ func (bs *BaseState) GetStorage(addr common.Address) map[string]string {
 	return storage
 }
 
-// WriteTransactions writes a set of transactions directly into the DB
-func (bs *BaseState) WriteTransactions(txs map[common.Hash]*EVMLTransaction) error {
-	batch := bs.db.NewBatch()
-
+// WriteTransactions adds a set of transactions to a batch
+func (bs *BaseState) WriteTransactions(batch ethdb.Batch, txs map[common.Hash]*EVMLTransaction) error {
 	for hash, tx := range txs {
-		if err := batch.Put(hash.Bytes(), tx.rlpBytes); err != nil {
+		if err := batch.Put(txKey(hash), tx.rlpBytes); err != nil {
 			return err
 		}
 	}
 
-	// Write the scheduled data into the database
-	return batch.Write()
+	return nil
 }
 
-// WriteReceipts writes a set of receipts directly into the DB
-func (bs *BaseState) WriteReceipts(txs map[common.Hash]*EVMLTransaction) error {
-	batch := bs.db.NewBatch()
-
+// WriteReceipts adds a set of receipts to a batch
+func (bs *BaseState) WriteReceipts(batch ethdb.Batch, txs map[common.Hash]*EVMLTransaction) error {
 	for txHash, tx := range txs {
 		storageReceipt := (*ethTypes.ReceiptForStorage)(tx.receipt)
 		data, err := rlp.EncodeToBytes(storageReceipt)
 		if err != nil {
 			return err
 		}
-		if err := batch.Put(append(_receiptsPrefix, txHash.Bytes()...), data); err != nil {
+		if err := batch.Put(receiptKey(txHash), data); err != nil {
 			return err
 		}
 	}
 
-	return batch.Write()
+	return nil
 }
 
 // GetTransaction fetches transactions by hash directly from the DB.
 func (bs *BaseState) GetTransaction(hash common.Hash) (*ethTypes.Transaction, error) {
 	// Retrieve the transaction itself from the database
-	data, err := bs.db.Get(hash.Bytes())
+	data, err := bs.db.Get(txKey(hash))
 	if err != nil {
 		return nil, err
 	}
@@ -281,7 +432,7 @@ func (bs *BaseState) GetTransaction(hash common.Hash) (*ethTypes.Transaction, er
 // GetReceipt fetches transaction receipts by transaction hash directly from the
 // DB
 func (bs *BaseState) GetReceipt(txHash common.Hash) (*ethTypes.Receipt, error) {
-	data, err := bs.db.Get(append(_receiptsPrefix, txHash.Bytes()...))
+	data, err := bs.db.Get(receiptKey(txHash))
 	if err != nil {
 		return nil, err
 	}
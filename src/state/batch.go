@@ -0,0 +1,167 @@
+package state
+
+import (
+	"sync"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/ethdb"
+)
+
+// batchDatabase is the database behind the tries of a BaseState. It writes to
+// the underlying database, except while a commit is in progress, in which case
+// all the writes go to the commit's batch. This way, the trie nodes are written
+// atomically with the transactions, receipts, and head of the commit.
+//
+// The trie database drops the nodes from its cache as soon as they are flushed
+// to the batch, so the batchDatabase keeps them until the batch is known to be
+// written. Until then, they are served by Get and Has, and they are added again
+// to the batch of the next commit, so that a commit which failed after the
+// flush does not leave the state with missing nodes.
+type batchDatabase struct {
+	ethdb.Database
+
+	lock  sync.Mutex
+	batch ethdb.Batch
+
+	// pending holds the values written to batches since the last successful
+	// write
+	pending map[string][]byte
+}
+
+func newBatchDatabase(db ethdb.Database) *batchDatabase {
+	return &batchDatabase{
+		Database: db,
+		pending:  make(map[string][]byte),
+	}
+}
+
+// redirect sends all subsequent writes to batch, until it is called with nil.
+// The pending values of previous batches are added to batch.
+func (db *batchDatabase) redirect(batch ethdb.Batch) error {
+	db.lock.Lock()
+	defer db.lock.Unlock()
+
+	db.batch = batch
+
+	if batch != nil {
+		for key, value := range db.pending {
+			if err := batch.Put([]byte(key), value); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// written releases the pending values once the batches which contain them
+// have been written to the underlying database.
+func (db *batchDatabase) written() {
+	db.lock.Lock()
+	defer db.lock.Unlock()
+
+	if len(db.pending) > 0 {
+		db.pending = make(map[string][]byte)
+	}
+}
+
+// put writes to the batch if there is one, and to the underlying database
+// otherwise. The caller must hold the lock.
+func (db *batchDatabase) put(key []byte, value []byte) error {
+	if db.batch != nil {
+		db.pending[string(key)] = common.CopyBytes(value)
+		return db.batch.Put(key, value)
+	}
+	return db.Database.Put(key, value)
+}
+
+// Put implements ethdb.Putter
+func (db *batchDatabase) Put(key []byte, value []byte) error {
+	db.lock.Lock()
+	defer db.lock.Unlock()
+
+	return db.put(key, value)
+}
+
+// Delete implements ethdb.Deleter
+func (db *batchDatabase) Delete(key []byte) error {
+	db.lock.Lock()
+	defer db.lock.Unlock()
+
+	delete(db.pending, string(key))
+
+	if db.batch != nil {
+		return db.batch.Delete(key)
+	}
+	return db.Database.Delete(key)
+}
+
+// Get implements ethdb.Database. Pending values take precedence over the
+// underlying database.
+func (db *batchDatabase) Get(key []byte) ([]byte, error) {
+	db.lock.Lock()
+	value, ok := db.pending[string(key)]
+	db.lock.Unlock()
+
+	if ok {
+		return common.CopyBytes(value), nil
+	}
+	return db.Database.Get(key)
+}
+
+// Has implements ethdb.Database
+func (db *batchDatabase) Has(key []byte) (bool, error) {
+	db.lock.Lock()
+	_, ok := db.pending[string(key)]
+	db.lock.Unlock()
+
+	if ok {
+		return true, nil
+	}
+	return db.Database.Has(key)
+}
+
+// NewBatch implements ethdb.Database. While a commit is in progress, it returns
+// a batch which adds to the commit's batch, and is only written with it.
+func (db *batchDatabase) NewBatch() ethdb.Batch {
+	db.lock.Lock()
+	defer db.lock.Unlock()
+
+	if db.batch != nil {
+		return &nestedBatch{db: db}
+	}
+	return db.Database.NewBatch()
+}
+
+// nestedBatch is an ethdb.Batch which adds to the batch of the commit in
+// progress. Write and Reset do not affect the commit's batch.
+type nestedBatch struct {
+	db   *batchDatabase
+	size int
+}
+
+func (b *nestedBatch) Put(key []byte, value []byte) error {
+	b.size += len(value)
+
+	b.db.lock.Lock()
+	defer b.db.lock.Unlock()
+
+	return b.db.put(key, value)
+}
+
+func (b *nestedBatch) Delete(key []byte) error {
+	b.size++
+	return b.db.Delete(key)
+}
+
+func (b *nestedBatch) ValueSize() int {
+	return b.size
+}
+
+func (b *nestedBatch) Write() error {
+	return nil
+}
+
+func (b *nestedBatch) Reset() {
+	b.size = 0
+}
@@ -0,0 +1,210 @@
+package state
+
+import (
+	"errors"
+	"fmt"
+	"math/big"
+	"time"
+
+	ethTypes "github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/core/vm"
+	"github.com/ethereum/go-ethereum/params"
+)
+
+/*
+The calls made through the API are bounded, so that clients cannot exhaust the
+node's resources: their gas is capped, their execution is cancelled after a
+timeout, and the number of concurrent calls is limited. Each limit fails with a
+distinct error. The calls made by the State itself, like the POA queries, are
+not bounded.
+*/
+
+var (
+	// ErrCallTimeout is returned when the execution of a call is cancelled
+	// because it exceeded the call timeout
+	ErrCallTimeout = errors.New("Call execution timed out")
+
+	// ErrTooManyCalls is returned when the maximum number of concurrent calls
+	// is reached
+	ErrTooManyCalls = errors.New("Too many concurrent calls")
+)
+
+// CallGasCapError is returned when the gas of a call exceeds the gas cap
+type CallGasCapError struct {
+	Gas uint64
+	Cap uint64
+}
+
+// Error implements the error interface
+func (e *CallGasCapError) Error() string {
+	return fmt.Sprintf("Call gas %d exceeds the gas cap %d", e.Gas, e.Cap)
+}
+
+// callLimits are the limits of the calls made through the API
+type callLimits struct {
+	gasCap  uint64
+	timeout time.Duration
+
+	// slots holds a token for every call in progress. It is nil if the
+	// number of concurrent calls is not limited.
+	slots chan struct{}
+}
+
+// SetCallLimits sets the limits of the calls made through the API. gasCap is
+// the maximum gas of a call, and the gas of calls which do not set it; it is
+// the block gas limit if 0. Calls are cancelled after timeout, unless it is 0,
+// and at most maxConcurrent calls are executed at the same time, unless it is
+// 0. It must be called before the API is served.
+func (s *State) SetCallLimits(gasCap uint64, timeout time.Duration, maxConcurrent int) {
+	limits := callLimits{
+		gasCap:  gasCap,
+		timeout: timeout,
+	}
+
+	if maxConcurrent > 0 {
+		limits.slots = make(chan struct{}, maxConcurrent)
+	}
+
+	s.callLimits = limits
+}
+
+// LimitedCall executes a call made through the API, within the call limits,
+// and traced if tracer is not nil. It returns a CallGasCapError,
+// ErrTooManyCalls, or ErrCallTimeout if a limit is exceeded.
+func (s *State) LimitedCall(callMsg ethTypes.Message, tracer vm.Tracer) ([]byte, error) {
+	limits := s.callLimits
+
+	gasCap := limits.gasCap
+	if gasCap == 0 {
+		gasCap = s.GetGasLimit()
+	}
+
+	if callMsg.Gas() > gasCap {
+		return nil, &CallGasCapError{Gas: callMsg.Gas(), Cap: gasCap}
+	}
+
+	if callMsg.Gas() == 0 {
+		callMsg = withGas(callMsg, gasCap)
+	}
+
+	release, err := limits.acquire()
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+
+	res, err := s.readState().Call(callMsg, tracer, limits.timeout)
+	if err != nil {
+		s.logger.WithError(err).Debug("Executing Call")
+		return nil, err
+	}
+
+	return res, nil
+}
+
+// EstimateGas returns the lowest gas with which a transaction succeeds against
+// the last committed state, searching up to the gas of the message, if it is
+// set, or the gas cap. If the message has a gas price, the search is also
+// bounded by the gas which the sender can pay for after the value. It is subject
+// to the call limits like LimitedCall, and every attempt is subject to the
+// timeout.
+func (s *State) EstimateGas(callMsg ethTypes.Message) (uint64, error) {
+	limits := s.callLimits
+
+	hi := limits.gasCap
+	if hi == 0 {
+		hi = s.GetGasLimit()
+	}
+
+	if callMsg.Gas() > hi {
+		return 0, &CallGasCapError{Gas: callMsg.Gas(), Cap: hi}
+	}
+
+	if callMsg.Gas() >= params.TxGas {
+		hi = callMsg.Gas()
+	}
+
+	release, err := limits.acquire()
+	if err != nil {
+		return 0, err
+	}
+	defer release()
+
+	rs := s.readState()
+
+	if gasPrice := callMsg.GasPrice(); gasPrice != nil && gasPrice.Sign() > 0 {
+		available := new(big.Int).Set(rs.GetBalance(callMsg.From()))
+		if callMsg.Value() != nil {
+			if callMsg.Value().Cmp(available) > 0 {
+				return 0, fmt.Errorf("Insufficient funds for value %v with balance %v", callMsg.Value(), available)
+			}
+			available.Sub(available, callMsg.Value())
+		}
+
+		allowance := new(big.Int).Div(available, gasPrice)
+		if allowance.IsUint64() && hi > allowance.Uint64() {
+			hi = allowance.Uint64()
+		}
+	}
+
+	succeeds := func(gas uint64) (bool, error) {
+		_, failed, err := rs.apply(withGas(callMsg, gas), nil, limits.timeout)
+		if err == ErrCallTimeout {
+			return false, err
+		}
+		return err == nil && !failed, nil
+	}
+
+	ok, err := succeeds(hi)
+	if err != nil {
+		return 0, err
+	}
+	if !ok {
+		return 0, fmt.Errorf("Transaction fails with the maximum gas %d", hi)
+	}
+
+	lo := params.TxGas - 1
+	for lo+1 < hi {
+		mid := lo + (hi-lo)/2
+
+		ok, err := succeeds(mid)
+		if err != nil {
+			return 0, err
+		}
+
+		if ok {
+			hi = mid
+		} else {
+			lo = mid
+		}
+	}
+
+	return hi, nil
+}
+
+// acquire takes a call slot. It fails with ErrTooManyCalls if there are none
+// left, and otherwise returns the function which releases the slot.
+func (l callLimits) acquire() (func(), error) {
+	if l.slots == nil {
+		return func() {}, nil
+	}
+
+	select {
+	case l.slots <- struct{}{}:
+		return func() { <-l.slots }, nil
+	default:
+		return nil, ErrTooManyCalls
+	}
+}
+
+// withGas returns a copy of a message with a different gas
+func withGas(msg ethTypes.Message, gas uint64) ethTypes.Message {
+	return ethTypes.NewMessage(msg.From(),
+		msg.To(),
+		msg.Nonce(),
+		msg.Value(),
+		gas,
+		msg.GasPrice(),
+		msg.Data(),
+		msg.CheckNonce())
+}
@@ -0,0 +1,360 @@
+package state
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/common/hexutil"
+	ethState "github.com/ethereum/go-ethereum/core/state"
+	"github.com/ethereum/go-ethereum/ethdb"
+	"github.com/ethereum/go-ethereum/rlp"
+	"github.com/sirupsen/logrus"
+)
+
+/*
+Every Commit is recorded in the DB with a sequential number, starting at 0 for
+the genesis accounts. The record contains the resulting state root and the
+hashes of the transactions it included, which is what allows the State to be
+rolled back to a previous commit. The number and root of the last commit are
+stored separately, so that a node can resume from them.
+*/
+
+// CommitRecord describes a Commit
+type CommitRecord struct {
+	Number   uint64
+	Root     common.Hash
+	TxHashes []common.Hash
+}
+
+// CommitMeta is the metadata of a commit: the gas used by its transactions and
+// the block gas limit, the total of the fees they paid, and the amounts
+// credited according to the fee policy.
+type CommitMeta struct {
+	GasUsed       uint64                          `json:"gasUsed"`
+	GasLimit      uint64                          `json:"gasLimit"`
+	Fees          *hexutil.Big                    `json:"fees"`
+	FeePolicy     string                          `json:"feePolicy"`
+	FeeRecipients map[common.Address]*hexutil.Big `json:"feeRecipients,omitempty"`
+}
+
+// WriteCommit records a commit and makes it the head, in a single batch. The
+// batch is small, so that it is atomic with every database engine. The records
+// of the commit must be written before.
+func (bs *BaseState) WriteCommit(number uint64, root common.Hash, txHashes []common.Hash) error {
+	batch := bs.db.NewBatch()
+
+	if err := writeCommit(batch, &CommitRecord{Number: number, Root: root, TxHashes: txHashes}); err != nil {
+		return err
+	}
+
+	return batch.Write()
+}
+
+// writeCommit adds a commit record and the head pointers to a batch
+func writeCommit(batch ethdb.Batch, record *CommitRecord) error {
+	data, err := rlp.EncodeToBytes(record)
+	if err != nil {
+		return err
+	}
+
+	number := make([]byte, 8)
+	binary.BigEndian.PutUint64(number, record.Number)
+
+	if err := batch.Put(commitKey(record.Number), data); err != nil {
+		return err
+	}
+	if err := batch.Put(_headCommitKey, number); err != nil {
+		return err
+	}
+	return batch.Put(_headRootKey, record.Root.Bytes())
+}
+
+// writeCommitMeta adds the metadata of a commit to a batch
+func writeCommitMeta(batch ethdb.Batch, number uint64, meta *CommitMeta) error {
+	data, err := json.Marshal(meta)
+	if err != nil {
+		return err
+	}
+
+	return batch.Put(commitMetaKey(number), data)
+}
+
+// ReadCommitMeta returns the metadata of a commit
+func ReadCommitMeta(db ethdb.Database, number uint64) (*CommitMeta, error) {
+	data, err := db.Get(commitMetaKey(number))
+	if err != nil {
+		return nil, fmt.Errorf("Metadata of commit %d not found: %v", number, err)
+	}
+
+	var meta CommitMeta
+	if err := json.Unmarshal(data, &meta); err != nil {
+		return nil, err
+	}
+
+	return &meta, nil
+}
+
+// ReadCommit returns the record of a commit
+func ReadCommit(db ethdb.Database, number uint64) (*CommitRecord, error) {
+	data, err := db.Get(commitKey(number))
+	if err != nil {
+		return nil, fmt.Errorf("Commit %d not found: %v", number, err)
+	}
+
+	var record CommitRecord
+	if err := rlp.DecodeBytes(data, &record); err != nil {
+		return nil, err
+	}
+
+	return &record, nil
+}
+
+// ReadHead returns the last committed state root recorded in the DB, or an
+// empty hash if nothing was ever committed.
+func ReadHead(db ethdb.Database) (common.Hash, error) {
+	has, err := db.Has(_headRootKey)
+	if err != nil || !has {
+		return common.Hash{}, err
+	}
+
+	data, err := db.Get(_headRootKey)
+	if err != nil {
+		return common.Hash{}, err
+	}
+
+	return common.BytesToHash(data), nil
+}
+
+// ReadHeadCommit returns the number of the last commit recorded in the DB. ok
+// is false if nothing was ever committed.
+func ReadHeadCommit(db ethdb.Database) (number uint64, ok bool, err error) {
+	has, err := db.Has(_headCommitKey)
+	if err != nil || !has {
+		return 0, false, err
+	}
+
+	data, err := db.Get(_headCommitKey)
+	if err != nil {
+		return 0, false, err
+	}
+
+	return binary.BigEndian.Uint64(data), true, nil
+}
+
+/*******************************************************************************
+Consistency
+*******************************************************************************/
+
+// repairHead verifies that the last commit recorded in the database is
+// complete, ie. that its state root, transactions, and receipts are present.
+// Otherwise, the State is rolled back to the last complete commit, whose root is
+// returned. An error is returned if the head pointers are inconsistent, or if no
+// commit is complete.
+func (s *State) repairHead(root common.Hash) (common.Hash, error) {
+	head, ok := s.GetCommitNumber()
+	if !ok {
+		return root, nil
+	}
+
+	record, err := ReadCommit(s.db, head)
+	if err != nil {
+		return root, fmt.Errorf("Inconsistent database: %v", err)
+	}
+
+	if record.Root != root {
+		return root, fmt.Errorf("Inconsistent database: head root %s does not match root %s of commit %d",
+			root.Hex(),
+			record.Root.Hex(),
+			head)
+	}
+
+	for n := head; ; n-- {
+		record, err := ReadCommit(s.db, n)
+		if err != nil {
+			return root, err
+		}
+
+		err = s.verifyCommit(record)
+		if err == nil {
+			if n == head {
+				return root, nil
+			}
+			return s.RollbackTo(n)
+		}
+
+		s.logger.WithError(err).WithField("commit", n).Error("Incomplete commit")
+
+		if n == 0 {
+			break
+		}
+	}
+
+	return root, fmt.Errorf("Inconsistent database: no complete commit")
+}
+
+// verifyCommit checks that the state root, transactions, and receipts of a
+// commit are present in the database.
+func (s *State) verifyCommit(record *CommitRecord) error {
+	db := s.db
+
+	if _, err := ethState.New(record.Root, ethState.NewDatabase(trieTable(db))); err != nil {
+		return fmt.Errorf("Missing state %s: %v", record.Root.Hex(), err)
+	}
+
+	for _, txHash := range record.TxHashes {
+		if has, err := db.Has(txKey(txHash)); err != nil || !has {
+			return fmt.Errorf("Missing transaction %s", txHash.Hex())
+		}
+		if has, err := db.Has(receiptKey(txHash)); err != nil || !has {
+			return fmt.Errorf("Missing receipt %s", txHash.Hex())
+		}
+	}
+
+	return nil
+}
+
+/*******************************************************************************
+Rollback
+*******************************************************************************/
+
+// GetCommitNumber returns the number of the last commit, and false if nothing
+// was committed yet.
+func (s *State) GetCommitNumber() (uint64, bool) {
+	if s.was.commitNumber == 0 {
+		return 0, false
+	}
+	return s.was.commitNumber - 1, true
+}
+
+// GetCommit returns the record of a commit
+func (s *State) GetCommit(number uint64) (*CommitRecord, error) {
+	return ReadCommit(s.db, number)
+}
+
+// GetCommitMeta returns the metadata of a commit. Commits made before the
+// metadata was recorded do not have any.
+func (s *State) GetCommitMeta(number uint64) (*CommitMeta, error) {
+	return ReadCommitMeta(s.db, number)
+}
+
+// RollbackTo resets the main state, the WAS, and the TxPool to the root of a
+// previous commit. The transactions, receipts, and records of the later
+// commits are deleted, and the rolled back commit becomes the head. It must
+// not be called while the consensus system is applying transactions.
+func (s *State) RollbackTo(number uint64) (common.Hash, error) {
+	head, ok := s.GetCommitNumber()
+	if !ok || number > head {
+		return common.Hash{}, fmt.Errorf("Commit %d not found", number)
+	}
+
+	db := s.db
+
+	target, err := ReadCommit(db, number)
+	if err != nil {
+		return common.Hash{}, err
+	}
+
+	// Check that the target state is complete before deleting anything
+	if _, err := ethState.New(target.Root, ethState.NewDatabase(trieTable(db))); err != nil {
+		return common.Hash{}, fmt.Errorf("State %s of commit %d is not available: %v", target.Root.Hex(), number, err)
+	}
+
+	// The head is moved first, so that an interrupted rollback only leaves
+	// records of later commits behind, which the next commits overwrite
+	if err := s.main.WriteCommit(target.Number, target.Root, target.TxHashes); err != nil {
+		return common.Hash{}, err
+	}
+
+	batch := db.NewBatch()
+	deleted := 0
+
+	for n := head; n > number; n-- {
+		record, err := ReadCommit(db, n)
+		if err != nil {
+			return common.Hash{}, err
+		}
+
+		for _, txHash := range record.TxHashes {
+			if err := batch.Delete(txKey(txHash)); err != nil {
+				return common.Hash{}, err
+			}
+			if err := batch.Delete(receiptKey(txHash)); err != nil {
+				return common.Hash{}, err
+			}
+			if err := batch.Delete(stateDiffKey(txHash)); err != nil {
+				return common.Hash{}, err
+			}
+			if err := deleteInternalTxs(db, batch, n, txHash); err != nil {
+				return common.Hash{}, err
+			}
+			deleted++
+		}
+
+		if err := batch.Delete(commitKey(n)); err != nil {
+			return common.Hash{}, err
+		}
+		if err := batch.Delete(commitMetaKey(n)); err != nil {
+			return common.Hash{}, err
+		}
+	}
+
+	if err := batch.Write(); err != nil {
+		return common.Hash{}, err
+	}
+
+	s.was.commitNumber = number + 1
+	s.validatorChanges = nil
+
+	if err := s.resetAll(target.Root); err != nil {
+		return common.Hash{}, err
+	}
+
+	s.logger.WithFields(logrus.Fields{
+		"commit": number,
+		"root":   target.Root.Hex(),
+		"from":   head,
+		"txs":    deleted,
+	}).Warn("Rolled back")
+
+	return target.Root, nil
+}
+
+// RollbackToRoot is like RollbackTo, but identifies the commit by its root. If
+// several commits have the same root, the most recent one is used.
+func (s *State) RollbackToRoot(root common.Hash) (uint64, error) {
+	number, err := s.FindCommit(root)
+	if err != nil {
+		return 0, err
+	}
+
+	if _, err := s.RollbackTo(number); err != nil {
+		return 0, err
+	}
+
+	return number, nil
+}
+
+// FindCommit returns the number of the most recent commit with the given root
+func (s *State) FindCommit(root common.Hash) (uint64, error) {
+	head, ok := s.GetCommitNumber()
+	if !ok {
+		return 0, fmt.Errorf("No commits")
+	}
+
+	for n := head; ; n-- {
+		record, err := ReadCommit(s.db, n)
+		if err != nil {
+			return 0, err
+		}
+		if record.Root == root {
+			return n, nil
+		}
+		if n == 0 {
+			break
+		}
+	}
+
+	return 0, fmt.Errorf("No commit with root %s", root.Hex())
+}
@@ -16,6 +16,12 @@ type EVMLTransaction struct {
 	message  *ethTypes.Message
 	receipt  *ethTypes.Receipt
 	rlpBytes []byte
+
+	// stateDiff is recorded when the transaction is applied, if enabled
+	stateDiff StateDiff
+
+	// internalTxs are recorded when the transaction is applied, if enabled
+	internalTxs []InternalTx
 }
 
 // NewEVMLTransaction decodes an RLP encoded EVM transaction and returns an
@@ -0,0 +1,347 @@
+package state
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/ethereum/go-ethereum/common"
+	ethState "github.com/ethereum/go-ethereum/core/state"
+	"github.com/ethereum/go-ethereum/ethdb"
+	"github.com/ethereum/go-ethereum/rlp"
+	"github.com/ethereum/go-ethereum/trie"
+	"github.com/sirupsen/logrus"
+
+	bcommon "github.com/mosaicnetworks/evm-lite/src/common"
+)
+
+// ExportFormat is the output format of Export
+type ExportFormat int
+
+const (
+	// ExportGenesis produces a single JSON object which can be reused as a
+	// genesis file. The POA smart-contract is placed in its own section, and
+	// the chain ID, gas limit, fee policy, and precompiles of the genesis file
+	// are carried over.
+	ExportGenesis ExportFormat = iota
+	// ExportNDJSON produces one JSON ExportAccount per line
+	ExportNDJSON
+)
+
+// exportProgressInterval is the number of accounts between two calls to the
+// progress function.
+const exportProgressInterval = 10000
+
+// ParseExportFormat converts a string (genesis or ndjson) to an ExportFormat
+func ParseExportFormat(format string) (ExportFormat, error) {
+	switch strings.ToLower(format) {
+	case "", "genesis":
+		return ExportGenesis, nil
+	case "ndjson":
+		return ExportNDJSON, nil
+	default:
+		return ExportGenesis, fmt.Errorf("Unknown export format %s", format)
+	}
+}
+
+// ExportOptions configures Export
+type ExportOptions struct {
+	Format ExportFormat
+
+	// Root is the state root to export. The last committed root is used if
+	// it is empty.
+	Root common.Hash
+
+	// Prefix, if not empty, restricts the export to accounts whose address,
+	// in lowercase hex without 0x, starts with Prefix.
+	Prefix string
+
+	// Start and End, if not nil, restrict the export to accounts whose
+	// address is in the range [Start, End).
+	Start *common.Address
+	End   *common.Address
+
+	// Progress, if not nil, is called regularly with the number of accounts
+	// visited and exported so far.
+	Progress func(ExportProgress)
+}
+
+// ExportProgress reports the progress of an Export
+type ExportProgress struct {
+	Root     common.Hash
+	Visited  uint64
+	Exported uint64
+	Elapsed  time.Duration
+	Done     bool
+}
+
+// ExportAccount is an account as exported in the ndjson format
+type ExportAccount struct {
+	Address string `json:"address"`
+	ethState.DumpAccount
+}
+
+// match returns true if the address passes the filters
+func (o ExportOptions) match(addr common.Address) bool {
+	if o.Prefix != "" {
+		hexAddr := common.Bytes2Hex(addr.Bytes())
+		prefix := strings.TrimPrefix(strings.ToLower(o.Prefix), "0x")
+		if !strings.HasPrefix(hexAddr, prefix) {
+			return false
+		}
+	}
+	if o.Start != nil && bytes.Compare(addr.Bytes(), o.Start.Bytes()) < 0 {
+		return false
+	}
+	if o.End != nil && bytes.Compare(addr.Bytes(), o.End.Bytes()) >= 0 {
+		return false
+	}
+	return true
+}
+
+// filtered returns true if some accounts might be excluded from the export
+func (o ExportOptions) filtered() bool {
+	return o.Prefix != "" || o.Start != nil || o.End != nil
+}
+
+// Export streams the accounts of the last committed state, or of opts.Root, to
+// w. It iterates over the trie at a fixed root, without holding the state's
+// locks, so it can run while the consensus system keeps committing
+// transactions. It returns the root of the exported state. In the genesis
+// format, the root is also recorded in the output when there are no filters,
+// so that an import can be verified.
+func (s *State) Export(w io.Writer, opts ExportOptions) (common.Hash, error) {
+	root := opts.Root
+	if root == (common.Hash{}) {
+		root = s.GetRoot()
+	}
+	start := time.Now()
+	progress := ExportProgress{Root: root}
+
+	bw := bufio.NewWriter(w)
+	enc := json.NewEncoder(bw)
+
+	var poaAccount *ethState.DumpAccount
+
+	if opts.Format == ExportGenesis {
+		header, err := s.exportHeader(root, opts)
+		if err != nil {
+			return root, err
+		}
+		if _, err := bw.Write(header); err != nil {
+			return root, err
+		}
+	}
+
+	err := iterateAccounts(s.db, root, func(addr common.Address, account ethState.DumpAccount) error {
+		progress.Visited++
+
+		if opts.Format == ExportGenesis && addr == s.poa.address {
+			poaAccount = &account
+		} else if opts.match(addr) {
+			if err := writeExportAccount(bw, enc, opts.Format, progress.Exported, addr, account); err != nil {
+				return err
+			}
+			progress.Exported++
+		}
+
+		if opts.Progress != nil && progress.Visited%exportProgressInterval == 0 {
+			progress.Elapsed = time.Since(start)
+			opts.Progress(progress)
+		}
+
+		return nil
+	})
+	if err != nil {
+		s.logger.WithError(err).Error("Exporting state")
+		return root, err
+	}
+
+	if opts.Format == ExportGenesis {
+		poa := bcommon.PoaMap{
+			Address: s.poa.address.Hex(),
+			Balance: "0",
+			Abi:     s.poa.abiString,
+		}
+		if poaAccount != nil {
+			poa.Balance = poaAccount.Balance
+			poa.Code = poaAccount.Code
+			poa.Storage = poaAccount.Storage
+			poa.Nonce = poaAccount.Nonce
+		}
+
+		js, err := json.Marshal(poa)
+		if err != nil {
+			return root, err
+		}
+
+		if _, err := fmt.Fprintf(bw, `},"Poa":%s}`, js); err != nil {
+			return root, err
+		}
+	}
+
+	if err := bw.Flush(); err != nil {
+		return root, err
+	}
+
+	progress.Elapsed = time.Since(start)
+	progress.Done = true
+	if opts.Progress != nil {
+		opts.Progress(progress)
+	}
+
+	s.logger.WithFields(logrus.Fields{
+		"root":     root.Hex(),
+		"visited":  progress.Visited,
+		"exported": progress.Exported,
+		"elapsed":  progress.Elapsed,
+	}).Info("Export")
+
+	return root, nil
+}
+
+// exportHeader returns the start of an export in the genesis format, up to the
+// accounts. It carries over the chain parameters of the genesis file, and the
+// root, which is only meaningful if the whole state is exported.
+func (s *State) exportHeader(root common.Hash, opts ExportOptions) ([]byte, error) {
+	genesis, err := s.GetGenesis()
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+
+	header := struct {
+		Root        string            `json:"Root,omitempty"`
+		Precompiles map[string]string `json:"precompiles,omitempty"`
+		Fees        *bcommon.FeeMap   `json:"fees,omitempty"`
+		GasLimit    uint64            `json:"gasLimit,omitempty"`
+		ChainID     uint64            `json:"chainId,omitempty"`
+	}{
+		Precompiles: genesis.Precompiles,
+		Fees:        genesis.Fees,
+		GasLimit:    genesis.GasLimit,
+		ChainID:     genesis.ChainID,
+	}
+	if !opts.filtered() {
+		header.Root = root.Hex()
+	}
+
+	js, err := json.Marshal(header)
+	if err != nil {
+		return nil, err
+	}
+
+	// The accounts follow in the same object
+	js = js[:len(js)-1]
+	if len(js) > 1 {
+		js = append(js, ',')
+	}
+
+	return append(js, `"Alloc":{`...), nil
+}
+
+// writeExportAccount writes an account in the given format. index is the number
+// of accounts written before this one.
+func writeExportAccount(bw *bufio.Writer,
+	enc *json.Encoder,
+	format ExportFormat,
+	index uint64,
+	addr common.Address,
+	account ethState.DumpAccount) error {
+
+	hexAddr := common.Bytes2Hex(addr.Bytes())
+
+	if format == ExportNDJSON {
+		return enc.Encode(ExportAccount{Address: hexAddr, DumpAccount: account})
+	}
+
+	if index > 0 {
+		if err := bw.WriteByte(','); err != nil {
+			return err
+		}
+	}
+
+	js, err := json.Marshal(account)
+	if err != nil {
+		return err
+	}
+
+	_, err = fmt.Fprintf(bw, "%q:%s", hexAddr, js)
+	return err
+}
+
+// iterateAccounts calls fn with every account of the state at root, including
+// its code and storage. Only one account is held in memory at a time.
+func iterateAccounts(db ethdb.Database, root common.Hash, fn func(common.Address, ethState.DumpAccount) error) error {
+	if root == (common.Hash{}) || root == _emptyRoot {
+		return nil
+	}
+
+	sdb := ethState.NewDatabase(trieTable(db))
+
+	tr, err := sdb.OpenTrie(root)
+	if err != nil {
+		return err
+	}
+
+	it := trie.NewIterator(tr.NodeIterator(nil))
+	for it.Next() {
+		preimage := tr.GetKey(it.Key)
+		if preimage == nil {
+			return fmt.Errorf("Missing preimage of account %x", it.Key)
+		}
+		addr := common.BytesToAddress(preimage)
+
+		var data ethState.Account
+		if err := rlp.DecodeBytes(it.Value, &data); err != nil {
+			return err
+		}
+
+		account := ethState.DumpAccount{
+			Balance:  data.Balance.String(),
+			Nonce:    data.Nonce,
+			Root:     common.Bytes2Hex(data.Root[:]),
+			CodeHash: common.Bytes2Hex(data.CodeHash),
+			Storage:  make(map[string]string),
+		}
+
+		if !bytes.Equal(data.CodeHash, _emptyCodeHash) {
+			code, err := sdb.ContractCode(common.BytesToHash(it.Key), common.BytesToHash(data.CodeHash))
+			if err != nil {
+				return err
+			}
+			account.Code = common.Bytes2Hex(code)
+		}
+
+		if data.Root != _emptyRoot {
+			st, err := sdb.OpenStorageTrie(common.BytesToHash(it.Key), data.Root)
+			if err != nil {
+				return err
+			}
+
+			sit := trie.NewIterator(st.NodeIterator(nil))
+			for sit.Next() {
+				// Storage values are RLP encoded in the trie
+				_, value, _, err := rlp.Split(sit.Value)
+				if err != nil {
+					return err
+				}
+				key := common.BytesToHash(st.GetKey(sit.Key))
+				account.Storage[common.Bytes2Hex(key.Bytes())] = common.Bytes2Hex(value)
+			}
+			if sit.Err != nil {
+				return sit.Err
+			}
+		}
+
+		if err := fn(addr, account); err != nil {
+			return err
+		}
+	}
+
+	return it.Err
+}
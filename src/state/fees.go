@@ -0,0 +1,180 @@
+package state
+
+import (
+	"bytes"
+	"fmt"
+	"math/big"
+	"sort"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/common/hexutil"
+	"github.com/sirupsen/logrus"
+
+	bcommon "github.com/mosaicnetworks/evm-lite/src/common"
+)
+
+/*
+The EVM credits the fees of a transaction, its gas used times its gas price, to
+the coinbase of the block. Unless the fee policy is FeeCoinbase, the WAS takes
+the fees back from the coinbase when it sets the receipt, and the State
+distributes their total when it commits, before the root is computed, so that
+every node computes the same state. The total and its distribution are recorded
+in the metadata of the commit.
+*/
+
+const (
+	// FeeCoinbase leaves the fees to the coinbase passed by the consensus
+	// system. This is the default policy.
+	FeeCoinbase = "coinbase"
+	// FeeBurn destroys the fees
+	FeeBurn = "burn"
+	// FeeTreasury credits the fees to the treasury address of the genesis file
+	FeeTreasury = "treasury"
+	// FeeValidators splits the fees equally among the validators of the last
+	// committed state. The remainder goes to the first validators, by address.
+	// If the validators cannot be read from the POA contract, the fees go to
+	// the treasury address of the genesis file, if any, or are burnt.
+	FeeValidators = "validators"
+)
+
+// feePolicy is the fee policy of the genesis file
+type feePolicy struct {
+	name     string
+	treasury common.Address
+}
+
+func defaultFeePolicy() feePolicy {
+	return feePolicy{name: FeeCoinbase}
+}
+
+// newFeePolicy parses the fees section of the genesis file
+func newFeePolicy(fees *bcommon.FeeMap) (feePolicy, error) {
+	if fees == nil || fees.Policy == "" {
+		return defaultFeePolicy(), nil
+	}
+
+	policy := feePolicy{name: fees.Policy}
+
+	switch fees.Policy {
+	case FeeCoinbase, FeeBurn:
+	case FeeValidators:
+		// The treasury is optional, as a fallback
+		if fees.Treasury != "" {
+			if !common.IsHexAddress(fees.Treasury) {
+				return policy, fmt.Errorf("Invalid treasury address %q", fees.Treasury)
+			}
+			policy.treasury = common.HexToAddress(fees.Treasury)
+		}
+	case FeeTreasury:
+		if !common.IsHexAddress(fees.Treasury) {
+			return policy, fmt.Errorf("Invalid treasury address %q", fees.Treasury)
+		}
+		policy.treasury = common.HexToAddress(fees.Treasury)
+	default:
+		return policy, fmt.Errorf("Unknown fee policy %q", fees.Policy)
+	}
+
+	return policy, nil
+}
+
+// loadFeePolicy sets the State's fee policy from the fees section of the
+// genesis file
+func (s *State) loadFeePolicy(fees *bcommon.FeeMap) error {
+	policy, err := newFeePolicy(fees)
+	if err != nil {
+		s.logger.WithError(err).Error("Parsing fee policy")
+		return err
+	}
+
+	s.feePolicy = policy
+	s.was.feePolicy = policy.name
+	s.was.redirectFees = policy.name != FeeCoinbase
+
+	s.logger.WithFields(logrus.Fields{
+		"policy":   policy.name,
+		"treasury": policy.treasury.Hex(),
+	}).Debug("Fee policy")
+
+	return nil
+}
+
+// distributeFees credits the fees collected by the WAS since the last commit
+// according to the fee policy. It cannot fail, so that a faulty POA contract
+// does not stop the chain: every node reads the same validators from the same
+// state, and therefore takes the same fallback.
+func (s *State) distributeFees() {
+	fees := s.was.Fees()
+
+	recipients := make(map[common.Address]*big.Int)
+
+	if fees.Sign() > 0 {
+		switch s.feePolicy.name {
+		case FeeTreasury:
+			recipients[s.feePolicy.treasury] = fees
+		case FeeValidators:
+			validators, err := s.GetValidators()
+			if err != nil {
+				recipients = s.undistributedFees(fees)
+				s.logger.WithError(err).WithField("fees", fees).Warn("Getting validators to distribute fees. Using fallback")
+				break
+			}
+			recipients = splitFees(fees, validators)
+		}
+	}
+
+	s.was.creditFees(recipients)
+}
+
+// undistributedFees returns the recipients of fees which cannot be split among
+// the validators: the treasury, if any, or nobody, which burns them.
+func (s *State) undistributedFees(fees *big.Int) map[common.Address]*big.Int {
+	recipients := make(map[common.Address]*big.Int)
+	if s.feePolicy.treasury != (common.Address{}) {
+		recipients[s.feePolicy.treasury] = fees
+	}
+	return recipients
+}
+
+// splitFees splits an amount equally among validators. The remainder is
+// distributed one unit at a time, in the order of the addresses. It is burnt
+// if there are no validators.
+func splitFees(fees *big.Int, validators []Validator) map[common.Address]*big.Int {
+	shares := make(map[common.Address]*big.Int)
+
+	if len(validators) == 0 {
+		return shares
+	}
+
+	addrs := make([]common.Address, 0, len(validators))
+	for _, v := range validators {
+		if _, ok := shares[v.Address]; !ok {
+			shares[v.Address] = nil
+			addrs = append(addrs, v.Address)
+		}
+	}
+
+	sort.Slice(addrs, func(i, j int) bool {
+		return bytes.Compare(addrs[i].Bytes(), addrs[j].Bytes()) < 0
+	})
+
+	share, remainder := new(big.Int).DivMod(fees, big.NewInt(int64(len(addrs))), new(big.Int))
+
+	for i, addr := range addrs {
+		amount := new(big.Int).Set(share)
+		if int64(i) < remainder.Int64() {
+			amount.Add(amount, big.NewInt(1))
+		}
+		shares[addr] = amount
+	}
+
+	return shares
+}
+
+// toHexBigs converts amounts for the JSON metadata
+func toHexBigs(amounts map[common.Address]*big.Int) map[common.Address]*hexutil.Big {
+	result := make(map[common.Address]*hexutil.Big, len(amounts))
+	for addr, amount := range amounts {
+		result[addr] = (*hexutil.Big)(new(big.Int).Set(amount))
+	}
+	return result
+}
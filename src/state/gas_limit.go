@@ -0,0 +1,82 @@
+package state
+
+import (
+	"fmt"
+
+	"github.com/ethereum/go-ethereum/core"
+)
+
+/*
+The transactions applied to the WAS between two commits form a block, whose
+total gas is bounded by the block gas limit. The gas of a transaction, ie. its
+gas limit, is reserved in the gas pool of the WAS before it is executed, so a
+transaction which does not fit in the gas left in the block is rejected with a
+GasLimitError, without being applied. If its gas does not exceed the block gas
+limit, the consensus system can defer it to a later block.
+*/
+
+// GasLimitError is returned when the gas of a transaction exceeds the gas left
+// in the block
+type GasLimitError struct {
+	Gas       uint64 // Gas of the transaction
+	Available uint64 // Gas left in the block
+	Limit     uint64 // Block gas limit
+}
+
+// Error implements the error interface
+func (e *GasLimitError) Error() string {
+	if !e.Deferrable() {
+		return fmt.Sprintf("Transaction gas %d exceeds the block gas limit %d", e.Gas, e.Limit)
+	}
+	return fmt.Sprintf("Transaction gas %d exceeds the gas left in the block (%d of %d)", e.Gas, e.Available, e.Limit)
+}
+
+// Deferrable returns true if the transaction fits in an empty block
+func (e *GasLimitError) Deferrable() bool {
+	return e.Gas <= e.Limit
+}
+
+// IsDeferrable returns true if err was returned for a transaction which did not
+// fit in the current block, but can be applied in a later one
+func IsDeferrable(err error) bool {
+	gasErr, ok := err.(*GasLimitError)
+	return ok && gasErr.Deferrable()
+}
+
+// reserveGas checks that a transaction's gas fits in a gas pool, before the
+// transaction is applied. The caller must hold the lock.
+func (bs *BaseState) reserveGas(gp *core.GasPool, gas uint64) error {
+	if gas > bs.gasLimit || gas > gp.Gas() {
+		return &GasLimitError{
+			Gas:       gas,
+			Available: gp.Gas(),
+			Limit:     bs.gasLimit,
+		}
+	}
+	return nil
+}
+
+// setGasLimit changes the block gas limit. The gas used since the last reset
+// is deducted from the new gas pool.
+func (bs *BaseState) setGasLimit(limit uint64) {
+	bs.Lock()
+	defer bs.Unlock()
+
+	bs.gasLimit = limit
+	bs.gp = new(core.GasPool).AddGas(limit)
+
+	if bs.totalUsedGas < limit {
+		bs.gp.SubGas(bs.totalUsedGas)
+	} else {
+		bs.gp.SubGas(limit)
+	}
+}
+
+// GasUsed returns the gas used by the transactions applied since the last
+// reset
+func (bs *BaseState) GasUsed() uint64 {
+	bs.Lock()
+	defer bs.Unlock()
+
+	return bs.totalUsedGas
+}
@@ -0,0 +1,168 @@
+package state
+
+import (
+	"encoding/hex"
+	"fmt"
+	"math/big"
+	"strings"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/common/math"
+	ethState "github.com/ethereum/go-ethereum/core/state"
+	ethTypes "github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/core/vm"
+
+	bcommon "github.com/mosaicnetworks/evm-lite/src/common"
+	"github.com/mosaicnetworks/evm-lite/src/currency"
+	"github.com/mosaicnetworks/evm-lite/src/database"
+)
+
+/*
+These functions help tools build genesis files. A contract is embedded in the
+genesis file with its runtime code and storage, so DeployGenesisContract runs
+its constructor in a throwaway state to obtain them. ValidateGenesis checks the
+values which NewState would otherwise reject, or fail on, when it creates the
+genesis accounts.
+*/
+
+// DeployGenesisContract executes the creation code of a contract, including its
+// ABI-encoded constructor arguments, against an empty state, and returns the
+// resulting runtime code and storage, in the format of the genesis file. The
+// constructor is executed by the zero address, and the storage must not depend
+// on the address of the contract, which differs in the genesis file.
+func DeployGenesisContract(creationCode []byte) (string, map[string]string, error) {
+	db, err := database.Open(database.Memory, "", 0)
+	if err != nil {
+		return "", nil, err
+	}
+	defer db.Close()
+
+	bs := NewBaseState(db,
+		common.Hash{},
+		ethTypes.NewEIP155Signer(CustomChainConfig.ChainID),
+		CustomChainConfig,
+		vm.Config{},
+		_gasLimit,
+	)
+
+	context := NewContext(common.Address{}, common.Address{}, _gasLimit, big.NewInt(0))
+	vmenv := vm.NewEVM(context, bs.stateDB, &bs.chainConfig, bs.vmConfig)
+
+	_, address, _, err := vmenv.Create(vm.AccountRef(common.Address{}), creationCode, _gasLimit, big.NewInt(0))
+	if err != nil {
+		return "", nil, fmt.Errorf("Executing contract constructor: %v", err)
+	}
+
+	root, err := bs.Commit()
+	if err != nil {
+		return "", nil, err
+	}
+
+	var contract *ethState.DumpAccount
+
+	err = iterateAccounts(db, root, func(addr common.Address, account ethState.DumpAccount) error {
+		if addr == address {
+			contract = &account
+		}
+		return nil
+	})
+	if err != nil {
+		return "", nil, err
+	}
+
+	if contract == nil || contract.Code == "" {
+		return "", nil, fmt.Errorf("Contract constructor returned no code")
+	}
+
+	return contract.Code, contract.Storage, nil
+}
+
+// ValidateGenesis checks the addresses, balances, code and storage of the
+// accounts of a genesis file, its POA contract, precompile addresses, and fee
+// policy. Precompile names are not checked, because they are registered at
+// runtime.
+func ValidateGenesis(genesis bcommon.Genesis) error {
+	for addr, account := range genesis.Alloc {
+		if !common.IsHexAddress(addr) {
+			return fmt.Errorf("Invalid account address %q", addr)
+		}
+		if err := validateGenesisAccount(account.Balance, account.Code, account.Storage); err != nil {
+			return fmt.Errorf("Account %s: %v", addr, err)
+		}
+	}
+
+	if genesis.Poa.Address != "" {
+		if !common.IsHexAddress(genesis.Poa.Address) {
+			return fmt.Errorf("Invalid POA address %q", genesis.Poa.Address)
+		}
+
+		poaAddress := common.HexToAddress(genesis.Poa.Address)
+		for addr := range genesis.Alloc {
+			if common.HexToAddress(addr) == poaAddress {
+				return fmt.Errorf("Account %s is also the POA contract", addr)
+			}
+		}
+
+		if _, err := newPOAContract(genesis.Poa.Address, genesis.Poa.Abi); err != nil {
+			return fmt.Errorf("Invalid POA ABI: %v", err)
+		}
+
+		if genesis.Poa.Code == "" {
+			return fmt.Errorf("POA contract has no code")
+		}
+
+		if err := validateGenesisAccount(genesis.Poa.Balance, genesis.Poa.Code, genesis.Poa.Storage); err != nil {
+			return fmt.Errorf("POA contract: %v", err)
+		}
+	}
+
+	for addr, name := range genesis.Precompiles {
+		if !common.IsHexAddress(addr) {
+			return fmt.Errorf("Invalid precompile address %q", addr)
+		}
+		if name == "" {
+			return fmt.Errorf("Precompile %s has no name", addr)
+		}
+	}
+
+	if _, err := newFeePolicy(genesis.Fees); err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// validateGenesisAccount checks the balance, code and storage of an account
+func validateGenesisAccount(balance string, code string, storage map[string]string) error {
+	if _, ok := math.ParseBig256(currency.ExpandCurrencyString(balance)); !ok {
+		return fmt.Errorf("Invalid balance %q", balance)
+	}
+
+	// The code is decoded without a 0x prefix
+	if _, err := hex.DecodeString(code); err != nil {
+		return fmt.Errorf("Invalid code: %v", err)
+	}
+
+	for key, value := range storage {
+		if !isHexWord(key) || !isHexWord(value) {
+			return fmt.Errorf("Invalid storage %q: %q", key, value)
+		}
+	}
+
+	return nil
+}
+
+// isHexWord returns true if s is a hex number which fits in 32 bytes, with or
+// without the 0x prefix
+func isHexWord(s string) bool {
+	s = strings.TrimPrefix(s, "0x")
+	if len(s) > 2*common.HashLength {
+		return false
+	}
+	for _, c := range s {
+		if !strings.ContainsRune("0123456789abcdefABCDEF", c) {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,220 @@
+package state
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/ethereum/go-ethereum/common"
+	ethTypes "github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/core/vm"
+	"github.com/sirupsen/logrus"
+
+	bcommon "github.com/mosaicnetworks/evm-lite/src/common"
+	"github.com/mosaicnetworks/evm-lite/src/database"
+)
+
+// importCommitInterval is the number of accounts between two intermediate
+// commits of an import. The stateDB is reopened after every intermediate commit,
+// which bounds the number of accounts held in memory.
+const importCommitInterval = 10000
+
+// ImportResult describes the state created by ImportState, and the chain
+// parameters of the export
+type ImportResult struct {
+	Root        common.Hash
+	Accounts    uint64
+	Poa         bcommon.PoaMap
+	Precompiles map[string]string
+	Fees        *bcommon.FeeMap
+	GasLimit    uint64
+	ChainID     uint64
+}
+
+// Genesis returns a genesis file for the imported state. It has the chain
+// parameters of the export, and the address and ABI of the POA smart-contract,
+// whose account is already in the imported database like the other accounts.
+func (r *ImportResult) Genesis() bcommon.Genesis {
+	return bcommon.Genesis{
+		Alloc: bcommon.AccountMap{},
+		Poa: bcommon.PoaMap{
+			Address: r.Poa.Address,
+			Abi:     r.Poa.Abi,
+		},
+		Precompiles: r.Precompiles,
+		Fees:        r.Fees,
+		GasLimit:    r.GasLimit,
+		ChainID:     r.ChainID,
+	}
+}
+
+// ImportState fills a new database from a genesis-compatible JSON stream, as
+// produced by Export, and records the resulting root as the last committed
+// state. The JSON is decoded one account at a time. If the stream contains a
+// Root, the resulting root must match it. The database must not contain a
+// committed state already.
+func ImportState(db database.Database, r io.Reader, logger *logrus.Entry) (*ImportResult, error) {
+	if _, _, err := Migrate(db, logger); err != nil {
+		return nil, err
+	}
+
+	head, err := ReadHead(db)
+	if err != nil {
+		return nil, err
+	}
+	if head != (common.Hash{}) {
+		return nil, fmt.Errorf("Database already contains a committed state")
+	}
+
+	bs := NewBaseState(db,
+		common.Hash{},
+		ethTypes.NewEIP155Signer(CustomChainConfig.ChainID),
+		CustomChainConfig,
+		vm.Config{},
+		_gasLimit,
+	)
+
+	result := &ImportResult{}
+	var expectedRoot common.Hash
+
+	createAccount := func(addr string, account bcommon.GenesisAccount) error {
+		bs.CreateAccount(common.HexToAddress(addr),
+			account.Code,
+			account.Storage,
+			account.Balance,
+			account.Nonce)
+
+		result.Accounts++
+
+		if result.Accounts%importCommitInterval == 0 {
+			root, err := bs.Commit()
+			if err != nil {
+				return err
+			}
+			// The stateDB keeps every account it loaded or created
+			if err := bs.Reset(root); err != nil {
+				return err
+			}
+			logger.WithField("accounts", result.Accounts).Debug("Importing")
+		}
+
+		return nil
+	}
+
+	dec := json.NewDecoder(r)
+
+	if err := expectDelim(dec, '{'); err != nil {
+		return nil, err
+	}
+
+	for dec.More() {
+		key, err := dec.Token()
+		if err != nil {
+			return nil, err
+		}
+
+		switch strings.ToLower(fmt.Sprint(key)) {
+		case "root":
+			if err := dec.Decode(&expectedRoot); err != nil {
+				return nil, err
+			}
+		case "precompiles":
+			if err := dec.Decode(&result.Precompiles); err != nil {
+				return nil, err
+			}
+		case "fees":
+			if err := dec.Decode(&result.Fees); err != nil {
+				return nil, err
+			}
+		case "gaslimit":
+			if err := dec.Decode(&result.GasLimit); err != nil {
+				return nil, err
+			}
+		case "chainid":
+			if err := dec.Decode(&result.ChainID); err != nil {
+				return nil, err
+			}
+		case "alloc":
+			if err := expectDelim(dec, '{'); err != nil {
+				return nil, err
+			}
+			for dec.More() {
+				addr, err := dec.Token()
+				if err != nil {
+					return nil, err
+				}
+				var account bcommon.GenesisAccount
+				if err := dec.Decode(&account); err != nil {
+					return nil, err
+				}
+				if err := createAccount(fmt.Sprint(addr), account); err != nil {
+					return nil, err
+				}
+			}
+			if err := expectDelim(dec, '}'); err != nil {
+				return nil, err
+			}
+		case "poa":
+			if err := dec.Decode(&result.Poa); err != nil {
+				return nil, err
+			}
+			if result.Poa.Address != "" {
+				err := createAccount(result.Poa.Address, bcommon.GenesisAccount{
+					Code:    result.Poa.Code,
+					Storage: result.Poa.Storage,
+					Balance: result.Poa.Balance,
+					Nonce:   result.Poa.Nonce,
+				})
+				if err != nil {
+					return nil, err
+				}
+			}
+		default:
+			var skip json.RawMessage
+			if err := dec.Decode(&skip); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	if err := expectDelim(dec, '}'); err != nil {
+		return nil, err
+	}
+
+	root, err := bs.Commit()
+	if err != nil {
+		return nil, err
+	}
+	result.Root = root
+
+	if expectedRoot != (common.Hash{}) && expectedRoot != root {
+		return result, fmt.Errorf("Imported root %s does not match expected root %s", root.Hex(), expectedRoot.Hex())
+	}
+
+	// The head is written last, so that an interrupted import leaves no
+	// committed state
+	if err := bs.WriteCommit(0, root, nil); err != nil {
+		return result, err
+	}
+
+	logger.WithFields(logrus.Fields{
+		"root":     root.Hex(),
+		"accounts": result.Accounts,
+	}).Info("Import")
+
+	return result, nil
+}
+
+// expectDelim reads the next JSON token and checks that it is the given
+// delimiter.
+func expectDelim(dec *json.Decoder, delim json.Delim) error {
+	tok, err := dec.Token()
+	if err != nil {
+		return err
+	}
+	if d, ok := tok.(json.Delim); !ok || d != delim {
+		return fmt.Errorf("Expected %v, got %v", delim, tok)
+	}
+	return nil
+}
@@ -0,0 +1,390 @@
+package state
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"math/big"
+	"time"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/common/hexutil"
+	"github.com/ethereum/go-ethereum/core/vm"
+	"github.com/ethereum/go-ethereum/ethdb"
+)
+
+/*
+Receipts only show the top-level sender and recipient of a transaction. The
+message calls, contract creations, and self-destructs performed by contracts
+during the execution are internal transactions. When they are recorded, they
+are persisted with the transaction, and indexed by the addresses they involve.
+*/
+
+// InternalTx is a message call, contract creation, or self-destruct performed
+// by a contract. Depth is 1 for the calls made by the contract called by the
+// transaction. Error is set if the internal transaction failed, and Reverted
+// if its effects were reverted, because it or one of its callers failed.
+type InternalTx struct {
+	Type     string         `json:"type"`
+	From     common.Address `json:"from"`
+	To       common.Address `json:"to"`
+	Value    *hexutil.Big   `json:"value"`
+	Input    hexutil.Bytes  `json:"input,omitempty"`
+	Depth    int            `json:"depth"`
+	Error    string         `json:"error,omitempty"`
+	Reverted bool           `json:"reverted"`
+}
+
+// AddressInternalTx is an internal transaction returned by an address query,
+// with the transaction and the commit it belongs to.
+type AddressInternalTx struct {
+	Commit uint64      `json:"commit"`
+	TxHash common.Hash `json:"txHash"`
+	InternalTx
+}
+
+/*******************************************************************************
+Tracer
+*******************************************************************************/
+
+// pendingCall is an internal call whose frame has not returned yet
+type pendingCall struct {
+	index  int
+	depth  int // depth of the frame of the call
+	parent int // index of the caller, or -1 for the transaction
+}
+
+// callTracer is a vm.Tracer which records the internal transactions. Calls are
+// detected when their opcode is executed, and their outcome when the execution
+// resumes in the caller's frame. A callTracer traces a single transaction.
+type callTracer struct {
+	txs     []InternalTx
+	parents []int
+	pending []pendingCall
+	failed  bool
+}
+
+func newCallTracer() *callTracer {
+	return &callTracer{}
+}
+
+// CaptureStart implements vm.Tracer
+func (t *callTracer) CaptureStart(from common.Address, to common.Address, create bool, input []byte, gas uint64, value *big.Int) error {
+	return nil
+}
+
+// CaptureState implements vm.Tracer
+func (t *callTracer) CaptureState(env *vm.EVM, pc uint64, op vm.OpCode, gas, cost uint64, memory *vm.Memory, stack *vm.Stack, contract *vm.Contract, depth int, err error) error {
+	t.returned(depth, stack)
+
+	if err != nil {
+		t.fail(depth, err.Error())
+		return nil
+	}
+
+	if op == vm.REVERT {
+		t.fail(depth, "execution reverted")
+		return nil
+	}
+
+	data := stack.Data()
+	back := func(n int) *big.Int {
+		return data[len(data)-1-n]
+	}
+	input := func(offset, size *big.Int) []byte {
+		return memory.GetCopy(offset.Int64(), size.Int64())
+	}
+
+	call := InternalTx{
+		Type:  op.String(),
+		From:  contract.Address(),
+		Value: new(hexutil.Big),
+		Depth: depth,
+	}
+
+	switch op {
+	case vm.CALL, vm.CALLCODE:
+		call.To = common.BigToAddress(back(1))
+		call.Value = (*hexutil.Big)(new(big.Int).Set(back(2)))
+		call.Input = input(back(3), back(4))
+	case vm.DELEGATECALL, vm.STATICCALL:
+		call.To = common.BigToAddress(back(1))
+		call.Input = input(back(2), back(3))
+	case vm.CREATE, vm.CREATE2:
+		call.Value = (*hexutil.Big)(new(big.Int).Set(back(0)))
+		call.Input = input(back(1), back(2))
+	case vm.SELFDESTRUCT:
+		call.To = common.BigToAddress(back(0))
+		call.Value = (*hexutil.Big)(new(big.Int).Set(env.StateDB.GetBalance(contract.Address())))
+		t.add(call, depth)
+		return nil
+	default:
+		return nil
+	}
+
+	t.pending = append(t.pending, pendingCall{
+		index:  t.add(call, depth),
+		depth:  depth + 1,
+		parent: t.caller(depth),
+	})
+
+	return nil
+}
+
+// CaptureFault implements vm.Tracer
+func (t *callTracer) CaptureFault(env *vm.EVM, pc uint64, op vm.OpCode, gas, cost uint64, memory *vm.Memory, stack *vm.Stack, contract *vm.Contract, depth int, err error) error {
+	t.fail(depth, err.Error())
+	return nil
+}
+
+// CaptureEnd implements vm.Tracer
+func (t *callTracer) CaptureEnd(output []byte, gasUsed uint64, d time.Duration, err error) error {
+	// The calls which are still pending did not return to their caller
+	for _, p := range t.pending {
+		if t.txs[p.index].Error == "" {
+			t.txs[p.index].Error = "internal failure"
+		}
+	}
+	t.pending = nil
+
+	t.failed = err != nil
+
+	return nil
+}
+
+// add appends an internal transaction made from the frame at depth
+func (t *callTracer) add(call InternalTx, depth int) int {
+	t.txs = append(t.txs, call)
+	t.parents = append(t.parents, t.caller(depth))
+	return len(t.txs) - 1
+}
+
+// caller returns the index of the call whose frame is at depth, or -1 for the
+// transaction itself
+func (t *callTracer) caller(depth int) int {
+	for i := len(t.pending) - 1; i >= 0; i-- {
+		if t.pending[i].depth == depth {
+			return t.pending[i].index
+		}
+	}
+	return -1
+}
+
+// returned completes the pending calls whose frame returned, once the execution
+// resumes at depth. The result of the call is on the top of the stack.
+func (t *callTracer) returned(depth int, stack *vm.Stack) {
+	for len(t.pending) > 0 && t.pending[len(t.pending)-1].depth > depth {
+		p := t.pending[len(t.pending)-1]
+		t.pending = t.pending[:len(t.pending)-1]
+
+		data := stack.Data()
+		result := data[len(data)-1]
+
+		call := &t.txs[p.index]
+
+		if result.Sign() == 0 {
+			if call.Error == "" {
+				call.Error = "internal failure"
+			}
+			continue
+		}
+
+		if call.Type == vm.CREATE.String() || call.Type == vm.CREATE2.String() {
+			call.To = common.BigToAddress(result)
+		}
+	}
+}
+
+// fail records an error in the frame at depth
+func (t *callTracer) fail(depth int, err string) {
+	if len(t.pending) == 0 {
+		return
+	}
+
+	p := t.pending[len(t.pending)-1]
+	if p.depth == depth && t.txs[p.index].Error == "" {
+		t.txs[p.index].Error = err
+	}
+}
+
+// internalTxs returns the internal transactions, once the transaction is
+// applied
+func (t *callTracer) internalTxs() []InternalTx {
+	if t.txs == nil {
+		return []InternalTx{}
+	}
+
+	for i := range t.txs {
+		t.txs[i].Reverted = t.reverted(i)
+	}
+	return t.txs
+}
+
+func (t *callTracer) reverted(i int) bool {
+	if t.failed {
+		return true
+	}
+	for ; i >= 0; i = t.parents[i] {
+		if t.txs[i].Error != "" && t.txs[i].Type != vm.SELFDESTRUCT.String() {
+			return true
+		}
+	}
+	return false
+}
+
+/*******************************************************************************
+Persistence
+*******************************************************************************/
+
+// addressIndexKey returns the key under which an internal transaction of a
+// transaction in a commit is indexed for an address
+func addressIndexKey(addr common.Address, commit uint64, txHash common.Hash) []byte {
+	key := make([]byte, 0, len(_addressIndexPrefix)+common.AddressLength+8+common.HashLength)
+	key = append(key, _addressIndexPrefix...)
+	key = append(key, addr.Bytes()...)
+	key = append(key, make([]byte, 8)...)
+	binary.BigEndian.PutUint64(key[len(key)-8:], commit)
+	return append(key, txHash.Bytes()...)
+}
+
+// internalTxAddresses returns the addresses involved in a list of internal
+// transactions
+func internalTxAddresses(txs []InternalTx) []common.Address {
+	seen := make(map[common.Address]bool)
+	addrs := []common.Address{}
+
+	for _, tx := range txs {
+		for _, addr := range []common.Address{tx.From, tx.To} {
+			if !seen[addr] {
+				seen[addr] = true
+				addrs = append(addrs, addr)
+			}
+		}
+	}
+
+	return addrs
+}
+
+// WriteInternalTxs adds the internal transactions of a set of transactions to
+// a batch, and indexes them by address. Transactions applied without recording
+// internal transactions are skipped.
+func (bs *BaseState) WriteInternalTxs(batch ethdb.Batch, commit uint64, txs map[common.Hash]*EVMLTransaction) error {
+	for hash, tx := range txs {
+		if tx.internalTxs == nil {
+			continue
+		}
+
+		data, err := json.Marshal(tx.internalTxs)
+		if err != nil {
+			return err
+		}
+
+		if err := batch.Put(internalTxsKey(hash), data); err != nil {
+			return err
+		}
+
+		for _, addr := range internalTxAddresses(tx.internalTxs) {
+			if err := batch.Put(addressIndexKey(addr, commit, hash), []byte{}); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// deleteInternalTxs adds the deletion of the internal transactions of a
+// transaction, and of their index entries, to a batch
+func deleteInternalTxs(db ethdb.Database, batch ethdb.Batch, commit uint64, txHash common.Hash) error {
+	txs, err := readInternalTxs(db, txHash)
+	if err != nil || txs == nil {
+		return err
+	}
+
+	for _, addr := range internalTxAddresses(txs) {
+		if err := batch.Delete(addressIndexKey(addr, commit, txHash)); err != nil {
+			return err
+		}
+	}
+
+	return batch.Delete(internalTxsKey(txHash))
+}
+
+// readInternalTxs returns the internal transactions of a transaction, or nil if
+// they were not recorded
+func readInternalTxs(db ethdb.Database, txHash common.Hash) ([]InternalTx, error) {
+	has, err := db.Has(internalTxsKey(txHash))
+	if err != nil || !has {
+		return nil, err
+	}
+
+	data, err := db.Get(internalTxsKey(txHash))
+	if err != nil {
+		return nil, err
+	}
+
+	txs := []InternalTx{}
+	if err := json.Unmarshal(data, &txs); err != nil {
+		return nil, err
+	}
+
+	return txs, nil
+}
+
+// GetInternalTxs returns the internal transactions of a transaction, if they
+// were recorded
+func (s *State) GetInternalTxs(txHash common.Hash) ([]InternalTx, error) {
+	txs, err := readInternalTxs(s.db, txHash)
+	if err != nil {
+		return nil, err
+	}
+
+	if txs == nil {
+		return nil, fmt.Errorf("No internal transactions for transaction %s", txHash.Hex())
+	}
+
+	return txs, nil
+}
+
+// GetAddressInternalTxs returns the internal transactions from or to an
+// address, in the commits from start, in order. At most limit transactions are
+// returned, unless limit is 0.
+func (s *State) GetAddressInternalTxs(addr common.Address, start uint64, limit int) ([]AddressInternalTx, error) {
+	prefix := prefixedKey(_addressIndexPrefix, addr.Bytes())
+
+	// The index is ordered by commit, so the iterator starts at the first key
+	// of the start commit
+	it := s.db.NewIteratorWithStart(prefix, addressIndexKey(addr, start, common.Hash{}))
+	defer it.Release()
+
+	result := []AddressInternalTx{}
+
+	for it.Next() {
+		key := it.Key()[len(prefix):]
+		commit := binary.BigEndian.Uint64(key[:8])
+		txHash := common.BytesToHash(key[8:])
+
+		txs, err := readInternalTxs(s.db, txHash)
+		if err != nil {
+			return nil, err
+		}
+
+		for _, tx := range txs {
+			if tx.From != addr && tx.To != addr {
+				continue
+			}
+
+			result = append(result, AddressInternalTx{
+				Commit:     commit,
+				TxHash:     txHash,
+				InternalTx: tx,
+			})
+
+			if limit > 0 && len(result) >= limit {
+				return result, nil
+			}
+		}
+	}
+
+	return result, it.Error()
+}
@@ -0,0 +1,539 @@
+package state
+
+import (
+	"math/big"
+	"sync"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core"
+	ethState "github.com/ethereum/go-ethereum/core/state"
+	ethTypes "github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/core/vm"
+)
+
+/*
+ApplyTransactionsParallel executes the transactions of a block optimistically
+in parallel, and produces exactly the same state and receipts as applying them
+one at a time with ApplyTransaction.
+
+Every transaction is first executed speculatively by a pool of workers, on its
+own copy of the state at the start of the block. The execution records the
+accounts and storage slots it reads, with their values, and the changes it
+makes.
+
+The speculations are then merged into the stateDB in block order. Before a
+speculation is merged, the values it read are compared with the current
+values. If they are the same, the transaction would execute in the same way on
+the current state, so its changes are applied directly. Otherwise, it is
+re-executed in order on the current state.
+
+Balance increases of accounts which a transaction does not read, like the
+coinbase or the recipient of a transfer, are merged as deltas, so that they do
+not conflict. Transactions which destroy a contract, or create an account over
+an existing one, are always re-executed in order.
+*/
+
+// Fields of an account read by a transaction
+const (
+	readBalance uint8 = 1 << iota
+	readNonce
+	readCode
+	readExist
+	readAccount = readBalance | readNonce | readCode | readExist
+)
+
+type slotKey struct {
+	addr common.Address
+	key  common.Hash
+}
+
+// accountValue holds the fields of an account which transactions can read
+type accountValue struct {
+	exist    bool
+	balance  *big.Int
+	nonce    uint64
+	codeHash common.Hash
+}
+
+func readAccountValue(stateDB *ethState.StateDB, addr common.Address) accountValue {
+	return accountValue{
+		exist:    stateDB.Exist(addr),
+		balance:  new(big.Int).Set(stateDB.GetBalance(addr)),
+		nonce:    stateDB.GetNonce(addr),
+		codeHash: stateDB.GetCodeHash(addr),
+	}
+}
+
+// accessRecorder is the vm.StateDB of a speculative execution. It records the
+// value of every account and storage slot before the transaction first
+// accesses it, and which of them the transaction reads.
+type accessRecorder struct {
+	*ethState.StateDB
+
+	accounts  map[common.Address]accountValue
+	reads     map[common.Address]uint8
+	slots     map[slotKey]common.Hash
+	slotReads map[slotKey]struct{}
+
+	// ordered is set when the transaction must be re-executed in order
+	ordered bool
+
+	// diff is set when the code of the accounts is recorded for stateDiff
+	diff bool
+	code map[common.Address][]byte
+}
+
+func newAccessRecorder(stateDB *ethState.StateDB) *accessRecorder {
+	return &accessRecorder{
+		StateDB:   stateDB,
+		accounts:  make(map[common.Address]accountValue),
+		reads:     make(map[common.Address]uint8),
+		slots:     make(map[slotKey]common.Hash),
+		slotReads: make(map[slotKey]struct{}),
+	}
+}
+
+// newDiffRecorder returns an accessRecorder which records the state diff of a
+// transaction
+func newDiffRecorder(stateDB *ethState.StateDB) *accessRecorder {
+	r := newAccessRecorder(stateDB)
+	r.diff = true
+	r.code = make(map[common.Address][]byte)
+	return r
+}
+
+func (r *accessRecorder) account(addr common.Address, fields uint8) {
+	if _, ok := r.accounts[addr]; !ok {
+		r.accounts[addr] = readAccountValue(r.StateDB, addr)
+		if r.diff {
+			r.code[addr] = common.CopyBytes(r.StateDB.GetCode(addr))
+		}
+	}
+	r.reads[addr] |= fields
+}
+
+func (r *accessRecorder) slot(addr common.Address, key common.Hash, read bool) {
+	if r.diff {
+		r.account(addr, 0)
+	}
+
+	k := slotKey{addr, key}
+	if _, ok := r.slots[k]; !ok {
+		r.slots[k] = r.StateDB.GetState(addr, key)
+	}
+	if read {
+		r.slotReads[k] = struct{}{}
+	}
+}
+
+// Every write depends on the existence of the account, because it creates the
+// account if it does not exist.
+
+func (r *accessRecorder) CreateAccount(addr common.Address) {
+	if r.StateDB.Exist(addr) {
+		r.ordered = true
+	}
+	r.account(addr, readExist)
+	r.StateDB.CreateAccount(addr)
+}
+
+func (r *accessRecorder) SubBalance(addr common.Address, amount *big.Int) {
+	r.account(addr, readExist)
+	r.StateDB.SubBalance(addr, amount)
+}
+
+func (r *accessRecorder) AddBalance(addr common.Address, amount *big.Int) {
+	r.account(addr, readExist)
+	r.StateDB.AddBalance(addr, amount)
+}
+
+func (r *accessRecorder) GetBalance(addr common.Address) *big.Int {
+	r.account(addr, readBalance)
+	return r.StateDB.GetBalance(addr)
+}
+
+func (r *accessRecorder) GetNonce(addr common.Address) uint64 {
+	r.account(addr, readNonce)
+	return r.StateDB.GetNonce(addr)
+}
+
+func (r *accessRecorder) SetNonce(addr common.Address, nonce uint64) {
+	r.account(addr, readExist)
+	r.StateDB.SetNonce(addr, nonce)
+}
+
+func (r *accessRecorder) GetCodeHash(addr common.Address) common.Hash {
+	r.account(addr, readCode)
+	return r.StateDB.GetCodeHash(addr)
+}
+
+func (r *accessRecorder) GetCode(addr common.Address) []byte {
+	r.account(addr, readCode)
+	return r.StateDB.GetCode(addr)
+}
+
+func (r *accessRecorder) SetCode(addr common.Address, code []byte) {
+	r.account(addr, readExist)
+	r.StateDB.SetCode(addr, code)
+}
+
+func (r *accessRecorder) GetCodeSize(addr common.Address) int {
+	r.account(addr, readCode)
+	return r.StateDB.GetCodeSize(addr)
+}
+
+func (r *accessRecorder) GetCommittedState(addr common.Address, key common.Hash) common.Hash {
+	r.slot(addr, key, true)
+	return r.StateDB.GetCommittedState(addr, key)
+}
+
+func (r *accessRecorder) GetState(addr common.Address, key common.Hash) common.Hash {
+	r.slot(addr, key, true)
+	return r.StateDB.GetState(addr, key)
+}
+
+func (r *accessRecorder) SetState(addr common.Address, key common.Hash, value common.Hash) {
+	r.account(addr, readExist)
+	r.slot(addr, key, false)
+	r.StateDB.SetState(addr, key, value)
+}
+
+func (r *accessRecorder) Suicide(addr common.Address) bool {
+	r.ordered = true
+	r.account(addr, readAccount)
+	return r.StateDB.Suicide(addr)
+}
+
+func (r *accessRecorder) Exist(addr common.Address) bool {
+	r.account(addr, readExist)
+	return r.StateDB.Exist(addr)
+}
+
+func (r *accessRecorder) Empty(addr common.Address) bool {
+	r.account(addr, readAccount)
+	return r.StateDB.Empty(addr)
+}
+
+// valid returns true if the values read by the transaction are the same in
+// stateDB
+func (r *accessRecorder) valid(stateDB *ethState.StateDB) bool {
+	for addr, fields := range r.reads {
+		before := r.accounts[addr]
+		now := readAccountValue(stateDB, addr)
+
+		if fields&readExist != 0 && before.exist != now.exist {
+			return false
+		}
+		if fields&readBalance != 0 && before.balance.Cmp(now.balance) != 0 {
+			return false
+		}
+		if fields&readNonce != 0 && before.nonce != now.nonce {
+			return false
+		}
+		if fields&readCode != 0 && before.codeHash != now.codeHash {
+			return false
+		}
+	}
+
+	for k := range r.slotReads {
+		if stateDB.GetState(k.addr, k.key) != r.slots[k] {
+			return false
+		}
+	}
+
+	return true
+}
+
+// accountChange is the change made to an account by a transaction. The fields
+// in written are set to their value in after, and the balance is increased by
+// delta otherwise.
+type accountChange struct {
+	addr    common.Address
+	after   accountValue
+	code    []byte
+	written uint8
+	delta   *big.Int
+}
+
+// changes returns the changes made by the transaction, once the stateDB is
+// finalised. It adds to the reads the fields which the changes depend on.
+func (r *accessRecorder) changes() ([]accountChange, map[slotKey]common.Hash) {
+	accounts := []accountChange{}
+
+	for addr, before := range r.accounts {
+		after := readAccountValue(r.StateDB, addr)
+
+		change := accountChange{
+			addr:  addr,
+			after: after,
+			delta: new(big.Int),
+		}
+
+		// Creating or deleting an account depends on all its fields
+		if before.exist != after.exist {
+			r.reads[addr] |= readAccount
+			change.written = readAccount
+		}
+
+		if before.nonce != after.nonce {
+			change.written |= readNonce
+		}
+
+		if before.codeHash != after.codeHash {
+			change.written |= readCode
+		}
+
+		if r.reads[addr]&readBalance != 0 {
+			if before.balance.Cmp(after.balance) != 0 {
+				change.written |= readBalance
+			}
+		} else {
+			change.delta.Sub(after.balance, before.balance)
+
+			// An account which is touched without changing its balance is
+			// deleted if it is empty.
+			if change.delta.Sign() == 0 {
+				r.reads[addr] |= readAccount
+			}
+		}
+
+		if change.written&readCode != 0 {
+			change.code = r.StateDB.GetCode(addr)
+		}
+
+		if change.written == 0 && change.delta.Sign() == 0 {
+			continue
+		}
+
+		accounts = append(accounts, change)
+	}
+
+	slots := make(map[slotKey]common.Hash)
+	for k, before := range r.slots {
+		if after := r.StateDB.GetState(k.addr, k.key); after != before {
+			slots[k] = after
+		}
+	}
+
+	return accounts, slots
+}
+
+// speculation is the outcome of the speculative execution of a transaction
+type speculation struct {
+	recorder  *accessRecorder
+	accounts  []accountChange
+	slots     map[slotKey]common.Hash
+	logs      []*ethTypes.Log
+	preimages map[common.Hash][]byte
+	gas       uint64
+	failed    bool
+
+	internalTxs []InternalTx
+
+	// ordered is set when the transaction must be re-executed in order
+	ordered bool
+}
+
+// ApplyTransactionsParallel applies the transactions of a block, with indexes
+// starting at 0, using the given number of workers. Nil transactions are
+// skipped. It returns the error of every transaction, as ApplyTransaction
+// would, and the number of transactions which had to be re-executed.
+func (bs *BaseState) ApplyTransactionsParallel(
+	txs []*EVMLTransaction,
+	blockHash common.Hash,
+	coinbase common.Address,
+	workers int) (errs []error, reexecuted int) {
+
+	bs.Lock()
+	defer bs.Unlock()
+
+	errs = make([]error, len(txs))
+
+	// The speculations start from a copy of the state at the start of the
+	// block, so that they can run while earlier transactions are merged.
+	base := bs.stateDB.Copy()
+	var baseLock sync.Mutex
+
+	results := make([]chan *speculation, len(txs))
+	for i := range results {
+		results[i] = make(chan *speculation, 1)
+	}
+
+	jobs := make(chan int)
+	go func() {
+		for i := range txs {
+			jobs <- i
+		}
+		close(jobs)
+	}()
+
+	for w := 0; w < workers; w++ {
+		go func() {
+			for i := range jobs {
+				if txs[i] == nil {
+					results[i] <- nil
+					continue
+				}
+
+				baseLock.Lock()
+				stateDB := base.Copy()
+				baseLock.Unlock()
+
+				results[i] <- bs.speculate(stateDB, txs[i], i, blockHash, coinbase)
+			}
+		}()
+	}
+
+	for i, tx := range txs {
+		spec := <-results[i]
+		if tx == nil {
+			continue
+		}
+
+		if bs.merge(spec, tx, i, blockHash, coinbase) {
+			continue
+		}
+
+		reexecuted++
+		errs[i] = bs.applyTransaction(tx, i, blockHash, coinbase, false)
+	}
+
+	return errs, reexecuted
+}
+
+// speculate executes a transaction on its own stateDB and records its reads
+// and changes
+func (bs *BaseState) speculate(
+	stateDB *ethState.StateDB,
+	tx *EVMLTransaction,
+	txIndex int,
+	blockHash common.Hash,
+	coinbase common.Address) *speculation {
+
+	msg := tx.Msg()
+
+	context := NewContext(msg.From(), coinbase, msg.Gas(), msg.GasPrice())
+
+	stateDB.Prepare(tx.Hash(), blockHash, txIndex)
+
+	recorder := newAccessRecorder(stateDB)
+
+	// Every speculation has its own tracer, as tracers are not safe for
+	// concurrent use
+	var tracers []vm.Tracer
+
+	var tracer *callTracer
+	if bs.recordInternalTxs {
+		tracer = newCallTracer()
+		tracers = append(tracers, tracer)
+	}
+
+	vmenv := newEVM(context, recorder, &bs.chainConfig, bs.vmConfig, bs.precompiles, tracers...)
+
+	_, gas, failed, err := core.ApplyMessage(vmenv, msg, new(core.GasPool).AddGas(msg.Gas()))
+	if err != nil || recorder.ordered {
+		// Consensus errors are returned by the execution in order
+		return &speculation{ordered: true}
+	}
+
+	stateDB.Finalise(true)
+
+	spec := &speculation{
+		recorder:  recorder,
+		logs:      stateDB.GetLogs(tx.Hash()),
+		preimages: stateDB.Preimages(),
+		gas:       gas,
+		failed:    failed,
+	}
+
+	spec.accounts, spec.slots = recorder.changes()
+
+	if tracer != nil {
+		spec.internalTxs = tracer.internalTxs()
+	}
+
+	return spec
+}
+
+// merge applies the changes of a speculation to the stateDB and sets the
+// receipt of the transaction. It returns false, without changing anything, if
+// the transaction must be re-executed. The caller must hold the lock.
+func (bs *BaseState) merge(
+	spec *speculation,
+	tx *EVMLTransaction,
+	txIndex int,
+	blockHash common.Hash,
+	coinbase common.Address) bool {
+
+	if spec.ordered ||
+		bs.gp.Gas() < tx.Msg().Gas() ||
+		!spec.recorder.valid(bs.stateDB) {
+		return false
+	}
+
+	// Record the values before the changes for the state diff
+	var recorder *accessRecorder
+	if bs.recordStateDiffs {
+		recorder = newDiffRecorder(bs.stateDB)
+		for addr := range spec.recorder.accounts {
+			recorder.account(addr, 0)
+		}
+		for k := range spec.recorder.slots {
+			recorder.slot(k.addr, k.key, false)
+		}
+	}
+
+	bs.stateDB.Prepare(tx.Hash(), blockHash, txIndex)
+
+	for k, value := range spec.slots {
+		bs.stateDB.SetState(k.addr, k.key, value)
+	}
+
+	for _, change := range spec.accounts {
+		if !change.after.exist {
+			// The account was emptied, and is deleted when the stateDB is
+			// finalised
+			bs.stateDB.SetBalance(change.addr, new(big.Int))
+			bs.stateDB.SetNonce(change.addr, 0)
+			continue
+		}
+
+		if change.written&readBalance != 0 {
+			bs.stateDB.SetBalance(change.addr, change.after.balance)
+		}
+		if change.written&readNonce != 0 {
+			bs.stateDB.SetNonce(change.addr, change.after.nonce)
+		}
+		if change.written&readCode != 0 {
+			bs.stateDB.SetCode(change.addr, change.code)
+		}
+
+		switch change.delta.Sign() {
+		case 1:
+			bs.stateDB.AddBalance(change.addr, change.delta)
+		case -1:
+			bs.stateDB.SubBalance(change.addr, new(big.Int).Neg(change.delta))
+		}
+	}
+
+	for _, log := range spec.logs {
+		l := *log
+		bs.stateDB.AddLog(&l)
+	}
+
+	for hash, preimage := range spec.preimages {
+		bs.stateDB.AddPreimage(hash, preimage)
+	}
+
+	bs.gp.SubGas(spec.gas)
+
+	bs.setReceipt(tx, coinbase, spec.gas, spec.failed)
+
+	if recorder != nil {
+		tx.stateDiff = recorder.stateDiff()
+	}
+
+	tx.internalTxs = spec.internalTxs
+
+	return true
+}
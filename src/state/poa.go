@@ -1,42 +1,180 @@
 package state
 
 import (
+	"fmt"
 	"strings"
 
 	"github.com/ethereum/go-ethereum/accounts/abi"
 	eth_common "github.com/ethereum/go-ethereum/common"
+	ethTypes "github.com/ethereum/go-ethereum/core/types"
 )
 
 /*
 The POA smart-contract needs to implement a very simple interface. The only
 required method is: checkAuthorised(address) bool
+
+Optionally, the contract can expose the whole whitelist, which allows a
+consensus module to discover the full validator set. The following methods are
+detected from the ABI:
+
+	getWhiteListCount() uint256
+	getWhiteListAddressFromIdx(uint256) address
+	getMoniker(address) bytes32
+
+getMoniker is only used to annotate validators, and is not required for the
+enumeration.
+
+Finally, the State watches the following events, if they are defined in the
+ABI, to notify the consensus system of changes to the whitelist:
+
+	MemberAdded(address, ...)
+	MemberRemoved(address, ...)
+	MemberEvicted(address, ...)
+
+The first address argument of the event, indexed or not, identifies the member.
 */
 
 const defaultPOAABI = "[{\"type\":\"function\",\"inputs\": [{\"name\":\"addr\",\"type\":\"address\"}],\"name\":\"checkAuthorised\",\"outputs\": [{\"name\":\"\",\"type\":\"bool\"}]}]"
 const defaultPOAADDR = "0XABBAABBAABBAABBAABBAABBAABBAABBAABBAABBA"
 
-var (
-	// POAABI defines the ABI of the POA smart-contract as needed by a consensus
-	// module to check if an address is authorized
-	POAABI abi.ABI
+const (
+	poaCheckAuthorisedMethod  = "checkAuthorised"
+	poaWhiteListCountMethod   = "getWhiteListCount"
+	poaWhiteListAddressMethod = "getWhiteListAddressFromIdx"
+	poaMonikerMethod          = "getMoniker"
+)
+
+// poaMaxValidators bounds the size of the whitelist reported by the POA
+// contract, so that a faulty contract cannot make GetValidators run an
+// unbounded number of calls.
+const poaMaxValidators = 1024
+
+// poaEvents maps the names of the events watched by the State to the
+// corresponding type of change in the validator set.
+var poaEvents = map[string]ValidatorChangeType{
+	"MemberAdded":   ValidatorAdded,
+	"MemberRemoved": ValidatorRemoved,
+	"MemberEvicted": ValidatorRemoved,
+}
 
-	// POAABISTRING is the string representaion of POAABI
-	POAABISTRING string
+// poaContract holds the configuration of the POA smart-contract as needed by a
+// consensus module to check if an address is authorised. Each State has its
+// own poaContract, set from the genesis file, so that multiple States can live
+// in the same process.
+type poaContract struct {
+	// address is the address of the POA smart-contract
+	address eth_common.Address
 
-	// POAADDR is the address of the POA smart-contract.
-	POAADDR eth_common.Address
-)
+	// abi is the parsed ABI of the POA smart-contract
+	abi abi.ABI
+
+	// abiString is the string representation of abi
+	abiString string
+
+	// events are the watched events defined in the ABI, indexed by id
+	events map[eth_common.Hash]abi.Event
+}
 
-func init() {
-	POAABI, _ = abi.JSON(strings.NewReader(defaultPOAABI))
-	POAADDR = eth_common.HexToAddress(defaultPOAADDR)
+// newPOAContract parses the ABI and returns the corresponding poaContract
+func newPOAContract(address string, abiString string) (*poaContract, error) {
+	poaABI, err := abi.JSON(strings.NewReader(abiString))
+	if err != nil {
+		return nil, err
+	}
+
+	events := make(map[eth_common.Hash]abi.Event)
+	for name, event := range poaABI.Events {
+		if _, ok := poaEvents[name]; ok {
+			events[event.Id()] = event
+		}
+	}
+
+	return &poaContract{
+		address:   eth_common.HexToAddress(address),
+		abi:       poaABI,
+		abiString: abiString,
+		events:    events,
+	}, nil
+}
+
+// defaultPOAContract returns the poaContract used when the genesis file does
+// not define one.
+func defaultPOAContract() *poaContract {
+	poa, _ := newPOAContract(defaultPOAADDR, defaultPOAABI)
+	return poa
+}
+
+// hasMethod returns true if the contract's ABI defines the given method
+func (p *poaContract) hasMethod(name string) bool {
+	_, ok := p.abi.Methods[name]
+	return ok
+}
+
+// canEnumerate returns true if the contract exposes the methods required to
+// list the whole whitelist.
+func (p *poaContract) canEnumerate() bool {
+	return p.hasMethod(poaWhiteListCountMethod) &&
+		p.hasMethod(poaWhiteListAddressMethod)
 }
 
-func setPOAABI(poaABI string) {
-	POAABISTRING = poaABI
-	POAABI, _ = abi.JSON(strings.NewReader(poaABI))
+// parseValidatorChange returns the change to the validator set described by a
+// log, or nil if the log was not emitted by the POA contract or is not a
+// watched event.
+func (p *poaContract) parseValidatorChange(log *ethTypes.Log) (*ValidatorChange, error) {
+	if log.Address != p.address || len(log.Topics) == 0 {
+		return nil, nil
+	}
+
+	event, ok := p.events[log.Topics[0]]
+	if !ok {
+		return nil, nil
+	}
+
+	addr, err := eventAddress(event, log)
+	if err != nil {
+		return nil, err
+	}
+
+	return &ValidatorChange{
+		Type:    poaEvents[event.Name],
+		Address: addr,
+		Event:   event.Name,
+		TxHash:  log.TxHash,
+	}, nil
 }
 
-func setPOAADDR(address string) {
-	POAADDR = eth_common.HexToAddress(address)
+// eventAddress returns the first address argument of an event, looking in the
+// topics for indexed arguments, and in the data for the others.
+func eventAddress(event abi.Event, log *ethTypes.Log) (eth_common.Address, error) {
+	var values []interface{}
+	topic, nonIndexed := 1, 0
+
+	for _, input := range event.Inputs {
+		if input.Indexed {
+			if input.Type.T == abi.AddressTy {
+				if topic >= len(log.Topics) {
+					return eth_common.Address{}, fmt.Errorf("Missing topic %d in %s event", topic, event.Name)
+				}
+				return eth_common.BytesToAddress(log.Topics[topic].Bytes()), nil
+			}
+			topic++
+			continue
+		}
+
+		if input.Type.T == abi.AddressTy {
+			if values == nil {
+				var err error
+				values, err = event.Inputs.NonIndexed().UnpackValues(log.Data)
+				if err != nil {
+					return eth_common.Address{}, err
+				}
+			}
+			if addr, ok := values[nonIndexed].(eth_common.Address); ok {
+				return addr, nil
+			}
+		}
+		nonIndexed++
+	}
+
+	return eth_common.Address{}, fmt.Errorf("No address argument in %s event", event.Name)
 }
@@ -0,0 +1,365 @@
+package state
+
+import (
+	"bytes"
+	"fmt"
+	"math/big"
+	"sync"
+	"time"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/common/math"
+	"github.com/ethereum/go-ethereum/core/vm"
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/ethereum/go-ethereum/params"
+	"github.com/sirupsen/logrus"
+)
+
+/*
+Precompiles are native contracts implemented in Go, for functionality which
+would be too expensive in Solidity. Embedders register them by name with
+RegisterPrecompile, and each State enables them at addresses with
+EnablePrecompile, or from the precompiles section of the genesis file, which
+maps addresses to names.
+
+go-ethereum only looks precompiles up in process-wide tables, which are never
+modified here. Instead, every EVM created by a State with enabled precompiles
+runs on a StateDB which gives a small stub contract to their addresses, and
+with a tracer which executes the precompile when the stub starts, and passes
+the result to the stub in memory. The stub returns the result, or fails like a
+precompile, consuming all the gas of the call. The precompiles of a State are
+therefore independent of the other States of the process, and apply to the
+transactions as well as the calls.
+
+Precompiles must be enabled before transactions are applied, and in the same
+way on every node, or the nodes would compute different states.
+*/
+
+// PrecompileState is the read-only view of the state given to a precompile.
+// It reflects the changes made by the transaction so far.
+type PrecompileState interface {
+	Exist(addr common.Address) bool
+	GetBalance(addr common.Address) *big.Int
+	GetNonce(addr common.Address) uint64
+	GetCode(addr common.Address) []byte
+	GetState(addr common.Address, key common.Hash) common.Hash
+}
+
+// Precompile is a native contract. Gas returns the gas cost of a call with the
+// given input, and Run executes it. An error consumes all the gas of the call,
+// and reverts it.
+type Precompile struct {
+	Name string
+	Gas  func(input []byte) uint64
+	Run  func(state PrecompileState, input []byte) ([]byte, error)
+}
+
+// _precompileStub is the code of the address of an enabled precompile:
+//
+//	PUSH1 0x00 MLOAD DUP1 PUSH1 0x00 NOT EQ PUSH1 0x0e JUMPI
+//	PUSH1 0x20 RETURN
+//	JUMPDEST INVALID
+//
+// The first word of memory is the size of the result, which follows it, or
+// the maximum word if the precompile failed.
+var (
+	_precompileStub     = common.Hex2Bytes("6000518060001914600e576020f35bfe")
+	_precompileStubHash = crypto.Keccak256Hash(_precompileStub)
+	_precompileFailed   = math.PaddedBigBytes(math.MaxBig256, 32)
+)
+
+// _registeredPrecompiles are the precompiles available to the States, by name
+var _registeredPrecompiles = struct {
+	sync.Mutex
+	byName map[string]*Precompile
+}{
+	byName: make(map[string]*Precompile),
+}
+
+// RegisterPrecompile makes a precompile available under its name
+func RegisterPrecompile(p Precompile) error {
+	if p.Name == "" || p.Gas == nil || p.Run == nil {
+		return fmt.Errorf("Precompile must have a name, and Gas and Run functions")
+	}
+
+	_registeredPrecompiles.Lock()
+	defer _registeredPrecompiles.Unlock()
+
+	if _, ok := _registeredPrecompiles.byName[p.Name]; ok {
+		return fmt.Errorf("Precompile %s is already registered", p.Name)
+	}
+
+	_registeredPrecompiles.byName[p.Name] = &p
+
+	return nil
+}
+
+// registeredPrecompile returns the precompile registered under a name
+func registeredPrecompile(name string) (*Precompile, error) {
+	_registeredPrecompiles.Lock()
+	defer _registeredPrecompiles.Unlock()
+
+	p, ok := _registeredPrecompiles.byName[name]
+	if !ok {
+		return nil, fmt.Errorf("Unknown precompile %s", name)
+	}
+
+	return p, nil
+}
+
+// precompileSet maps addresses to the precompiles enabled at them. A set is
+// never modified once it is in use by a BaseState; it is replaced instead.
+type precompileSet map[common.Address]*Precompile
+
+// with returns a copy of the set, with p at addr, or without addr if p is nil
+func (ps precompileSet) with(addr common.Address, p *Precompile) precompileSet {
+	set := make(precompileSet, len(ps)+1)
+	for a, q := range ps {
+		set[a] = q
+	}
+
+	if p == nil {
+		delete(set, addr)
+	} else {
+		set[addr] = p
+	}
+
+	return set
+}
+
+// newEVM returns an EVM running on stateDB with the given precompiles and
+// tracers. The precompile tracer runs first, so that the other tracers see the
+// result of the precompiles.
+func newEVM(context vm.Context,
+	stateDB vm.StateDB,
+	chainConfig *params.ChainConfig,
+	vmConfig vm.Config,
+	precompiles precompileSet,
+	tracers ...vm.Tracer) *vm.EVM {
+
+	if len(precompiles) > 0 {
+		stateDB = &precompileStateDB{StateDB: stateDB, precompiles: precompiles}
+		tracers = append([]vm.Tracer{&precompileTracer{precompiles: precompiles}}, tracers...)
+	}
+
+	return vm.NewEVM(context, stateDB, chainConfig, withTracers(vmConfig, tracers...))
+}
+
+// precompileStateDB gives the stub contract to the addresses of the enabled
+// precompiles
+type precompileStateDB struct {
+	vm.StateDB
+	precompiles precompileSet
+}
+
+// Exist implements vm.StateDB
+func (db *precompileStateDB) Exist(addr common.Address) bool {
+	if _, ok := db.precompiles[addr]; ok {
+		return true
+	}
+	return db.StateDB.Exist(addr)
+}
+
+// Empty implements vm.StateDB
+func (db *precompileStateDB) Empty(addr common.Address) bool {
+	if _, ok := db.precompiles[addr]; ok {
+		return false
+	}
+	return db.StateDB.Empty(addr)
+}
+
+// GetCode implements vm.StateDB
+func (db *precompileStateDB) GetCode(addr common.Address) []byte {
+	if _, ok := db.precompiles[addr]; ok {
+		return _precompileStub
+	}
+	return db.StateDB.GetCode(addr)
+}
+
+// GetCodeSize implements vm.StateDB
+func (db *precompileStateDB) GetCodeSize(addr common.Address) int {
+	if _, ok := db.precompiles[addr]; ok {
+		return len(_precompileStub)
+	}
+	return db.StateDB.GetCodeSize(addr)
+}
+
+// GetCodeHash implements vm.StateDB
+func (db *precompileStateDB) GetCodeHash(addr common.Address) common.Hash {
+	if _, ok := db.precompiles[addr]; ok {
+		return _precompileStubHash
+	}
+	return db.StateDB.GetCodeHash(addr)
+}
+
+// readOnlyState restricts a vm.StateDB to PrecompileState
+type readOnlyState struct {
+	db vm.StateDB
+}
+
+func (s readOnlyState) Exist(addr common.Address) bool          { return s.db.Exist(addr) }
+func (s readOnlyState) GetBalance(addr common.Address) *big.Int { return s.db.GetBalance(addr) }
+func (s readOnlyState) GetNonce(addr common.Address) uint64     { return s.db.GetNonce(addr) }
+func (s readOnlyState) GetCode(addr common.Address) []byte      { return s.db.GetCode(addr) }
+
+func (s readOnlyState) GetState(addr common.Address, key common.Hash) common.Hash {
+	return s.db.GetState(addr, key)
+}
+
+// precompileTracer executes a precompile when its stub starts, and writes the
+// result to the memory of the stub
+type precompileTracer struct {
+	precompiles precompileSet
+}
+
+// CaptureStart implements vm.Tracer
+func (t *precompileTracer) CaptureStart(from common.Address, to common.Address, create bool, input []byte, gas uint64, value *big.Int) error {
+	return nil
+}
+
+// CaptureState implements vm.Tracer. It is called before the first operation
+// of the stub, whose gas is already paid.
+func (t *precompileTracer) CaptureState(env *vm.EVM, pc uint64, op vm.OpCode, gas, cost uint64, memory *vm.Memory, stack *vm.Stack, contract *vm.Contract, depth int, err error) error {
+	if pc != 0 || contract.CodeAddr == nil {
+		return nil
+	}
+
+	p, ok := t.precompiles[*contract.CodeAddr]
+	if !ok || !bytes.Equal(contract.Code, _precompileStub) {
+		return nil
+	}
+
+	output, runErr := runPrecompile(p, readOnlyState{env.StateDB}, contract)
+
+	status := _precompileFailed
+	if runErr == nil {
+		status = math.PaddedBigBytes(new(big.Int).SetUint64(uint64(len(output))), 32)
+	} else {
+		output = nil
+	}
+
+	// The memory is resized to whole words, so that the stub does not pay for
+	// its expansion
+	size := 32 + uint64(len(output))
+	memory.Resize((size + 31) / 32 * 32)
+	memory.Set(0, 32, status)
+	memory.Set(32, uint64(len(output)), output)
+
+	return nil
+}
+
+// CaptureFault implements vm.Tracer
+func (t *precompileTracer) CaptureFault(env *vm.EVM, pc uint64, op vm.OpCode, gas, cost uint64, memory *vm.Memory, stack *vm.Stack, contract *vm.Contract, depth int, err error) error {
+	return nil
+}
+
+// CaptureEnd implements vm.Tracer
+func (t *precompileTracer) CaptureEnd(output []byte, gasUsed uint64, d time.Duration, err error) error {
+	return nil
+}
+
+// runPrecompile charges the gas of a precompile to the contract, and runs it
+func runPrecompile(p *Precompile, state PrecompileState, contract *vm.Contract) ([]byte, error) {
+	if !contract.UseGas(p.Gas(contract.Input)) {
+		return nil, vm.ErrOutOfGas
+	}
+	return p.Run(state, contract.Input)
+}
+
+// EnablePrecompile enables a registered precompile at an address, in the EVMs
+// created by this State. Enabling the same precompile at the same address again
+// has no effect.
+func (s *State) EnablePrecompile(addr common.Address, name string) error {
+	s.precompileLock.Lock()
+	defer s.precompileLock.Unlock()
+
+	p, err := registeredPrecompile(name)
+	if err != nil {
+		return err
+	}
+
+	if enabled, ok := s.precompiles[addr]; ok {
+		if enabled == p {
+			return nil
+		}
+		return fmt.Errorf("Precompile %s is already enabled at %s", enabled.Name, addr.Hex())
+	}
+
+	if _, ok := vm.PrecompiledContractsByzantium[addr]; ok {
+		return fmt.Errorf("Address %s is used by a standard precompile", addr.Hex())
+	}
+
+	s.setPrecompiles(s.precompiles.with(addr, p))
+
+	return nil
+}
+
+// DisablePrecompile disables the precompile enabled at an address. The address
+// becomes a regular account again.
+func (s *State) DisablePrecompile(addr common.Address) error {
+	s.precompileLock.Lock()
+	defer s.precompileLock.Unlock()
+
+	if _, ok := s.precompiles[addr]; !ok {
+		return fmt.Errorf("No precompile enabled at %s", addr.Hex())
+	}
+
+	s.setPrecompiles(s.precompiles.with(addr, nil))
+
+	return nil
+}
+
+// Precompiles returns the names of the precompiles enabled in this State, by
+// address
+func (s *State) Precompiles() map[common.Address]string {
+	s.precompileLock.Lock()
+	defer s.precompileLock.Unlock()
+
+	enabled := make(map[common.Address]string, len(s.precompiles))
+	for addr, p := range s.precompiles {
+		enabled[addr] = p.Name
+	}
+
+	return enabled
+}
+
+// setPrecompiles installs a set of precompiles in the main state, the WAS, the
+// TxPool, and the reader. The caller must hold precompileLock.
+func (s *State) setPrecompiles(precompiles precompileSet) {
+	s.precompiles = precompiles
+
+	s.main.setPrecompiles(precompiles)
+	s.was.setPrecompiles(precompiles)
+	s.txPool.setPrecompiles(precompiles)
+
+	s.reader.Store(newReadState(&s.main, s.main.GetRoot()))
+}
+
+// setPrecompiles replaces the precompiles of the EVMs created by the BaseState
+func (bs *BaseState) setPrecompiles(precompiles precompileSet) {
+	bs.Lock()
+	defer bs.Unlock()
+
+	bs.precompiles = precompiles
+}
+
+// loadPrecompiles enables the precompiles of the genesis file
+func (s *State) loadPrecompiles(precompiles map[string]string) error {
+	for addr, name := range precompiles {
+		if !common.IsHexAddress(addr) {
+			return fmt.Errorf("Invalid precompile address %s", addr)
+		}
+
+		if err := s.EnablePrecompile(common.HexToAddress(addr), name); err != nil {
+			s.logger.WithError(err).Error("Enabling precompile")
+			return err
+		}
+
+		s.logger.WithFields(logrus.Fields{
+			"address": addr,
+			"name":    name,
+		}).Debug("Enabled precompile")
+	}
+
+	return nil
+}
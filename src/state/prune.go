@@ -0,0 +1,210 @@
+package state
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/ethdb"
+	"github.com/sirupsen/logrus"
+)
+
+/*
+Every Commit writes the new trie nodes to disk, and nothing is ever deleted, so
+the database grows with every commit even though only recent states are
+queried. Prune garbage-collects the trie nodes and contract code which are not
+reachable from the roots that must be kept: the roots of the last commits, and
+the roots which were explicitly pinned, like checkpoints.
+
+Pruning is a mark-and-sweep over the whole database. It must not run while the
+State is applying transactions, so it is meant to be used by offline tools on
+the database of a stopped node. The records of pruned commits are kept, but
+the State can no longer be rolled back to them.
+*/
+
+// PruneOptions configures Prune
+type PruneOptions struct {
+	// Keep is the number of most recent commits whose state is kept. The last
+	// commit is always kept.
+	Keep uint64
+
+	// Pinned are roots kept in addition to the roots pinned in the database
+	Pinned []common.Hash
+
+	// DryRun only counts the nodes which would be deleted
+	DryRun bool
+}
+
+// PruneResult describes the outcome of Prune
+type PruneResult struct {
+	Roots   []common.Hash
+	Live    uint64
+	Deleted uint64
+	Size    uint64
+	Elapsed time.Duration
+}
+
+// PinRoot records a root which is never pruned
+func (s *State) PinRoot(root common.Hash) error {
+	return s.db.Put(pinnedKey(root), []byte{})
+}
+
+// UnpinRoot removes a root recorded by PinRoot
+func (s *State) UnpinRoot(root common.Hash) error {
+	return s.db.Delete(pinnedKey(root))
+}
+
+// GetPinnedRoots returns the roots recorded by PinRoot
+func (s *State) GetPinnedRoots() ([]common.Hash, error) {
+	it := s.db.NewIteratorWithPrefix(_pinnedPrefix)
+	defer it.Release()
+
+	roots := []common.Hash{}
+	for it.Next() {
+		roots = append(roots, common.BytesToHash(it.Key()[len(_pinnedPrefix):]))
+	}
+
+	return roots, it.Error()
+}
+
+// Prune deletes the trie nodes and contract code which are not reachable from
+// the state of the last opts.Keep commits or from a pinned root.
+func (s *State) Prune(opts PruneOptions) (*PruneResult, error) {
+	start := time.Now()
+	db := s.db
+
+	roots, err := s.pruneRoots(opts)
+	if err != nil {
+		return nil, err
+	}
+
+	result := &PruneResult{Roots: roots}
+
+	// Mark every node and code reachable from the kept roots
+	live := make(map[common.Hash]struct{})
+	mark := func(kind uint8, key []byte, value []byte) error {
+		if kind == snapshotNode || kind == snapshotCode {
+			live[common.BytesToHash(key)] = struct{}{}
+		}
+		return nil
+	}
+
+	for _, root := range roots {
+		if err := iterateState(db, root, mark); err != nil {
+			return nil, fmt.Errorf("Marking state %s: %v", root.Hex(), err)
+		}
+	}
+	result.Live = uint64(len(live))
+
+	// Sweep the unreachable nodes and code. Preimages are kept.
+	batch := db.NewBatch()
+
+	it := db.NewIteratorWithPrefix(_triePrefix)
+	defer it.Release()
+
+	for it.Next() {
+		key := it.Key()
+		if len(key) != len(_triePrefix)+common.HashLength {
+			continue
+		}
+
+		hash := common.BytesToHash(key[len(_triePrefix):])
+		if _, ok := live[hash]; ok {
+			continue
+		}
+
+		result.Deleted++
+		result.Size += uint64(len(key) + len(it.Value()))
+
+		if opts.DryRun {
+			continue
+		}
+
+		if err := batch.Delete(common.CopyBytes(key)); err != nil {
+			return nil, err
+		}
+
+		if batch.ValueSize() >= ethdb.IdealBatchSize {
+			if err := batch.Write(); err != nil {
+				return nil, err
+			}
+			batch.Reset()
+		}
+	}
+
+	if err := it.Error(); err != nil {
+		return nil, err
+	}
+
+	if !opts.DryRun {
+		if err := batch.Write(); err != nil {
+			return nil, err
+		}
+
+		// Reclaim the disk space
+		if err := db.Compact(); err != nil {
+			return nil, err
+		}
+	}
+
+	result.Elapsed = time.Since(start)
+
+	s.logger.WithFields(logrus.Fields{
+		"roots":   len(result.Roots),
+		"live":    result.Live,
+		"deleted": result.Deleted,
+		"size":    result.Size,
+		"dry_run": opts.DryRun,
+		"elapsed": result.Elapsed,
+	}).Info("Prune")
+
+	return result, nil
+}
+
+// pruneRoots returns the roots which must be kept by Prune
+func (s *State) pruneRoots(opts PruneOptions) ([]common.Hash, error) {
+	head, ok := s.GetCommitNumber()
+	if !ok {
+		return nil, fmt.Errorf("No commits")
+	}
+
+	keep := opts.Keep
+	if keep == 0 {
+		keep = 1
+	}
+
+	pinned, err := s.GetPinnedRoots()
+	if err != nil {
+		return nil, err
+	}
+
+	seen := make(map[common.Hash]bool)
+	roots := []common.Hash{}
+
+	add := func(root common.Hash) {
+		if !seen[root] {
+			seen[root] = true
+			roots = append(roots, root)
+		}
+	}
+
+	add(s.GetRoot())
+
+	for n := head; n+keep > head; n-- {
+		record, err := ReadCommit(s.db, n)
+		if err != nil {
+			return nil, err
+		}
+		add(record.Root)
+
+		if n == 0 {
+			break
+		}
+	}
+
+	for _, root := range append(pinned, opts.Pinned...) {
+		add(root)
+	}
+
+	return roots, nil
+}
@@ -0,0 +1,118 @@
+package state
+
+import (
+	"math/big"
+	"sync/atomic"
+	"time"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core"
+	ethState "github.com/ethereum/go-ethereum/core/state"
+	ethTypes "github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/core/vm"
+	"github.com/ethereum/go-ethereum/params"
+)
+
+// readState is an immutable view of the state at a committed root. It serves
+// the read-only queries of the Service without any lock: every query opens its
+// own StateDB on the shared trie database, which is safe for concurrent use.
+// The State replaces its readState atomically after every Commit, so queries
+// never wait for transactions to be applied or committed.
+type readState struct {
+	root        common.Hash
+	db          ethState.Database
+	chainConfig params.ChainConfig
+	vmConfig    vm.Config
+	gasLimit    uint64
+	precompiles precompileSet
+}
+
+// newReadState returns a readState at the root of a BaseState, sharing its trie
+// database.
+func newReadState(bs *BaseState, root common.Hash) *readState {
+	return &readState{
+		root:        root,
+		db:          bs.stateDB.Database(),
+		chainConfig: bs.chainConfig,
+		vmConfig:    bs.vmConfig,
+		gasLimit:    bs.gasLimit,
+		precompiles: bs.precompiles,
+	}
+}
+
+// stateDB returns a new StateDB at the readState's root. If the root cannot be
+// opened, which would mean that the database is corrupted, an empty StateDB is
+// returned, like for BaseState.
+func (rs *readState) stateDB() *ethState.StateDB {
+	stateDB, err := ethState.New(rs.root, rs.db)
+	if err != nil {
+		stateDB, _ = ethState.New(common.Hash{}, rs.db)
+	}
+	return stateDB
+}
+
+// GetBalance returns an account's balance
+func (rs *readState) GetBalance(addr common.Address) *big.Int {
+	return rs.stateDB().GetBalance(addr)
+}
+
+// GetNonce returns an account's nonce
+func (rs *readState) GetNonce(addr common.Address) uint64 {
+	return rs.stateDB().GetNonce(addr)
+}
+
+// GetCode returns an account's bytecode
+func (rs *readState) GetCode(addr common.Address) []byte {
+	return rs.stateDB().GetCode(addr)
+}
+
+// GetStorage returns an account's storage
+func (rs *readState) GetStorage(addr common.Address) map[string]string {
+	storage := make(map[string]string)
+
+	rs.stateDB().ForEachStorage(addr, func(key, value common.Hash) bool {
+		storage[common.Bytes2Hex(key.Bytes())] = common.Bytes2Hex(value.Bytes())
+		return true
+	})
+
+	return storage
+}
+
+// Call executes a readonly transaction, traced if tracer is not nil. The
+// changes it makes are discarded with its StateDB. If timeout is not 0, the
+// execution is cancelled after it, and ErrCallTimeout is returned.
+func (rs *readState) Call(callMsg ethTypes.Message, tracer vm.Tracer, timeout time.Duration) ([]byte, error) {
+	res, _, err := rs.apply(callMsg, tracer, timeout)
+	return res, err
+}
+
+// apply executes a readonly transaction like Call, and also reports whether
+// the EVM failed, ie. reverted or ran out of gas
+func (rs *readState) apply(callMsg ethTypes.Message, tracer vm.Tracer, timeout time.Duration) ([]byte, bool, error) {
+	context := NewContext(callMsg.From(), common.Address{}, 0, big.NewInt(0))
+
+	var tracers []vm.Tracer
+	if tracer != nil {
+		tracers = append(tracers, tracer)
+	}
+
+	vmenv := newEVM(context, rs.stateDB(), &rs.chainConfig, rs.vmConfig, rs.precompiles, tracers...)
+
+	var timedOut int32
+	if timeout > 0 {
+		timer := time.AfterFunc(timeout, func() {
+			atomic.StoreInt32(&timedOut, 1)
+			vmenv.Cancel()
+		})
+		defer timer.Stop()
+	}
+
+	res, _, failed, err := core.ApplyMessage(vmenv, callMsg, new(core.GasPool).AddGas(rs.gasLimit))
+
+	// A cancelled EVM stops without an error
+	if atomic.LoadInt32(&timedOut) == 1 {
+		return nil, false, ErrCallTimeout
+	}
+
+	return res, failed, err
+}
@@ -0,0 +1,286 @@
+package state
+
+import (
+	"encoding/binary"
+	"fmt"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/ethdb"
+	"github.com/sirupsen/logrus"
+
+	"github.com/mosaicnetworks/evm-lite/src/database"
+)
+
+/*
+Database schema
+
+Every record is stored under an explicit prefix:
+
+	evml-schema-version              schema version (8 bytes, big endian)
+	evml-head-root                   root of the last commit
+	evml-head-commit                 number of the last commit (8 bytes)
+	evml-commit-    + number         CommitRecord (RLP), number on 8 bytes
+	evml-tx-        + tx hash        transaction (RLP)
+	evml-receipt-   + tx hash        ReceiptForStorage (RLP)
+	evml-statediff- + tx hash        StateDiff (JSON), if recorded
+	evml-internal-  + tx hash        []InternalTx (JSON), if recorded
+	evml-addrindex- + address + commit number + tx hash
+	                                 empty, indexes the internal transactions
+	evml-pinned-    + root           root which is never pruned
+	evml-trie-      + hash           trie node or contract code
+	evml-trie-secure-key- + hash     preimage of a secure trie key
+	evml-restore-   + key            record of a snapshot being restored
+
+The trie records are written by go-ethereum's trie database, which is given a
+table with the evml-trie- prefix.
+
+The version of the schema is stored in the database. Databases created before
+the schema was versioned are version 0. When a database is opened, the
+migrations from its version to SchemaVersion are applied in order.
+*/
+
+// SchemaVersion is the version of the database schema used by this package
+const SchemaVersion = 1
+
+var (
+	_schemaVersionKey = []byte("evml-schema-version")
+
+	// _headRootKey is the key under which the last committed root is stored
+	_headRootKey = []byte("evml-head-root")
+
+	// _headCommitKey is the key under which the last commit number is stored
+	_headCommitKey = []byte("evml-head-commit")
+
+	_commitPrefix       = []byte("evml-commit-")
+	_commitMetaPrefix   = []byte("evml-commitmeta-")
+	_txPrefix           = []byte("evml-tx-")
+	_receiptPrefix      = []byte("evml-receipt-")
+	_stateDiffPrefix    = []byte("evml-statediff-")
+	_internalPrefix     = []byte("evml-internal-")
+	_addressIndexPrefix = []byte("evml-addrindex-")
+	_pinnedPrefix       = []byte("evml-pinned-")
+	_triePrefix         = []byte("evml-trie-")
+	_restorePrefix      = []byte("evml-restore-")
+
+	// _preimagePrefix is the prefix under which go-ethereum's trie database
+	// stores the preimages of secure trie keys, within the trie table.
+	_preimagePrefix = []byte("secure-key-")
+)
+
+func prefixedKey(prefix []byte, key []byte) []byte {
+	return append(common.CopyBytes(prefix), key...)
+}
+
+func commitKey(number uint64) []byte {
+	key := make([]byte, len(_commitPrefix)+8)
+	copy(key, _commitPrefix)
+	binary.BigEndian.PutUint64(key[len(_commitPrefix):], number)
+	return key
+}
+
+func commitMetaKey(number uint64) []byte {
+	key := make([]byte, len(_commitMetaPrefix)+8)
+	copy(key, _commitMetaPrefix)
+	binary.BigEndian.PutUint64(key[len(_commitMetaPrefix):], number)
+	return key
+}
+
+func txKey(hash common.Hash) []byte {
+	return prefixedKey(_txPrefix, hash.Bytes())
+}
+
+func receiptKey(hash common.Hash) []byte {
+	return prefixedKey(_receiptPrefix, hash.Bytes())
+}
+
+func stateDiffKey(hash common.Hash) []byte {
+	return prefixedKey(_stateDiffPrefix, hash.Bytes())
+}
+
+func internalTxsKey(hash common.Hash) []byte {
+	return prefixedKey(_internalPrefix, hash.Bytes())
+}
+
+func pinnedKey(root common.Hash) []byte {
+	return prefixedKey(_pinnedPrefix, root.Bytes())
+}
+
+// trieTable returns the view of the database used by the trie database
+func trieTable(db ethdb.Database) ethdb.Database {
+	return ethdb.NewTable(db, string(_triePrefix))
+}
+
+/*******************************************************************************
+Versioning
+*******************************************************************************/
+
+// ReadSchemaVersion returns the schema version of a database. Databases which
+// do not record a version are version 0, unless they are empty.
+func ReadSchemaVersion(db database.Database) (uint64, error) {
+	has, err := db.Has(_schemaVersionKey)
+	if err != nil {
+		return 0, err
+	}
+
+	if has {
+		data, err := db.Get(_schemaVersionKey)
+		if err != nil {
+			return 0, err
+		}
+		return binary.BigEndian.Uint64(data), nil
+	}
+
+	it := db.NewIteratorWithPrefix(nil)
+	defer it.Release()
+
+	if !it.Next() {
+		return SchemaVersion, it.Error()
+	}
+
+	return 0, nil
+}
+
+func writeSchemaVersion(putter ethdb.Putter, version uint64) error {
+	data := make([]byte, 8)
+	binary.BigEndian.PutUint64(data, version)
+	return putter.Put(_schemaVersionKey, data)
+}
+
+/*******************************************************************************
+Migrations
+*******************************************************************************/
+
+// migration upgrades a database from version-1 to version
+type migration struct {
+	version     uint64
+	description string
+	run         func(db database.Database) error
+}
+
+var _migrations = []migration{
+	{
+		version:     1,
+		description: "Move every record under an explicit prefix",
+		run:         migrateNamespaces,
+	},
+}
+
+// Migrate applies the migrations from the version of the database to
+// SchemaVersion. It returns the versions before and after the migrations.
+func Migrate(db database.Database, logger *logrus.Entry) (from uint64, to uint64, err error) {
+	from, err = ReadSchemaVersion(db)
+	if err != nil {
+		return from, from, err
+	}
+
+	if from > SchemaVersion {
+		return from, from, fmt.Errorf("Database schema version %d is newer than supported version %d", from, SchemaVersion)
+	}
+
+	to = from
+	for _, m := range _migrations {
+		if m.version <= to {
+			continue
+		}
+
+		logger.WithFields(logrus.Fields{
+			"version":     m.version,
+			"description": m.description,
+		}).Info("Migrating database")
+
+		if err := m.run(db); err != nil {
+			return from, to, fmt.Errorf("Migrating database to version %d: %v", m.version, err)
+		}
+
+		if err := writeSchemaVersion(db, m.version); err != nil {
+			return from, to, err
+		}
+
+		to = m.version
+	}
+
+	// Record the version of new databases
+	if err := writeSchemaVersion(db, to); err != nil {
+		return from, to, err
+	}
+
+	return from, to, nil
+}
+
+// migrateNamespaces moves the records of the version 0 layout, in which
+// transactions were stored under their bare hash, in the same keyspace as trie
+// nodes, to the prefixes of version 1. It can be interrupted and run again.
+func migrateNamespaces(db database.Database) error {
+	legacyPrefixes := map[string][]byte{
+		"receipts-":   _receiptPrefix,
+		"commit-":     _commitPrefix,
+		"pinned-":     _pinnedPrefix,
+		"secure-key-": prefixedKey(_triePrefix, _preimagePrefix),
+	}
+
+	// Bare hashes are transactions if they have a receipt, and trie nodes or
+	// code otherwise.
+	txs := make(map[common.Hash]struct{})
+	for _, prefix := range [][]byte{[]byte("receipts-"), _receiptPrefix} {
+		it := db.NewIteratorWithPrefix(prefix)
+		for it.Next() {
+			txs[common.BytesToHash(it.Key()[len(prefix):])] = struct{}{}
+		}
+		it.Release()
+		if err := it.Error(); err != nil {
+			return err
+		}
+	}
+
+	batch := db.NewBatch()
+
+	move := func(oldKey []byte, newKey []byte, value []byte) error {
+		if err := batch.Put(newKey, common.CopyBytes(value)); err != nil {
+			return err
+		}
+		if err := batch.Delete(common.CopyBytes(oldKey)); err != nil {
+			return err
+		}
+		if batch.ValueSize() >= ethdb.IdealBatchSize {
+			if err := batch.Write(); err != nil {
+				return err
+			}
+			batch.Reset()
+		}
+		return nil
+	}
+
+	it := db.NewIteratorWithPrefix(nil)
+	defer it.Release()
+
+	for it.Next() {
+		key := it.Key()
+
+		if len(key) == common.HashLength {
+			hash := common.BytesToHash(key)
+			newKey := prefixedKey(_triePrefix, key)
+			if _, ok := txs[hash]; ok {
+				newKey = txKey(hash)
+			}
+			if err := move(key, newKey, it.Value()); err != nil {
+				return err
+			}
+			continue
+		}
+
+		for legacy, prefix := range legacyPrefixes {
+			if len(key) > len(legacy) && string(key[:len(legacy)]) == legacy {
+				if err := move(key, prefixedKey(prefix, key[len(legacy):]), it.Value()); err != nil {
+					return err
+				}
+				break
+			}
+		}
+	}
+
+	if err := it.Error(); err != nil {
+		return err
+	}
+
+	return batch.Write()
+}
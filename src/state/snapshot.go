@@ -0,0 +1,435 @@
+package state
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+
+	"github.com/ethereum/go-ethereum/common"
+	ethState "github.com/ethereum/go-ethereum/core/state"
+	ethTypes "github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/ethereum/go-ethereum/ethdb"
+	"github.com/ethereum/go-ethereum/rlp"
+	"github.com/sirupsen/logrus"
+
+	"github.com/mosaicnetworks/evm-lite/src/database"
+)
+
+/*
+A snapshot is a self-contained archive of the state at a given root, which can
+be used by a consensus system to bring a new node up to date without replaying
+every transaction. It is an RLP stream composed of a SnapshotHeader, followed by
+any number of snapshotRecords, and terminated by a record of kind snapshotEnd
+which contains the number of preceding records.
+
+Trie nodes, contract code, preimages, and transactions are content-addressed,
+so their integrity is verified record by record upon restore, and a receipt is
+only accepted after its transaction. The size of every record is bounded. The
+records are restored under a staging prefix, and the completeness of the state
+is verified by traversing the whole trie from the root in the header, before
+they are moved in place. A snapshot which fails verification leaves nothing
+behind.
+*/
+
+// SnapshotVersion is the version of the snapshot format produced by this
+// package. It is increased whenever the format changes.
+const SnapshotVersion = 1
+
+// maxSnapshotRecordSize is the maximum encoded size of the header or of a
+// record of a snapshot. It is much larger than any legitimate record, and
+// prevents a corrupt snapshot from making Restore allocate unbounded memory.
+const maxSnapshotRecordSize = 16 * 1024 * 1024
+
+var (
+	_snapshotMagic = []byte("evml-snapshot")
+
+	_emptyRoot     = common.HexToHash("56e81f171bcc55a6ff8345e692c0f86e5b48e01b996cadc001622fb5e363b421")
+	_emptyCodeHash = crypto.Keccak256(nil)
+)
+
+// Kinds of snapshot records
+const (
+	snapshotNode uint8 = iota
+	snapshotCode
+	snapshotPreimage
+	snapshotTransaction
+	snapshotReceipt
+	snapshotEnd
+)
+
+// SnapshotHeader is the first item of a snapshot
+type SnapshotHeader struct {
+	Magic   []byte
+	Version uint64
+	Root    common.Hash
+	Commit  uint64
+}
+
+// snapshotRecord is a key-value pair of the database
+type snapshotRecord struct {
+	Kind  uint8
+	Key   []byte
+	Value []byte
+}
+
+// stateVisitor is called for every trie node, contract code, and preimage
+// reachable from a state root.
+type stateVisitor func(kind uint8, key []byte, value []byte) error
+
+// Snapshot writes a snapshot of the last committed state, including the
+// transactions and receipts, to w. It returns the root of the snapshot.
+func (s *State) Snapshot(w io.Writer) (common.Hash, error) {
+	root := s.GetRoot()
+	db := s.db
+	commit, _ := s.GetCommitNumber()
+
+	header := SnapshotHeader{
+		Magic:   _snapshotMagic,
+		Version: SnapshotVersion,
+		Root:    root,
+		Commit:  commit,
+	}
+
+	if err := rlp.Encode(w, header); err != nil {
+		return root, err
+	}
+
+	count := uint64(0)
+
+	write := func(kind uint8, key []byte, value []byte) error {
+		count++
+		return rlp.Encode(w, snapshotRecord{Kind: kind, Key: key, Value: value})
+	}
+
+	if err := iterateState(db, root, write); err != nil {
+		s.logger.WithError(err).Error("Snapshotting state")
+		return root, err
+	}
+
+	it := db.NewIteratorWithPrefix(_receiptPrefix)
+	defer it.Release()
+
+	for it.Next() {
+		txHash := it.Key()[len(_receiptPrefix):]
+
+		tx, err := db.Get(txKey(common.BytesToHash(txHash)))
+		if err != nil {
+			return root, fmt.Errorf("Reading transaction %x: %v", txHash, err)
+		}
+
+		if err := write(snapshotTransaction, txHash, tx); err != nil {
+			return root, err
+		}
+
+		if err := write(snapshotReceipt, txHash, it.Value()); err != nil {
+			return root, err
+		}
+	}
+
+	if err := it.Error(); err != nil {
+		return root, err
+	}
+
+	end := make([]byte, 8)
+	binary.BigEndian.PutUint64(end, count)
+
+	if err := rlp.Encode(w, snapshotRecord{Kind: snapshotEnd, Key: end}); err != nil {
+		return root, err
+	}
+
+	s.logger.WithFields(logrus.Fields{
+		"root":    root.Hex(),
+		"records": count,
+	}).Info("Snapshot")
+
+	return root, nil
+}
+
+// Restore imports a snapshot produced by Snapshot into the database, verifies
+// that the state is complete, and resets the main state, the WAS, and the
+// TxPool to the snapshot's root. Nothing is imported if the verification fails. It must not be called while the consensus
+// system is applying transactions.
+func (s *State) Restore(r io.Reader) (common.Hash, error) {
+	// Every item is decoded with its own input limit. The input is buffered
+	// here rather than by the stream, so that nothing is lost when the stream
+	// is reset.
+	br := bufio.NewReader(r)
+	stream := rlp.NewStream(br, maxSnapshotRecordSize)
+
+	var header SnapshotHeader
+	if err := stream.Decode(&header); err != nil {
+		return common.Hash{}, fmt.Errorf("Reading snapshot header: %v", err)
+	}
+
+	if !bytes.Equal(header.Magic, _snapshotMagic) {
+		return common.Hash{}, fmt.Errorf("Not a snapshot")
+	}
+
+	if header.Version != SnapshotVersion {
+		return common.Hash{}, fmt.Errorf("Unsupported snapshot version %d", header.Version)
+	}
+
+	db := s.db
+
+	// Remove what an interrupted restore may have left
+	if err := drainStaging(db, false); err != nil {
+		return common.Hash{}, err
+	}
+
+	root := header.Root
+
+	count, err := stageSnapshot(db, stream, br, root)
+	if err != nil {
+		if clearErr := drainStaging(db, false); clearErr != nil {
+			s.logger.WithError(clearErr).Error("Clearing restore staging area")
+		}
+		return common.Hash{}, err
+	}
+
+	if err := drainStaging(db, true); err != nil {
+		return common.Hash{}, err
+	}
+
+	// The transactions of previous commits are not known, so the snapshot
+	// cannot be rolled back beyond its own commit.
+	if err := s.main.WriteCommit(header.Commit, root, nil); err != nil {
+		return common.Hash{}, err
+	}
+	s.was.commitNumber = header.Commit + 1
+
+	if err := s.resetAll(root); err != nil {
+		return common.Hash{}, err
+	}
+
+	s.logger.WithFields(logrus.Fields{
+		"root":    root.Hex(),
+		"commit":  header.Commit,
+		"records": count,
+	}).Info("Restored snapshot")
+
+	return root, nil
+}
+
+// stageSnapshot writes the records of a snapshot under the staging prefix,
+// verifying them one by one, and then verifies that the state at root is
+// complete. It returns the number of records.
+func stageSnapshot(db database.Database,
+	stream *rlp.Stream,
+	br *bufio.Reader,
+	root common.Hash) (uint64, error) {
+
+	staging := ethdb.NewTable(db, string(_restorePrefix))
+	batch := staging.NewBatch()
+	count := uint64(0)
+	txs := make(map[common.Hash]struct{})
+
+	for {
+		stream.Reset(br, maxSnapshotRecordSize)
+
+		var rec snapshotRecord
+		if err := stream.Decode(&rec); err != nil {
+			return count, fmt.Errorf("Reading snapshot record %d: %v", count, err)
+		}
+
+		if rec.Kind == snapshotEnd {
+			if len(rec.Key) != 8 || binary.BigEndian.Uint64(rec.Key) != count {
+				return count, fmt.Errorf("Snapshot should contain %d records", count)
+			}
+			break
+		}
+
+		key, err := snapshotKey(rec, txs)
+		if err != nil {
+			return count, err
+		}
+
+		if err := batch.Put(key, rec.Value); err != nil {
+			return count, err
+		}
+
+		if batch.ValueSize() >= ethdb.IdealBatchSize {
+			if err := batch.Write(); err != nil {
+				return count, err
+			}
+			batch.Reset()
+		}
+
+		count++
+	}
+
+	if err := batch.Write(); err != nil {
+		return count, err
+	}
+
+	// Verify that every node of the state is present
+	noop := func(uint8, []byte, []byte) error { return nil }
+	if err := iterateState(staging, root, noop); err != nil {
+		return count, fmt.Errorf("Verifying state %s: %v", root.Hex(), err)
+	}
+
+	return count, nil
+}
+
+// drainStaging deletes the records under the staging prefix. If publish is set,
+// they are first copied to their own keys.
+func drainStaging(db database.Database, publish bool) error {
+	batch := db.NewBatch()
+
+	it := db.NewIteratorWithPrefix(_restorePrefix)
+	defer it.Release()
+
+	for it.Next() {
+		key := common.CopyBytes(it.Key())
+
+		if publish {
+			if err := batch.Put(key[len(_restorePrefix):], common.CopyBytes(it.Value())); err != nil {
+				return err
+			}
+		}
+
+		if err := batch.Delete(key); err != nil {
+			return err
+		}
+
+		if batch.ValueSize() >= ethdb.IdealBatchSize {
+			if err := batch.Write(); err != nil {
+				return err
+			}
+			batch.Reset()
+		}
+	}
+
+	if err := it.Error(); err != nil {
+		return err
+	}
+
+	return batch.Write()
+}
+
+// snapshotKey returns the database key of a snapshot record. It verifies the
+// hash of content-addressed records, and that receipts belong to a transaction
+// of txs, the set of transactions restored so far, to which it adds
+// transactions.
+func snapshotKey(rec snapshotRecord, txs map[common.Hash]struct{}) ([]byte, error) {
+	switch rec.Kind {
+	case snapshotNode, snapshotCode, snapshotPreimage:
+		if !bytes.Equal(crypto.Keccak256(rec.Value), rec.Key) {
+			return nil, fmt.Errorf("Hash mismatch for %x", rec.Key)
+		}
+		if rec.Kind == snapshotPreimage {
+			return prefixedKey(_triePrefix, prefixedKey(_preimagePrefix, rec.Key)), nil
+		}
+		return prefixedKey(_triePrefix, rec.Key), nil
+	case snapshotTransaction:
+		if !bytes.Equal(crypto.Keccak256(rec.Value), rec.Key) {
+			return nil, fmt.Errorf("Hash mismatch for transaction %x", rec.Key)
+		}
+		txs[common.BytesToHash(rec.Key)] = struct{}{}
+		return txKey(common.BytesToHash(rec.Key)), nil
+	case snapshotReceipt:
+		txHash := common.BytesToHash(rec.Key)
+		if _, ok := txs[txHash]; !ok || len(rec.Key) != common.HashLength {
+			return nil, fmt.Errorf("Receipt %x without transaction", rec.Key)
+		}
+		var receipt ethTypes.ReceiptForStorage
+		if err := rlp.DecodeBytes(rec.Value, &receipt); err != nil {
+			return nil, fmt.Errorf("Decoding receipt %x: %v", rec.Key, err)
+		}
+		if receipt.TxHash != txHash {
+			return nil, fmt.Errorf("Receipt %x is for transaction %x", rec.Key, receipt.TxHash)
+		}
+		return receiptKey(txHash), nil
+	default:
+		return nil, fmt.Errorf("Unknown snapshot record kind %d", rec.Kind)
+	}
+}
+
+// iterateState traverses the account trie at root, along with the storage
+// tries and code of every account, and calls visit for every node, code, and
+// preimage. It returns an error if any part of the state is missing.
+func iterateState(db ethdb.Database, root common.Hash, visit stateVisitor) error {
+	tdb := trieTable(db)
+	sdb := ethState.NewDatabase(tdb)
+
+	tr, err := sdb.OpenTrie(root)
+	if err != nil {
+		return err
+	}
+
+	return iterateTrie(tdb, tr, visit, func(key, blob []byte) error {
+		var account ethState.Account
+		if err := rlp.DecodeBytes(blob, &account); err != nil {
+			return err
+		}
+
+		if account.Root != _emptyRoot {
+			st, err := sdb.OpenStorageTrie(common.BytesToHash(key), account.Root)
+			if err != nil {
+				return err
+			}
+			if err := iterateTrie(tdb, st, visit, nil); err != nil {
+				return err
+			}
+		}
+
+		if !bytes.Equal(account.CodeHash, _emptyCodeHash) {
+			code, err := tdb.Get(account.CodeHash)
+			if err != nil {
+				return fmt.Errorf("Reading code %x: %v", account.CodeHash, err)
+			}
+			if err := visit(snapshotCode, account.CodeHash, code); err != nil {
+				return err
+			}
+		}
+
+		return nil
+	})
+}
+
+// iterateTrie calls visit for every node of a trie, and for the preimage of
+// every leaf key. onLeaf, if not nil, is called with the key and value of
+// every leaf.
+func iterateTrie(db ethdb.Database,
+	tr ethState.Trie,
+	visit stateVisitor,
+	onLeaf func(key, blob []byte) error) error {
+
+	if tr.Hash() == _emptyRoot {
+		return nil
+	}
+
+	it := tr.NodeIterator(nil)
+	for it.Next(true) {
+		// Nodes smaller than 32 bytes are embedded in their parent
+		if hash := it.Hash(); hash != (common.Hash{}) {
+			blob, err := db.Get(hash.Bytes())
+			if err != nil {
+				return fmt.Errorf("Reading node %x: %v", hash, err)
+			}
+			if err := visit(snapshotNode, hash.Bytes(), blob); err != nil {
+				return err
+			}
+		}
+
+		if it.Leaf() {
+			key := common.CopyBytes(it.LeafKey())
+
+			if preimage := tr.GetKey(key); preimage != nil {
+				if err := visit(snapshotPreimage, key, preimage); err != nil {
+					return err
+				}
+			}
+
+			if onLeaf != nil {
+				if err := onLeaf(key, common.CopyBytes(it.LeafBlob())); err != nil {
+					return err
+				}
+			}
+		}
+	}
+
+	return it.Error()
+}
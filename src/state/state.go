@@ -1,26 +1,33 @@
 package state
 
 import (
+	"bytes"
 	"encoding/hex"
 	"encoding/json"
+	"fmt"
+	"io"
 	"io/ioutil"
 	"math/big"
 	"os"
-	"strings"
+	"sort"
+	"sync"
+	"sync/atomic"
 
 	"github.com/ethereum/go-ethereum/common"
 	ethTypes "github.com/ethereum/go-ethereum/core/types"
 
 	ethState "github.com/ethereum/go-ethereum/core/state"
 	"github.com/ethereum/go-ethereum/core/vm"
-	"github.com/ethereum/go-ethereum/ethdb"
 	"github.com/sirupsen/logrus"
 
 	bcommon "github.com/mosaicnetworks/evm-lite/src/common"
+	"github.com/mosaicnetworks/evm-lite/src/database"
 )
 
 var (
-	_fdLimit  = 8192
+	// _gasLimit is the block gas limit of a genesis file which does not set
+	// one, and the gas of the genesis operations. It does not bound the blocks
+	// in practice, so a node without a gas limit warns about it on startup.
 	_gasLimit = uint64(1000000000000000000)
 )
 
@@ -38,54 +45,182 @@ underlying datastore:
    submitting them to the consensus system.
 */
 type State struct {
+	db     database.Database
 	main   BaseState
+	reader atomic.Value // *readState at the root of main
 	was    *WriteAheadState
 	txPool *TxPool
 
 	genesisFile string
 
+	// poa is the configuration of the POA smart-contract, read from the
+	// genesis file
+	poa *poaContract
+
+	// feePolicy is the fee policy, read from the genesis file
+	feePolicy feePolicy
+
+	// validatorChanges are the changes to the validator set since the last
+	// Commit, which are passed to validatorSetCallback after the next Commit.
+	validatorChanges     []ValidatorChange
+	validatorSetCallback ValidatorSetCallback
+
+	// parallelism is the number of workers used by ApplyBlock. Blocks are
+	// applied sequentially if it is lower than 2.
+	parallelism int
+
+	// callLimits are the limits of the calls made through the API
+	callLimits callLimits
+
+	// precompiles are the precompiles enabled in the EVMs of the State. The
+	// set is replaced, under precompileLock, whenever it changes.
+	precompiles    precompileSet
+	precompileLock sync.Mutex
+
 	logger *logrus.Entry
 }
 
-// NewState creates and initializes a new State object. It reads the genesis
-// file to create the initial accounts, including the POA smart-contract.
-func NewState(dbFile string, dbCache int, genesisFile string, logger *logrus.Entry) (*State, error) {
+// NewState creates and initializes a new State object. The database is
+// migrated to the current schema. If it already contains a committed state, the
+// State resumes from it. Otherwise, it reads the genesis file to create the
+// initial accounts, including the POA smart-contract. The State takes ownership
+// of the database, which is closed by Close.
+func NewState(db database.Database, genesisFile string, logger *logrus.Entry) (*State, error) {
 
 	// db is THREAD SAFE and reused by base, was, and txpool
-	db, err := ethdb.NewLDBDatabase(dbFile, dbCache, _fdLimit)
+	if _, _, err := Migrate(db, logger); err != nil {
+		return nil, err
+	}
+
+	s := newState(db, genesisFile, logger)
+
+	head, err := ReadHead(db)
 	if err != nil {
 		return nil, err
 	}
 
+	if head != (common.Hash{}) {
+		if err := s.resume(head); err != nil {
+			return nil, err
+		}
+		return s, nil
+	}
+
+	// Initialize genesis accounts with balance, code, and state
+	err = s.CreateGenesisAccounts()
+	if err != nil {
+		return nil, err
+	}
+
+	return s, nil
+}
+
+// OpenState opens a database which already contains a committed state, and
+// returns a State reset to the last committed root. Unlike NewState, it never
+// creates the genesis accounts. It is meant to be used by offline tools.
+func OpenState(db database.Database, genesisFile string, logger *logrus.Entry) (*State, error) {
+	if _, _, err := Migrate(db, logger); err != nil {
+		return nil, err
+	}
+
+	head, err := ReadHead(db)
+	if err != nil {
+		return nil, err
+	}
+
+	if head == (common.Hash{}) {
+		return nil, fmt.Errorf("No committed state in database")
+	}
+
+	s := newState(db, genesisFile, logger)
+
+	if err := s.resume(head); err != nil {
+		return nil, err
+	}
+
+	return s, nil
+}
+
+// newState returns a State with an empty root, backed by the given database
+func newState(db database.Database, genesisFile string, logger *logrus.Entry) *State {
 	main := NewBaseState(db,
 		common.Hash{},
 		ethTypes.NewEIP155Signer(CustomChainConfig.ChainID),
 		CustomChainConfig,
-		vm.Config{Tracer: vm.NewStructLogger(nil)},
+		vm.Config{},
 		_gasLimit,
 	)
 
 	s := &State{
+		db:          db,
 		main:        main,
 		was:         NewWriteAheadState(main.Copy(), logger),
 		txPool:      NewTxPool(main.Copy(), logger),
 		genesisFile: genesisFile,
+		poa:         defaultPOAContract(),
+		feePolicy:   defaultFeePolicy(),
 		logger:      logger,
 	}
 
-	// Initialize genesis accounts with balance, code, and state
-	err = s.CreateGenesisAccounts()
+	s.reader.Store(newReadState(&s.main, common.Hash{}))
+
+	return s
+}
+
+// resume reads the POA configuration from the genesis file, and resets the
+// State to a previously committed root.
+func (s *State) resume(root common.Hash) error {
+	head, ok, err := ReadHeadCommit(s.db)
 	if err != nil {
-		return nil, err
+		return err
+	}
+	if ok {
+		s.was.commitNumber = head + 1
 	}
 
-	return s, nil
+	genesis, err := s.GetGenesis()
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	if err == nil {
+		if err := s.loadPOAContract(genesis.Poa); err != nil {
+			return err
+		}
+		if err := s.loadPrecompiles(genesis.Precompiles); err != nil {
+			return err
+		}
+		if err := s.loadFeePolicy(genesis.Fees); err != nil {
+			return err
+		}
+		s.loadGasLimit(genesis.GasLimit)
+		s.loadChainID(genesis.ChainID)
+	}
+
+	root, err = s.repairHead(root)
+	if err != nil {
+		return err
+	}
+
+	if err := s.resetAll(root); err != nil {
+		return err
+	}
+
+	s.logger.WithField("root", root.Hex()).Info("Resuming from committed state")
+
+	return nil
+}
+
+// Close closes the underlying database
+func (s *State) Close() {
+	s.db.Close()
 }
 
 /******************************************************************************/
 
 // CreateGenesisAccounts reads the genesis.json file and creates the regular
-// pre-funded accounts, as well as the POA smart-contract account.
+// pre-funded accounts, as well as the POA smart-contract account. It also
+// enables the precompiles of the genesis file.
 func (s *State) CreateGenesisAccounts() error {
 
 	genesis, err := s.GetGenesis()
@@ -96,6 +231,17 @@ func (s *State) CreateGenesisAccounts() error {
 		return err
 	}
 
+	if err := s.loadPrecompiles(genesis.Precompiles); err != nil {
+		return err
+	}
+
+	if err := s.loadFeePolicy(genesis.Fees); err != nil {
+		return err
+	}
+
+	s.loadGasLimit(genesis.GasLimit)
+	s.loadChainID(genesis.ChainID)
+
 	// Regular pre-funded accounts
 	for addr, account := range genesis.Alloc {
 		address := common.HexToAddress(addr)
@@ -112,17 +258,16 @@ func (s *State) CreateGenesisAccounts() error {
 
 	// POA smart-contract account
 	if string(genesis.Poa.Address) != "" {
-		address := common.HexToAddress(genesis.Poa.Address)
+		if err := s.loadPOAContract(genesis.Poa); err != nil {
+			return err
+		}
 
-		s.was.CreateAccount(address,
+		s.was.CreateAccount(s.poa.address,
 			genesis.Poa.Code,
 			genesis.Poa.Storage,
 			genesis.Poa.Balance,
 			genesis.Poa.Nonce)
 
-		setPOAADDR(genesis.Poa.Address)
-		setPOAABI(genesis.Poa.Abi)
-
 		s.logger.WithField("address", genesis.Poa.Address).Debug("Adding POA smart-contract account")
 
 	}
@@ -135,6 +280,24 @@ func (s *State) CreateGenesisAccounts() error {
 
 }
 
+// loadPOAContract sets the State's POA configuration from the poa section of
+// the genesis file. The default configuration is kept if the section is empty.
+func (s *State) loadPOAContract(poaMap bcommon.PoaMap) error {
+	if poaMap.Address == "" {
+		return nil
+	}
+
+	poa, err := newPOAContract(poaMap.Address, poaMap.Abi)
+	if err != nil {
+		s.logger.WithError(err).Error("Parsing POA ABI")
+		return err
+	}
+
+	s.poa = poa
+
+	return nil
+}
+
 /*******************************************************************************
 Methods called by Consensus
 *******************************************************************************/
@@ -157,13 +320,94 @@ func (s *State) ApplyTransaction(
 		s.logger.WithField("hash", t.Hash().Hex()).Debug("Decoded tx")
 	}
 
-	return s.was.ApplyTransaction(t, txIndex, blockHash, coinbase)
+	if err := s.was.ApplyTransaction(t, txIndex, blockHash, coinbase); err != nil {
+		return err
+	}
+
+	s.recordValidatorChanges(t)
+
+	return nil
 }
 
-// Commit persists all pending state changes (in the WAS) to the DB, and resets
-// the WAS and TxPool
+// ApplyBlock decodes the transactions of a block and applies them to the WAS,
+// with indexes starting at 0. If parallelism is enabled, they are executed
+// speculatively in parallel, with the same result as applying them in order,
+// unless the VM debug log is enabled.
+// It returns the error of every transaction, as ApplyTransaction would.
+func (s *State) ApplyBlock(
+	txs [][]byte,
+	blockHash common.Hash,
+	coinbase common.Address) []error {
+
+	errs := make([]error, len(txs))
+	ts := make([]*EVMLTransaction, len(txs))
+
+	for i, txBytes := range txs {
+		t, err := NewEVMLTransaction(txBytes, s.GetSigner())
+		if err != nil {
+			s.logger.WithError(err).Error("Decoding Transaction")
+			errs[i] = err
+			continue
+		}
+		ts[i] = t
+	}
+
+	if s.parallelism > 1 && s.was.debug == nil {
+		for i, err := range s.was.ApplyTransactions(ts, blockHash, coinbase, s.parallelism) {
+			if ts[i] != nil {
+				errs[i] = err
+			}
+		}
+	} else {
+		for i, t := range ts {
+			if t != nil {
+				errs[i] = s.was.ApplyTransaction(t, i, blockHash, coinbase)
+			}
+		}
+	}
+
+	for i, t := range ts {
+		if t != nil && errs[i] == nil {
+			s.recordValidatorChanges(t)
+		}
+	}
+
+	return errs
+}
+
+// recordValidatorChanges looks for events emitted by the POA smart-contract in
+// the receipt of a transaction, and records the corresponding changes to the
+// validator set.
+func (s *State) recordValidatorChanges(t *EVMLTransaction) {
+	if t.receipt == nil {
+		return
+	}
+
+	for _, log := range t.receipt.Logs {
+		change, err := s.poa.parseValidatorChange(log)
+		if err != nil {
+			s.logger.WithError(err).Error("Parsing POA event")
+			continue
+		}
+		if change == nil {
+			continue
+		}
+
+		s.logger.WithFields(logrus.Fields{
+			"event":   change.Event,
+			"address": change.Address.Hex(),
+		}).Debug("Validator set change")
+
+		s.validatorChanges = append(s.validatorChanges, *change)
+	}
+}
+
+// Commit distributes the fees according to the fee policy, persists all pending
+// state changes (in the WAS) to the DB, and resets the WAS and TxPool
 func (s *State) Commit() (common.Hash, error) {
 
+	s.distributeFees()
+
 	// commit all state changes to the database
 	root, err := s.was.Commit()
 	if err != nil {
@@ -171,30 +415,95 @@ func (s *State) Commit() (common.Hash, error) {
 		return root, err
 	}
 
+	if s.logger.Level > logrus.InfoLevel {
+		s.logger.WithField("root", root.Hex()).Debug("Committed")
+	}
+
+	if err := s.resetAll(root); err != nil {
+		return root, err
+	}
+
+	// Notify the consensus system of changes to the validator set
+	if len(s.validatorChanges) > 0 {
+		update := ValidatorSetUpdate{
+			Root:    root,
+			Changes: s.validatorChanges,
+		}
+		s.validatorChanges = nil
+
+		if s.validatorSetCallback != nil {
+			s.validatorSetCallback(update)
+		}
+	}
+
+	return root, nil
+}
+
+// resetAll resets the main state, the WAS, and the TxPool to the given root
+func (s *State) resetAll(root common.Hash) error {
 	// Reset Main
 	if err := s.main.Reset(root); err != nil {
 		s.logger.WithError(err).Error("Resetting main StateDB")
-		return root, err
-	}
-	if s.logger.Level > logrus.InfoLevel {
-		s.logger.WithField("root", root.Hex()).Debug("Committed")
+		return err
 	}
 
+	// Swap the view used by readers
+	s.reader.Store(newReadState(&s.main, root))
+
 	// Reset WAS
 	if err := s.was.Reset(root); err != nil {
 		s.logger.WithError(err).Error("Resetting WAS")
-		return root, err
+		return err
 	}
 	s.logger.Debug("Reset WAS")
 
 	// Reset TxPool
 	if err := s.txPool.Reset(root); err != nil {
 		s.logger.WithError(err).Error("Resetting TxPool")
-		return root, err
+		return err
 	}
 	s.logger.Debug("Reset TxPool")
 
-	return root, nil
+	return nil
+}
+
+// SetValidatorSetCallback sets the function that is called after a Commit
+// which changed the validator set. It is meant to be used by consensus systems
+// that reconfigure their membership based on the POA smart-contract.
+func (s *State) SetValidatorSetCallback(f ValidatorSetCallback) {
+	s.validatorSetCallback = f
+}
+
+// SetStateDiffs enables or disables the recording of the StateDiff of every
+// transaction applied by the consensus system. The state diffs are persisted
+// with the transactions.
+func (s *State) SetStateDiffs(enabled bool) {
+	s.was.recordStateDiffs = enabled
+}
+
+// SetVMDebug enables the VM debug log: every transaction applied by the
+// consensus system is traced to w, as JSON lines. Blocks are then applied
+// sequentially, so that the transactions are traced in order. A nil writer
+// disables it.
+func (s *State) SetVMDebug(w io.Writer) {
+	if w == nil {
+		s.was.debug = nil
+		return
+	}
+	s.was.debug = newDebugLogger(w)
+}
+
+// SetInternalTxs enables or disables the recording of the internal
+// transactions of every transaction applied by the consensus system. They are
+// persisted with the transactions, and indexed by address.
+func (s *State) SetInternalTxs(enabled bool) {
+	s.was.recordInternalTxs = enabled
+}
+
+// SetParallelism sets the number of workers used by ApplyBlock to execute
+// transactions in parallel. Values lower than 2 disable parallel execution.
+func (s *State) SetParallelism(workers int) {
+	s.parallelism = workers
 }
 
 /*******************************************************************************
@@ -206,6 +515,57 @@ func (s *State) GetGasLimit() uint64 {
 	return s.main.gasLimit
 }
 
+// SetGasLimit sets the block gas limit, which bounds the gas of the
+// transactions applied between two commits. It also caps the gas of calls. It
+// is read from the genesis file, and must be the same on every node.
+func (s *State) SetGasLimit(limit uint64) {
+	s.main.setGasLimit(limit)
+	s.was.setGasLimit(limit)
+	s.txPool.setGasLimit(limit)
+
+	s.reader.Store(newReadState(&s.main, s.main.GetRoot()))
+
+	s.logger.WithField("gas_limit", limit).Debug("Block gas limit")
+}
+
+// loadGasLimit sets the block gas limit of the genesis file, if any, and warns
+// if it does not set one
+func (s *State) loadGasLimit(limit uint64) {
+	if limit == 0 {
+		s.logger.WithField("gas_limit", _gasLimit).Warn("No block gas limit in genesis file. Blocks are not bounded in practice")
+		return
+	}
+	s.SetGasLimit(limit)
+}
+
+// GetChainID returns the chain ID with which transactions are signed
+func (s *State) GetChainID() *big.Int {
+	return new(big.Int).Set(s.main.chainConfig.ChainID)
+}
+
+// loadChainID sets the chain ID of the genesis file, if any. Transactions
+// signed for another chain ID are rejected.
+func (s *State) loadChainID(chainID uint64) {
+	if chainID == 0 {
+		return
+	}
+
+	id := new(big.Int).SetUint64(chainID)
+
+	s.main.setChainID(id)
+	s.was.setChainID(id)
+	s.txPool.setChainID(id)
+
+	s.reader.Store(newReadState(&s.main, s.main.GetRoot()))
+
+	s.logger.WithField("chain_id", chainID).Debug("Chain ID")
+}
+
+// GetRoot returns the root hash of the last committed state
+func (s *State) GetRoot() common.Hash {
+	return s.main.GetRoot()
+}
+
 // GetGenesis reads and unmarshals the genesis.json file
 func (s *State) GetGenesis() (bcommon.Genesis, error) {
 	if _, err := os.Stat(s.genesisFile); err != nil {
@@ -229,13 +589,13 @@ func (s *State) GetGenesis() (bcommon.Genesis, error) {
 // GetAuthorisingAccount returns the address of the smart contract which handles
 // the list of authorized peers
 func (s *State) GetAuthorisingAccount() string {
-	return POAADDR.String()
+	return s.poa.address.String()
 }
 
 // GetAuthorisingABI returns the abi of the smart contract which handles the
 // list of authorized peers
 func (s *State) GetAuthorisingABI() string {
-	return POAABISTRING
+	return s.poa.abiString
 }
 
 // GetSigner returns the state's signer
@@ -243,16 +603,30 @@ func (s *State) GetSigner() ethTypes.Signer {
 	return s.main.signer
 }
 
+// readState returns the immutable view of the last committed state, which
+// serves the queries that are not made against the TxPool
+func (s *State) readState() *readState {
+	return s.reader.Load().(*readState)
+}
+
 /*******************************************************************************
 WAS & TxPool
 *******************************************************************************/
 
-// Call executes a readonly transaction on a copy of the WAS. It is called by
-// the service handlers
+// Call executes a readonly transaction against the last committed state. It
+// does not wait for transactions being applied or committed, and is not subject
+// to the call limits; the calls made through the API use LimitedCall.
 func (s *State) Call(callMsg ethTypes.Message) ([]byte, error) {
-	res, err := s.was.Call(callMsg)
+	return s.TraceCall(callMsg, nil)
+}
+
+// TraceCall executes a readonly transaction like Call, with a tracer if it is
+// not nil. Tracers are not safe for concurrent use, so every call needs its
+// own instance.
+func (s *State) TraceCall(callMsg ethTypes.Message, tracer vm.Tracer) ([]byte, error) {
+	res, err := s.readState().Call(callMsg, tracer, 0)
 	if err != nil {
-		s.logger.WithError(err).Error("Executing Call on WAS")
+		s.logger.WithError(err).Error("Executing Call")
 		return nil, err
 	}
 
@@ -264,6 +638,17 @@ func (s *State) CreateReceiptPromise(hash common.Hash) *ReceiptPromise {
 	return s.was.CreateReceiptPromise(hash)
 }
 
+// DropReceiptPromise forgets a receipt promise which nobody waits for anymore
+func (s *State) DropReceiptPromise(p *ReceiptPromise) {
+	s.was.DropReceiptPromise(p)
+}
+
+// PendingTxs returns the number of transactions submitted with a receipt
+// promise which are not committed yet, and whose receipt is still awaited
+func (s *State) PendingTxs() int {
+	return s.was.PendingPromises()
+}
+
 // CheckTx attempts to apply a transaction to the TxPool's stateDB. It is called
 // by the Service handlers to check if a transaction is valid before submitting
 // it to the consensus system. This also updates the sender's Nonce in the
@@ -277,7 +662,7 @@ func (s *State) GetBalance(addr common.Address, fromPool bool) *big.Int {
 	if fromPool {
 		return s.txPool.GetBalance(addr)
 	}
-	return s.main.GetBalance(addr)
+	return s.readState().GetBalance(addr)
 }
 
 // GetNonce returns an account's nonce
@@ -285,7 +670,7 @@ func (s *State) GetNonce(addr common.Address, fromPool bool) uint64 {
 	if fromPool {
 		return s.txPool.GetNonce(addr)
 	}
-	return s.main.GetNonce(addr)
+	return s.readState().GetNonce(addr)
 }
 
 // GetCode returns an account's bytecode
@@ -293,7 +678,7 @@ func (s *State) GetCode(addr common.Address, fromPool bool) []byte {
 	if fromPool {
 		return s.txPool.GetCode(addr)
 	}
-	return s.main.GetCode(addr)
+	return s.readState().GetCode(addr)
 }
 
 // GetStorage returns an account's storage
@@ -301,7 +686,7 @@ func (s *State) GetStorage(addr common.Address, fromPool bool) map[string]string
 	if fromPool {
 		return s.txPool.GetStorage(addr)
 	}
-	return s.main.GetStorage(addr)
+	return s.readState().GetStorage(addr)
 }
 
 // GetTransaction fetches a transaction from the WAS
@@ -314,6 +699,11 @@ func (s *State) GetReceipt(txHash common.Hash) (*ethTypes.Receipt, error) {
 	return s.was.GetReceipt(txHash)
 }
 
+// GetStateDiff fetches a transaction's state diff, if it was recorded
+func (s *State) GetStateDiff(txHash common.Hash) (StateDiff, error) {
+	return s.was.GetStateDiff(txHash)
+}
+
 /*******************************************************************************
 POA
 *******************************************************************************/
@@ -322,8 +712,130 @@ POA
 // authorised. It is called by the consensus system when deciding to add or
 // remove a peer.
 func (s *State) CheckAuthorised(addr common.Address) (bool, error) {
+	res, err := s.callPOA(poaCheckAuthorisedMethod, addr)
+	if err != nil {
+		return false, err
+	}
+
+	unpackRes := new(bool)
+	s.poa.abi.Unpack(&unpackRes, poaCheckAuthorisedMethod, res)
 
-	callData, err := POAABI.Pack("checkAuthorised", addr)
+	if *unpackRes {
+		return true, nil
+	}
+
+	return false, nil
+}
+
+// GetValidators returns the current whitelist of the POA smart-contract. If the
+// contract does not expose the enumeration methods, we fall back to checking
+// the accounts of the genesis file with checkAuthorised, so the result might
+// not include members that were added later. A whitelist larger than
+// poaMaxValidators is rejected.
+func (s *State) GetValidators() ([]Validator, error) {
+	if !s.poa.canEnumerate() {
+		s.logger.Debug("POA contract cannot enumerate whitelist. Using genesis accounts")
+		return s.getGenesisValidators()
+	}
+
+	res, err := s.callPOA(poaWhiteListCountMethod)
+	if err != nil {
+		return nil, err
+	}
+
+	var count *big.Int
+	if err := s.poa.abi.Unpack(&count, poaWhiteListCountMethod, res); err != nil {
+		return nil, err
+	}
+
+	if count.Cmp(big.NewInt(poaMaxValidators)) > 0 {
+		return nil, fmt.Errorf("POA contract reports %v validators, more than the maximum %d", count, poaMaxValidators)
+	}
+
+	validators := []Validator{}
+
+	for i := int64(0); i < count.Int64(); i++ {
+		res, err := s.callPOA(poaWhiteListAddressMethod, big.NewInt(i))
+		if err != nil {
+			return nil, err
+		}
+
+		var addr common.Address
+		if err := s.poa.abi.Unpack(&addr, poaWhiteListAddressMethod, res); err != nil {
+			return nil, err
+		}
+
+		validator := Validator{Address: addr}
+
+		if s.poa.hasMethod(poaMonikerMethod) {
+			moniker, err := s.getMoniker(addr)
+			if err != nil {
+				return nil, err
+			}
+			validator.Moniker = moniker
+		}
+
+		validators = append(validators, validator)
+	}
+
+	return validators, nil
+}
+
+// getGenesisValidators returns the accounts of the genesis file which are
+// authorised by the POA smart-contract.
+func (s *State) getGenesisValidators() ([]Validator, error) {
+	validators := []Validator{}
+
+	genesis, err := s.GetGenesis()
+	if err != nil {
+		if os.IsNotExist(err) {
+			return validators, nil
+		}
+		return nil, err
+	}
+
+	addresses := make([]string, 0, len(genesis.Alloc))
+	for addr := range genesis.Alloc {
+		addresses = append(addresses, addr)
+	}
+	// iterate in a deterministic order
+	sort.Strings(addresses)
+
+	for _, addr := range addresses {
+		address := common.HexToAddress(addr)
+
+		ok, err := s.CheckAuthorised(address)
+		if err != nil {
+			return nil, err
+		}
+
+		if ok {
+			validators = append(validators, Validator{Address: address})
+		}
+	}
+
+	return validators, nil
+}
+
+// getMoniker returns the moniker attached to a member of the whitelist
+func (s *State) getMoniker(addr common.Address) (string, error) {
+	res, err := s.callPOA(poaMonikerMethod, addr)
+	if err != nil {
+		return "", err
+	}
+
+	var moniker [32]byte
+	if err := s.poa.abi.Unpack(&moniker, poaMonikerMethod, res); err != nil {
+		return "", err
+	}
+
+	return string(bytes.TrimRight(moniker[:], "\x00")), nil
+}
+
+// callPOA packs the arguments and calls a method of the POA smart-contract. It
+// returns the raw result, to be unpacked by the caller.
+func (s *State) callPOA(method string, args ...interface{}) ([]byte, error) {
+	callData, err := s.poa.abi.Pack(method, args...)
 	if err != nil {
 		s.logger.Warningf("couldn't pack arguments: %v", err)
 	}
@@ -331,8 +843,8 @@ func (s *State) CheckAuthorised(addr common.Address) (bool, error) {
 	// Apply an ethereum call message (no state update) to query the
 	// smart-contract. Since there's no nonce check and the gas price is set to
 	// zero, an arbitrary address can be used as the source of the tx.
-	ethMsg := ethTypes.NewMessage(POAADDR,
-		&POAADDR,
+	ethMsg := ethTypes.NewMessage(s.poa.address,
+		&s.poa.address,
 		uint64(1),
 		big.NewInt(0),
 		s.GetGasLimit(),
@@ -342,25 +854,13 @@ func (s *State) CheckAuthorised(addr common.Address) (bool, error) {
 
 	if s.logger.Level > logrus.InfoLevel {
 		s.logger.WithFields(logrus.Fields{
-			"addr":     addr.Hex(),
+			"args":     args,
 			"callData": hex.EncodeToString(callData),
-			"contract": POAADDR.String(),
-		}).Debug("checkAuthorised")
-	}
-
-	res, err := s.Call(ethMsg)
-	if err != nil {
-		return false, err
-	}
-
-	unpackRes := new(bool)
-	POAABI.Unpack(&unpackRes, "checkAuthorised", res)
-
-	if *unpackRes {
-		return true, nil
+			"contract": s.poa.address.String(),
+		}).Debug(method)
 	}
 
-	return false, nil
+	return s.Call(ethMsg)
 }
 
 /*******************************************************************************
@@ -373,32 +873,15 @@ type CurrentGenesis struct {
 	Poa   bcommon.PoaMap
 }
 
-// DumpAllAccounts outputs JSON of all accounts
+// DumpAllAccounts outputs JSON of all accounts, in the genesis format. The
+// whole state is held in memory, so Export should be preferred for large
+// states.
 func (s *State) DumpAllAccounts() []byte {
+	var buf bytes.Buffer
 
-	dump := CurrentGenesis{Alloc: s.main.stateDB.RawDump().Accounts,
-		Poa: bcommon.PoaMap{
-			Address: POAADDR.Hex(),
-			Balance: s.GetBalance(POAADDR, false).Text(10),
-			Abi:     POAABISTRING,
-			Code:    hex.EncodeToString(s.GetCode(POAADDR, false)),
-			Nonce:   s.GetNonce(POAADDR, false),
-		},
-	}
-
-	// Lowercase and trim prefix on the Hex() of the key to match dump format
-	cleanPOAAddr := strings.TrimPrefix(strings.ToLower(POAADDR.Hex()), "0x")
-
-	// Set POA Storage from Alloc section before we remove it
-	dump.Poa.Storage = dump.Alloc[cleanPOAAddr].Storage
-
-	// Remove POA contract from Alloc section
-	delete(dump.Alloc, cleanPOAAddr)
-
-	js, err := json.Marshal(dump)
-	if err != nil {
-		s.logger.WithError(err).Error("Marshaling JSON response")
+	if _, err := s.Export(&buf, ExportOptions{Format: ExportGenesis}); err != nil {
+		s.logger.WithError(err).Error("Dumping accounts")
 	}
 
-	return js
+	return buf.Bytes()
 }
@@ -1,25 +1,38 @@
 package state
 
 import (
+	"bytes"
+	"encoding/json"
+	"io"
 	"io/ioutil"
 	"math/big"
 	"os"
 	"path/filepath"
 	"strings"
 	"testing"
+	"time"
 
 	"github.com/ethereum/go-ethereum/accounts"
 	"github.com/ethereum/go-ethereum/accounts/abi"
 	"github.com/ethereum/go-ethereum/accounts/keystore"
 	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/common/math"
 	ethTypes "github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/core/vm"
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/ethereum/go-ethereum/ethdb"
 	"github.com/ethereum/go-ethereum/rlp"
 	"github.com/sirupsen/logrus"
 
 	bcommon "github.com/mosaicnetworks/evm-lite/src/common"
+	"github.com/mosaicnetworks/evm-lite/src/database"
 )
 
 var (
+	// _testEngine is the database engine used by the tests. It is set with the
+	// EVML_TEST_DB_ENGINE environment variable, and defaults to memory.
+	_testEngine = testEngine()
+
 	_defaultValue    = big.NewInt(0)
 	_defaultGas      = uint64(1000000)
 	_defaultGasPrice = big.NewInt(0)
@@ -31,18 +44,31 @@ type Test struct {
 	dbFile  string
 	cache   int
 
+	db       database.Database
 	keyStore *keystore.KeyStore
 	state    *State
 	logger   *logrus.Entry
 }
 
-func NewTest(dataDir string, logger *logrus.Entry, t *testing.T) *Test {
+func testEngine() string {
+	if engine := os.Getenv("EVML_TEST_DB_ENGINE"); engine != "" {
+		return engine
+	}
+	return database.Memory
+}
+
+func NewTest(dataDir string, logger *logrus.Entry, t testing.TB) *Test {
 	pwdFile := filepath.Join(dataDir, "pwd.txt")
 	dbFile := filepath.Join(dataDir, "chaindata")
 	genesisFile := filepath.Join(dataDir, "genesis.json")
 	cache := 128
 
-	state, err := NewState(dbFile, cache, genesisFile, logger)
+	db, err := database.Open(_testEngine, dbFile, cache)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	state, err := NewState(db, genesisFile, logger)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -52,6 +78,7 @@ func NewTest(dataDir string, logger *logrus.Entry, t *testing.T) *Test {
 		pwdFile: pwdFile,
 		dbFile:  dbFile,
 		cache:   cache,
+		db:      db,
 		state:   state,
 		logger:  logger,
 	}
@@ -150,7 +177,7 @@ func (test *Test) prepareTransaction(from, to *accounts.Account,
 	return signedTx, nil
 }
 
-func (test *Test) deployContract(from accounts.Account, contract *Contract, t *testing.T) {
+func (test *Test) deployContract(from accounts.Account, contract *Contract, t testing.TB) {
 
 	// Create Contract transaction
 	tx, err := test.prepareTransaction(&from,
@@ -186,6 +213,33 @@ func (test *Test) deployContract(from accounts.Account, contract *Contract, t *t
 	}
 
 	contract.address = receipt.ContractAddress
+	contract.deployTx = tx.Hash()
+}
+
+// newTestWithGenesis creates a Test in a temporary directory, with a copy of the
+// reference Test's genesis file modified by the given function.
+func newTestWithGenesis(ref *Test, modify func(*bcommon.Genesis), t *testing.T) (*Test, bcommon.Genesis) {
+	dataDir, err := ioutil.TempDir("", "evml-state")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	genesis, err := ref.state.GetGenesis()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	modify(&genesis)
+
+	js, err := json.Marshal(genesis)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(dataDir, "genesis.json"), js, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	return NewTest(dataDir, ref.logger, t), genesis
 }
 
 //------------------------------------------------------------------------------
@@ -256,16 +310,65 @@ func TestTransfer(t *testing.T) {
 	}
 }
 
+// TestPendingTxs checks that a transaction submitted with a receipt promise is
+// pending until it is committed
+func TestPendingTxs(t *testing.T) {
+	os.RemoveAll("test_data/eth/chaindata")
+	defer os.RemoveAll("test_data/eth/chaindata")
+
+	test := NewTest("test_data/eth", bcommon.NewTestEntry(t), t)
+	defer test.state.main.db.Close()
+
+	if err := test.Init(); err != nil {
+		t.Fatal(err)
+	}
+
+	from := test.keyStore.Accounts()[0]
+	to := test.keyStore.Accounts()[1]
+
+	tx, err := test.prepareTransaction(&from, &to, _defaultValue, 21000, _defaultGasPrice, []byte{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	data, err := rlp.EncodeToBytes(tx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	promise := test.state.CreateReceiptPromise(tx.Hash())
+
+	if pending := test.state.PendingTxs(); pending != 1 {
+		t.Fatalf("There should be 1 pending transaction, not %d", pending)
+	}
+
+	if err := test.state.ApplyTransaction(data, 0, common.Hash{}, common.Address{}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := test.state.Commit(); err != nil {
+		t.Fatal(err)
+	}
+
+	if resp := <-promise.RespCh; resp.Error != nil {
+		t.Fatal(resp.Error)
+	}
+
+	if pending := test.state.PendingTxs(); pending != 0 {
+		t.Fatalf("There should be no pending transactions, not %d", pending)
+	}
+}
+
 //------------------------------------------------------------------------------
 type Contract struct {
-	name    string
-	address common.Address
-	code    string
-	abi     string
-	jsonABI abi.ABI
+	name     string
+	address  common.Address
+	deployTx common.Hash
+	code     string
+	abi      string
+	jsonABI  abi.ABI
 }
 
-func (c *Contract) parseABI(t *testing.T) {
+func (c *Contract) parseABI(t testing.TB) {
 	jABI, err := abi.JSON(strings.NewReader(c.abi))
 	if err != nil {
 		t.Fatal(err)
@@ -465,3 +568,2500 @@ func TestPOA(t *testing.T) {
 		t.Fatal("CheckAuthorised(3e735ec89371214b3f1fb2a59e3957f4ac4eaa03) should return false")
 	}
 }
+
+/*
+
+This test verifies that the POA contract configuration belongs to the State
+instance. A second State, with a different POA address in its genesis file,
+must not affect the first one.
+
+*/
+func TestPOAPerInstance(t *testing.T) {
+	os.RemoveAll("test_data/eth/chaindata")
+	defer os.RemoveAll("test_data/eth/chaindata")
+
+	testLogger := bcommon.NewTestEntry(t)
+
+	test := NewTest("test_data/eth", testLogger, t)
+	defer test.state.main.db.Close()
+
+	other, genesis := newTestWithGenesis(test, func(g *bcommon.Genesis) {
+		g.Poa.Address = "0x1234123412341234123412341234123412341234"
+	}, t)
+	defer os.RemoveAll(other.dataDir)
+	defer other.state.main.db.Close()
+
+	if addr := common.HexToAddress(test.state.GetAuthorisingAccount()); addr != common.HexToAddress(defaultPOAADDR) {
+		t.Fatalf("First State's POA address should be %s, not %s", defaultPOAADDR, addr.Hex())
+	}
+
+	if addr := common.HexToAddress(other.state.GetAuthorisingAccount()); addr != common.HexToAddress(genesis.Poa.Address) {
+		t.Fatalf("Second State's POA address should be %s, not %s", genesis.Poa.Address, addr.Hex())
+	}
+
+	ok, err := test.state.CheckAuthorised(common.HexToAddress("0x89acCD6b63d6eE73550eca0Cba16C2027c13FDa6"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !ok {
+		t.Fatal("CheckAuthorised(0x89acCD6b63d6eE73550eca0Cba16C2027c13FDa6) should still return true on the first State")
+	}
+}
+
+/*
+
+The dummy POA contract only implements checkAuthorised, so GetValidators must
+fall back to checking the accounts of the genesis file.
+
+*/
+func TestPOAValidatorsFallback(t *testing.T) {
+	os.RemoveAll("test_data/eth/chaindata")
+	defer os.RemoveAll("test_data/eth/chaindata")
+
+	testLogger := bcommon.NewTestEntry(t)
+
+	test := NewTest("test_data/eth", testLogger, t)
+	defer test.state.main.db.Close()
+
+	validators, err := test.state.GetValidators()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(validators) != 0 {
+		t.Fatalf("There should be no validators in the genesis accounts, not %d", len(validators))
+	}
+
+	authorised := common.HexToAddress("0x89acCD6b63d6eE73550eca0Cba16C2027c13FDa6")
+
+	other, _ := newTestWithGenesis(test, func(g *bcommon.Genesis) {
+		g.Alloc[strings.TrimPrefix(strings.ToLower(authorised.Hex()), "0x")] = g.Alloc["59d6e09fde8bf65183ddd1e0ca06f3d618c44c57"]
+	}, t)
+	defer os.RemoveAll(other.dataDir)
+	defer other.state.main.db.Close()
+
+	validators, err = other.state.GetValidators()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(validators) != 1 || validators[0].Address != authorised {
+		t.Fatalf("Validators should be [%s], not %v", authorised.Hex(), validators)
+	}
+}
+
+/*
+
+This test verifies that GetValidators enumerates the whitelist of a POA contract
+which implements getWhiteListCount, getWhiteListAddressFromIdx and getMoniker.
+The POA contract is replaced by the following hand-assembled code, which returns
+the storage slot designated by the first argument, plus one for
+getWhiteListAddressFromIdx. So slot 0 holds the count, slot i+1 the i-th member,
+and the slot of an address its moniker.
+
+	PUSH1 0x04 CALLDATALOAD
+	PUSH1 0x00 CALLDATALOAD PUSH29 0x01<28 zero bytes> SWAP1 DIV
+	PUSH4 <getWhiteListAddressFromIdx> EQ ADD SLOAD
+	PUSH1 0x00 MSTORE PUSH1 0x20 PUSH1 0x00 RETURN
+
+*/
+func TestPOAValidatorsEnumeration(t *testing.T) {
+	os.RemoveAll("test_data/eth/chaindata")
+	defer os.RemoveAll("test_data/eth/chaindata")
+
+	testLogger := bcommon.NewTestEntry(t)
+
+	test := NewTest("test_data/eth", testLogger, t)
+	defer test.state.main.db.Close()
+
+	poaABI := `[
+		{"type":"function","name":"getWhiteListCount","inputs":[],"outputs":[{"name":"","type":"uint256"}]},
+		{"type":"function","name":"getWhiteListAddressFromIdx","inputs":[{"name":"idx","type":"uint256"}],"outputs":[{"name":"","type":"address"}]},
+		{"type":"function","name":"getMoniker","inputs":[{"name":"addr","type":"address"}],"outputs":[{"name":"","type":"bytes32"}]}
+	]`
+
+	selector := crypto.Keccak256([]byte("getWhiteListAddressFromIdx(uint256)"))[:4]
+
+	poaCode := "600435" +
+		"600035" + "7c01" + strings.Repeat("00", 28) + "9004" +
+		"63" + common.Bytes2Hex(selector) + "140154" +
+		"600052" + "60206000f3"
+
+	alice := common.HexToAddress("0x1111111111111111111111111111111111111111")
+	bob := common.HexToAddress("0x2222222222222222222222222222222222222222")
+
+	moniker := func(name string) string {
+		return common.Bytes2Hex(common.RightPadBytes([]byte(name), 32))
+	}
+
+	other, _ := newTestWithGenesis(test, func(g *bcommon.Genesis) {
+		g.Poa.Abi = poaABI
+		g.Poa.Code = poaCode
+		g.Poa.Storage = map[string]string{
+			"0":         "2",
+			"1":         alice.Hex(),
+			"2":         bob.Hex(),
+			alice.Hex(): moniker("alice"),
+		}
+	}, t)
+	defer os.RemoveAll(other.dataDir)
+	defer other.state.main.db.Close()
+
+	validators, err := other.state.GetValidators()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := []Validator{
+		{Address: alice, Moniker: "alice"},
+		{Address: bob},
+	}
+
+	if len(validators) != len(expected) {
+		t.Fatalf("Validators should be %v, not %v", expected, validators)
+	}
+	for i := range expected {
+		if validators[i] != expected[i] {
+			t.Fatalf("Validator %d should be %v, not %v", i, expected[i], validators[i])
+		}
+	}
+
+	// A contract reporting too many members is rejected instead of being
+	// enumerated.
+	huge, _ := newTestWithGenesis(test, func(g *bcommon.Genesis) {
+		g.Poa.Abi = poaABI
+		g.Poa.Code = poaCode
+		g.Poa.Storage = map[string]string{
+			"0": strings.Repeat("ff", 32),
+		}
+	}, t)
+	defer os.RemoveAll(huge.dataDir)
+	defer huge.state.main.db.Close()
+
+	if _, err := huge.state.GetValidators(); err == nil {
+		t.Fatal("GetValidators should fail when the whitelist is too large")
+	}
+}
+
+/*
+
+This test verifies that events emitted by the POA contract are delivered to the
+validator set callback after Commit. The POA contract is replaced by the
+following hand-assembled code, which emits MemberAdded(msg.sender) whenever it
+is called:
+
+	CALLER PUSH1 0x00 MSTORE PUSH32 <topic> PUSH1 0x20 PUSH1 0x00 LOG1 STOP
+
+*/
+func TestPOAValidatorSetUpdate(t *testing.T) {
+	os.RemoveAll("test_data/eth/chaindata")
+	defer os.RemoveAll("test_data/eth/chaindata")
+
+	testLogger := bcommon.NewTestEntry(t)
+
+	test := NewTest("test_data/eth", testLogger, t)
+	defer test.state.main.db.Close()
+
+	if err := test.Init(); err != nil {
+		t.Fatal(err)
+	}
+
+	topic := crypto.Keccak256Hash([]byte("MemberAdded(address)"))
+
+	other, genesis := newTestWithGenesis(test, func(g *bcommon.Genesis) {
+		g.Poa.Abi = "[{\"anonymous\":false,\"inputs\":[{\"indexed\":false,\"name\":\"_address\",\"type\":\"address\"}],\"name\":\"MemberAdded\",\"type\":\"event\"}]"
+		g.Poa.Code = "33600052" + "7f" + common.Bytes2Hex(topic.Bytes()) + "60206000a100"
+	}, t)
+	defer os.RemoveAll(other.dataDir)
+	defer other.state.main.db.Close()
+
+	other.keyStore = test.keyStore
+
+	var updates []ValidatorSetUpdate
+	other.state.SetValidatorSetCallback(func(update ValidatorSetUpdate) {
+		updates = append(updates, update)
+	})
+
+	from := test.keyStore.Accounts()[0]
+	poa := accounts.Account{Address: common.HexToAddress(genesis.Poa.Address)}
+
+	tx, err := other.prepareTransaction(&from, &poa, _defaultValue, _defaultGas, _defaultGasPrice, []byte{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	data, err := rlp.EncodeToBytes(tx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := other.state.ApplyTransaction(data, 0, common.Hash{}, common.Address{}); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(updates) != 0 {
+		t.Fatal("Validator set updates should only be delivered after Commit")
+	}
+
+	root, err := other.state.Commit()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(updates) != 1 {
+		t.Fatalf("There should be 1 validator set update, not %d", len(updates))
+	}
+
+	if updates[0].Root != root {
+		t.Fatalf("Update root should be %s, not %s", root.Hex(), updates[0].Root.Hex())
+	}
+
+	changes := updates[0].Changes
+	if len(changes) != 1 ||
+		changes[0].Type != ValidatorAdded ||
+		changes[0].Address != from.Address ||
+		changes[0].TxHash != tx.Hash() {
+		t.Fatalf("Unexpected validator set changes: %v", changes)
+	}
+}
+
+//------------------------------------------------------------------------------
+func TestSnapshotRestore(t *testing.T) {
+	os.RemoveAll("test_data/eth/chaindata")
+	defer os.RemoveAll("test_data/eth/chaindata")
+
+	testLogger := bcommon.NewTestEntry(t)
+
+	test := NewTest("test_data/eth", testLogger, t)
+	defer test.state.main.db.Close()
+
+	if err := test.Init(); err != nil {
+		t.Fatal(err)
+	}
+
+	from := test.keyStore.Accounts()[0]
+
+	contract := dummyContract()
+	test.deployContract(from, contract, t)
+	contract.parseABI(t)
+	callDummyContractTestAsync(test, from, contract, t)
+
+	var snapshot bytes.Buffer
+	root, err := test.state.Snapshot(&snapshot)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if root != test.state.GetRoot() {
+		t.Fatalf("Snapshot root should be %s, not %s", test.state.GetRoot().Hex(), root.Hex())
+	}
+
+	// A truncated snapshot must be rejected
+	other, _ := newTestWithGenesis(test, func(g *bcommon.Genesis) {}, t)
+	defer os.RemoveAll(other.dataDir)
+	defer other.state.main.db.Close()
+
+	truncated := bytes.NewReader(snapshot.Bytes()[:snapshot.Len()-16])
+	if _, err := other.state.Restore(truncated); err == nil {
+		t.Fatal("Restoring a truncated snapshot should fail")
+	}
+
+	// Nothing is left behind by a failed restore
+	if _, err := other.state.GetTransaction(contract.deployTx); err == nil {
+		t.Fatal("The transactions of a failed restore should not be imported")
+	}
+
+	it := other.state.db.NewIteratorWithPrefix(_restorePrefix)
+	if it.Next() {
+		t.Fatalf("The staging area of a failed restore should be cleared, found %x", it.Key())
+	}
+	it.Release()
+
+	// A forged preimage, and a record larger than the limit, must be rejected
+	forged := func(rec snapshotRecord) io.Reader {
+		var buf bytes.Buffer
+		header := SnapshotHeader{Magic: _snapshotMagic, Version: SnapshotVersion, Root: root}
+		end := snapshotRecord{Kind: snapshotEnd, Key: []byte{0, 0, 0, 0, 0, 0, 0, 1}}
+		for _, item := range []interface{}{header, rec, end} {
+			if err := rlp.Encode(&buf, item); err != nil {
+				t.Fatal(err)
+			}
+		}
+		return &buf
+	}
+
+	preimage := snapshotRecord{Kind: snapshotPreimage, Key: crypto.Keccak256([]byte("a")), Value: []byte("b")}
+	if _, err := other.state.Restore(forged(preimage)); err == nil {
+		t.Fatal("Restoring a forged preimage should fail")
+	}
+
+	forgedTx := snapshotRecord{Kind: snapshotTransaction, Key: crypto.Keccak256([]byte("a")), Value: []byte("b")}
+	if _, err := other.state.Restore(forged(forgedTx)); err == nil {
+		t.Fatal("Restoring a forged transaction should fail")
+	}
+
+	orphan := snapshotRecord{Kind: snapshotReceipt, Key: contract.deployTx.Bytes(), Value: []byte{0xc0}}
+	if _, err := other.state.Restore(forged(orphan)); err == nil {
+		t.Fatal("Restoring a receipt without its transaction should fail")
+	}
+
+	large := make([]byte, maxSnapshotRecordSize)
+	receipt := snapshotRecord{Kind: snapshotReceipt, Key: root.Bytes(), Value: large}
+	if _, err := other.state.Restore(forged(receipt)); err == nil {
+		t.Fatal("Restoring a record larger than the limit should fail")
+	}
+
+	restoredRoot, err := other.state.Restore(bytes.NewReader(snapshot.Bytes()))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if restoredRoot != root || other.state.GetRoot() != root {
+		t.Fatalf("Restored root should be %s, not %s", root.Hex(), other.state.GetRoot().Hex())
+	}
+
+	if b, ob := test.state.GetBalance(from.Address, false), other.state.GetBalance(from.Address, false); b.Cmp(ob) != 0 {
+		t.Fatalf("Restored balance should be %v, not %v", b, ob)
+	}
+
+	other.keyStore = test.keyStore
+	callDummyContractTest(other, from, contract, big.NewInt(110), t)
+
+	tx, err := other.state.GetTransaction(contract.deployTx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	receipt, err := other.state.GetReceipt(tx.Hash())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if receipt.ContractAddress != contract.address {
+		t.Fatalf("Restored receipt should have contract address %s, not %s", contract.address.Hex(), receipt.ContractAddress.Hex())
+	}
+}
+
+//------------------------------------------------------------------------------
+func TestExport(t *testing.T) {
+	os.RemoveAll("test_data/eth/chaindata")
+	defer os.RemoveAll("test_data/eth/chaindata")
+
+	testLogger := bcommon.NewTestEntry(t)
+
+	test := NewTest("test_data/eth", testLogger, t)
+	defer test.state.main.db.Close()
+
+	expected, err := test.state.GetGenesis()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Genesis format
+	var genesis bcommon.Genesis
+	if err := json.Unmarshal(test.state.DumpAllAccounts(), &genesis); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(genesis.Alloc) != len(expected.Alloc) {
+		t.Fatalf("Export should contain %d accounts, not %d", len(expected.Alloc), len(genesis.Alloc))
+	}
+
+	for addr, account := range expected.Alloc {
+		if genesis.Alloc[addr].Balance != account.Balance {
+			t.Fatalf("Balance of %s should be %s, not %s", addr, account.Balance, genesis.Alloc[addr].Balance)
+		}
+	}
+
+	if genesis.Poa.Code != expected.Poa.Code {
+		t.Fatalf("Exported POA code should be %s, not %s", expected.Poa.Code, genesis.Poa.Code)
+	}
+
+	// NDJSON format with prefix filter
+	var buf bytes.Buffer
+	var progress ExportProgress
+
+	_, err = test.state.Export(&buf, ExportOptions{
+		Format:   ExportNDJSON,
+		Prefix:   "0x59D6",
+		Progress: func(p ExportProgress) { progress = p },
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	if len(lines) != 1 {
+		t.Fatalf("Export should contain 1 line, not %d", len(lines))
+	}
+
+	var account ExportAccount
+	if err := json.Unmarshal([]byte(lines[0]), &account); err != nil {
+		t.Fatal(err)
+	}
+
+	if account.Address != "59d6e09fde8bf65183ddd1e0ca06f3d618c44c57" {
+		t.Fatalf("Exported account should be 59d6e09fde8bf65183ddd1e0ca06f3d618c44c57, not %s", account.Address)
+	}
+
+	if !progress.Done || progress.Exported != 1 || progress.Visited != uint64(len(expected.Alloc)+1) {
+		t.Fatalf("Unexpected final progress: %+v", progress)
+	}
+}
+
+//------------------------------------------------------------------------------
+func TestExportImport(t *testing.T) {
+	os.RemoveAll("test_data/eth/chaindata")
+	defer os.RemoveAll("test_data/eth/chaindata")
+
+	testLogger := bcommon.NewTestEntry(t)
+
+	test := NewTest("test_data/eth", testLogger, t)
+	defer test.state.main.db.Close()
+
+	if err := test.Init(); err != nil {
+		t.Fatal(err)
+	}
+
+	from := test.keyStore.Accounts()[0]
+
+	contract := dummyContract()
+	test.deployContract(from, contract, t)
+	contract.parseABI(t)
+	callDummyContractTestAsync(test, from, contract, t)
+
+	var export bytes.Buffer
+	root, err := test.state.Export(&export, ExportOptions{Format: ExportGenesis})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	importDir, err := ioutil.TempDir("", "evml-import")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(importDir)
+
+	db, err := database.Open(_testEngine, filepath.Join(importDir, "chaindata"), test.cache)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	result, err := ImportState(db, bytes.NewReader(export.Bytes()), testLogger)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if result.Root != root {
+		t.Fatalf("Imported root should be %s, not %s", root.Hex(), result.Root.Hex())
+	}
+
+	// A second import in the same database must be refused
+	if _, err := ImportState(db, bytes.NewReader(export.Bytes()), testLogger); err == nil {
+		t.Fatal("Importing into a database with a committed state should fail")
+	}
+
+	imported, err := OpenState(db, test.state.genesisFile, testLogger)
+	if err != nil {
+		db.Close()
+		t.Fatal(err)
+	}
+	defer imported.Close()
+
+	if imported.GetRoot() != root {
+		t.Fatalf("Opened root should be %s, not %s", root.Hex(), imported.GetRoot().Hex())
+	}
+
+	other := &Test{state: imported, keyStore: test.keyStore, logger: testLogger}
+	callDummyContractTest(other, from, contract, big.NewInt(110), t)
+}
+
+// TestExportImportParams exports a state whose genesis file sets the chain
+// parameters, and checks that a node created from the export has the same ones
+func TestExportImportParams(t *testing.T) {
+	os.RemoveAll("test_data/eth/chaindata")
+	defer os.RemoveAll("test_data/eth/chaindata")
+
+	testLogger := bcommon.NewTestEntry(t)
+
+	test := NewTest("test_data/eth", testLogger, t)
+	defer test.state.main.db.Close()
+
+	err := RegisterPrecompile(Precompile{
+		Name: "test-export",
+		Gas:  func(input []byte) uint64 { return 100 },
+		Run:  func(state PrecompileState, input []byte) ([]byte, error) { return input, nil },
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	addr := common.HexToAddress("0x0000000000000000000000000000000000000102")
+	treasury := common.HexToAddress("0x0000000000000000000000000000000000007ea5")
+
+	other, _ := newTestWithGenesis(test, func(g *bcommon.Genesis) {
+		g.ChainID = 7
+		g.GasLimit = 5000000
+		g.Fees = &bcommon.FeeMap{Policy: FeeTreasury, Treasury: treasury.Hex()}
+		g.Precompiles = map[string]string{addr.Hex(): "test-export"}
+	}, t)
+	defer os.RemoveAll(other.dataDir)
+	defer other.state.main.db.Close()
+
+	var export bytes.Buffer
+	root, err := other.state.Export(&export, ExportOptions{Format: ExportGenesis})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	db := database.NewMemoryDB()
+
+	result, err := ImportState(db, bytes.NewReader(export.Bytes()), testLogger)
+	if err != nil {
+		db.Close()
+		t.Fatal(err)
+	}
+
+	// The genesis file of the new node, as created by evml state import
+	js, err := json.Marshal(result.Genesis())
+	if err != nil {
+		db.Close()
+		t.Fatal(err)
+	}
+
+	genesisFile := filepath.Join(other.dataDir, "imported-genesis.json")
+	if err := ioutil.WriteFile(genesisFile, js, 0644); err != nil {
+		db.Close()
+		t.Fatal(err)
+	}
+
+	imported, err := OpenState(db, genesisFile, testLogger)
+	if err != nil {
+		db.Close()
+		t.Fatal(err)
+	}
+	defer imported.Close()
+
+	if imported.GetRoot() != root {
+		t.Fatalf("Opened root should be %s, not %s", root.Hex(), imported.GetRoot().Hex())
+	}
+
+	if chainID := imported.GetChainID(); chainID.Uint64() != 7 {
+		t.Fatalf("Chain ID should be 7, not %v", chainID)
+	}
+
+	if limit := imported.GetGasLimit(); limit != 5000000 {
+		t.Fatalf("Gas limit should be 5000000, not %d", limit)
+	}
+
+	if policy := imported.feePolicy; policy.name != FeeTreasury || policy.treasury != treasury {
+		t.Fatalf("Fee policy should be %s to %s, not %s to %s", FeeTreasury, treasury.Hex(), policy.name, policy.treasury.Hex())
+	}
+
+	if name := imported.Precompiles()[addr]; name != "test-export" {
+		t.Fatalf("Precompile test-export should be enabled at %s, not %q", addr.Hex(), name)
+	}
+}
+
+// TestImportLarge imports more accounts than importCommitInterval, so that the
+// import commits and reopens its stateDB, and checks the root against a state
+// built in one go.
+func TestImportLarge(t *testing.T) {
+	testLogger := bcommon.NewTestEntry(t)
+
+	reference := NewBaseState(database.NewMemoryDB(),
+		common.Hash{},
+		ethTypes.NewEIP155Signer(CustomChainConfig.ChainID),
+		CustomChainConfig,
+		vm.Config{},
+		_gasLimit,
+	)
+
+	genesis := bcommon.Genesis{Alloc: make(bcommon.AccountMap)}
+
+	for i := 1; i <= importCommitInterval+10; i++ {
+		addr := common.BigToAddress(big.NewInt(int64(i)))
+		balance := big.NewInt(int64(i)).String()
+
+		genesis.Alloc[addr.Hex()] = bcommon.GenesisAccount{Balance: balance}
+		reference.CreateAccount(addr, "", nil, balance, 0)
+	}
+
+	root, err := reference.Commit()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	js, err := json.Marshal(genesis)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	db := database.NewMemoryDB()
+	defer db.Close()
+
+	result, err := ImportState(db, bytes.NewReader(js), testLogger)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if result.Accounts != importCommitInterval+10 {
+		t.Fatalf("Import should create %d accounts, not %d", importCommitInterval+10, result.Accounts)
+	}
+
+	if result.Root != root {
+		t.Fatalf("Imported root should be %s, not %s", root.Hex(), result.Root.Hex())
+	}
+}
+
+//------------------------------------------------------------------------------
+func commitTransfer(test *Test, from, to accounts.Account, value *big.Int, t *testing.T) common.Hash {
+	hash, err := transfer(test, from, to, value)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return hash
+}
+
+// transfer applies and commits a transfer in its own block
+func transfer(test *Test, from, to accounts.Account, value *big.Int) (common.Hash, error) {
+	tx, err := test.prepareTransaction(&from,
+		&to,
+		value,
+		uint64(21000),
+		big.NewInt(0),
+		[]byte{})
+	if err != nil {
+		return common.Hash{}, err
+	}
+
+	data, err := rlp.EncodeToBytes(tx)
+	if err != nil {
+		return common.Hash{}, err
+	}
+
+	if err := test.state.ApplyTransaction(data, 0, common.Hash{}, common.Address{}); err != nil {
+		return common.Hash{}, err
+	}
+
+	if _, err := test.state.Commit(); err != nil {
+		return common.Hash{}, err
+	}
+
+	return tx.Hash(), nil
+}
+
+func TestRollback(t *testing.T) {
+	os.RemoveAll("test_data/eth/chaindata")
+	defer os.RemoveAll("test_data/eth/chaindata")
+
+	test := NewTest("test_data/eth", bcommon.NewTestEntry(t), t)
+	defer test.state.main.db.Close()
+
+	if err := test.Init(); err != nil {
+		t.Fatal(err)
+	}
+
+	from := test.keyStore.Accounts()[0]
+	to := test.keyStore.Accounts()[1]
+
+	genesisRoot := test.state.GetRoot()
+	if number, ok := test.state.GetCommitNumber(); !ok || number != 0 {
+		t.Fatalf("Genesis should be commit 0, not %d", number)
+	}
+
+	tx1 := commitTransfer(test, from, to, big.NewInt(1000), t)
+	root1 := test.state.GetRoot()
+	balance1 := test.state.GetBalance(to.Address, false)
+
+	tx2 := commitTransfer(test, from, to, big.NewInt(2000), t)
+
+	if number, _ := test.state.GetCommitNumber(); number != 2 {
+		t.Fatalf("Last commit should be 2, not %d", number)
+	}
+
+	if _, err := test.state.RollbackTo(3); err == nil {
+		t.Fatal("Rolling back to a future commit should fail")
+	}
+
+	root, err := test.state.RollbackTo(1)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if root != root1 || test.state.GetRoot() != root1 {
+		t.Fatalf("Root should be %s, not %s", root1.Hex(), test.state.GetRoot().Hex())
+	}
+
+	if b := test.state.GetBalance(to.Address, false); b.Cmp(balance1) != 0 {
+		t.Fatalf("Balance should be %v, not %v", balance1, b)
+	}
+
+	if _, err := test.state.GetReceipt(tx1); err != nil {
+		t.Fatalf("Receipt of commit 1 should be kept: %v", err)
+	}
+
+	if _, err := test.state.GetReceipt(tx2); err == nil {
+		t.Fatal("Receipt of commit 2 should be deleted")
+	}
+
+	// The chain continues from the rolled back commit
+	commitTransfer(test, from, to, big.NewInt(3000), t)
+	if number, _ := test.state.GetCommitNumber(); number != 2 {
+		t.Fatalf("Last commit should be 2, not %d", number)
+	}
+
+	number, err := test.state.RollbackToRoot(genesisRoot)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if number != 0 || test.state.GetRoot() != genesisRoot {
+		t.Fatalf("Should be at genesis commit, not %d (%s)", number, test.state.GetRoot().Hex())
+	}
+
+	head, err := ReadHead(test.state.main.db)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if head != genesisRoot {
+		t.Fatalf("Head should be %s, not %s", genesisRoot.Hex(), head.Hex())
+	}
+}
+
+//------------------------------------------------------------------------------
+func TestPrune(t *testing.T) {
+	os.RemoveAll("test_data/eth/chaindata")
+	defer os.RemoveAll("test_data/eth/chaindata")
+
+	test := NewTest("test_data/eth", bcommon.NewTestEntry(t), t)
+	defer test.state.main.db.Close()
+
+	if err := test.Init(); err != nil {
+		t.Fatal(err)
+	}
+
+	from := test.keyStore.Accounts()[0]
+	to := test.keyStore.Accounts()[1]
+
+	genesisRoot := test.state.GetRoot()
+	if err := test.state.PinRoot(genesisRoot); err != nil {
+		t.Fatal(err)
+	}
+
+	tx1 := commitTransfer(test, from, to, big.NewInt(1000), t)
+	commitTransfer(test, from, to, big.NewInt(2000), t)
+	balance := test.state.GetBalance(to.Address, false)
+
+	dryRun, err := test.state.Prune(PruneOptions{Keep: 1, DryRun: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if dryRun.Deleted == 0 {
+		t.Fatal("Dry run should find nodes to delete")
+	}
+
+	result, err := test.state.Prune(PruneOptions{Keep: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if result.Deleted != dryRun.Deleted {
+		t.Fatalf("Prune should delete %d nodes, not %d", dryRun.Deleted, result.Deleted)
+	}
+
+	if len(result.Roots) != 2 {
+		t.Fatalf("Prune should keep 2 roots, not %d", len(result.Roots))
+	}
+
+	if b := test.state.GetBalance(to.Address, false); b.Cmp(balance) != 0 {
+		t.Fatalf("Balance should be %v, not %v", balance, b)
+	}
+
+	if _, err := test.state.GetReceipt(tx1); err != nil {
+		t.Fatalf("Receipts should not be pruned: %v", err)
+	}
+
+	if _, err := test.state.RollbackTo(1); err == nil {
+		t.Fatal("Rolling back to a pruned state should fail")
+	}
+
+	if _, err := test.state.RollbackTo(0); err != nil {
+		t.Fatalf("Rolling back to a pinned state should succeed: %v", err)
+	}
+}
+
+//------------------------------------------------------------------------------
+func TestRepairHead(t *testing.T) {
+	os.RemoveAll("test_data/eth/chaindata")
+	defer os.RemoveAll("test_data/eth/chaindata")
+
+	testLogger := bcommon.NewTestEntry(t)
+
+	test := NewTest("test_data/eth", testLogger, t)
+
+	if err := test.Init(); err != nil {
+		test.state.Close()
+		t.Fatal(err)
+	}
+
+	from := test.keyStore.Accounts()[0]
+	to := test.keyStore.Accounts()[1]
+
+	commitTransfer(test, from, to, big.NewInt(1000), t)
+	root1 := test.state.GetRoot()
+	tx2 := commitTransfer(test, from, to, big.NewInt(2000), t)
+
+	// Simulate a commit which was only partially written
+	if err := test.state.main.db.Delete(receiptKey(tx2)); err != nil {
+		t.Fatal(err)
+	}
+	// Open a new State on the same database, as a restarted node would
+	state, err := NewState(test.db, test.state.genesisFile, testLogger)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer state.Close()
+
+	if state.GetRoot() != root1 {
+		t.Fatalf("Root should be %s, not %s", root1.Hex(), state.GetRoot().Hex())
+	}
+
+	if number, _ := state.GetCommitNumber(); number != 1 {
+		t.Fatalf("Last commit should be 1, not %d", number)
+	}
+
+	if _, err := state.GetTransaction(tx2); err == nil {
+		t.Fatal("Transaction of the incomplete commit should be deleted")
+	}
+}
+
+// TestCommitAfterLostBatch checks that the trie nodes of a commit whose batch is
+// never written, because a later step of the commit failed, are written by the
+// next commit.
+func TestCommitAfterLostBatch(t *testing.T) {
+	db := database.NewMemoryDB()
+	defer db.Close()
+
+	bs := NewBaseState(db,
+		common.Hash{},
+		ethTypes.NewEIP155Signer(CustomChainConfig.ChainID),
+		CustomChainConfig,
+		vm.Config{},
+		_gasLimit,
+	)
+
+	first := common.HexToAddress("0x1111111111111111111111111111111111111111")
+	second := common.HexToAddress("0x2222222222222222222222222222222222222222")
+
+	bs.CreateAccount(first, "5b", map[string]string{"01": "02"}, "100", 0)
+
+	// The batch is dropped instead of being written
+	if _, err := bs.CommitToBatch(db.NewBatch()); err != nil {
+		t.Fatal(err)
+	}
+
+	bs.CreateAccount(second, "", nil, "200", 0)
+
+	root, err := bs.Commit()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Every node must be in the database itself
+	noop := func(uint8, []byte, []byte) error { return nil }
+	if err := iterateState(db, root, noop); err != nil {
+		t.Fatalf("State should be complete: %v", err)
+	}
+
+	other := NewBaseState(db,
+		root,
+		ethTypes.NewEIP155Signer(CustomChainConfig.ChainID),
+		CustomChainConfig,
+		vm.Config{},
+		_gasLimit,
+	)
+
+	if balance := other.GetBalance(first); balance.Cmp(big.NewInt(100)) != 0 {
+		t.Fatalf("Balance should be 100, not %v", balance)
+	}
+	if balance := other.GetBalance(second); balance.Cmp(big.NewInt(200)) != 0 {
+		t.Fatalf("Balance should be 200, not %v", balance)
+	}
+}
+
+// recordingDB records the keys put in each batch, in the order the batches
+// are written
+type recordingDB struct {
+	database.Database
+	batches [][][]byte
+}
+
+func (db *recordingDB) NewBatch() ethdb.Batch {
+	return &recordingBatch{Batch: db.Database.NewBatch(), db: db}
+}
+
+type recordingBatch struct {
+	ethdb.Batch
+	db   *recordingDB
+	keys [][]byte
+}
+
+func (b *recordingBatch) Put(key, value []byte) error {
+	b.keys = append(b.keys, common.CopyBytes(key))
+	return b.Batch.Put(key, value)
+}
+
+func (b *recordingBatch) Write() error {
+	b.db.batches = append(b.db.batches, b.keys)
+	return b.Batch.Write()
+}
+
+func (b *recordingBatch) Reset() {
+	b.keys = nil
+	b.Batch.Reset()
+}
+
+// TestCommitOrder checks that the record and head of a commit are written last,
+// in a batch of their own, after all its data
+func TestCommitOrder(t *testing.T) {
+	os.RemoveAll("test_data/eth/chaindata")
+	defer os.RemoveAll("test_data/eth/chaindata")
+
+	testLogger := bcommon.NewTestEntry(t)
+
+	test := NewTest("test_data/eth", testLogger, t)
+
+	if err := test.Init(); err != nil {
+		test.state.Close()
+		t.Fatal(err)
+	}
+
+	db := &recordingDB{Database: test.db}
+
+	state, err := NewState(db, test.state.genesisFile, testLogger)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer state.Close()
+
+	test.state = state
+	db.batches = nil
+
+	from := test.keyStore.Accounts()[0]
+	to := test.keyStore.Accounts()[1]
+
+	commitTransfer(test, from, to, big.NewInt(1000), t)
+
+	number, _ := state.GetCommitNumber()
+
+	if len(db.batches) < 2 {
+		t.Fatalf("Commit should write at least 2 batches, not %d", len(db.batches))
+	}
+
+	last := db.batches[len(db.batches)-1]
+	expected := [][]byte{commitKey(number), _headCommitKey, _headRootKey}
+
+	if len(last) != len(expected) {
+		t.Fatalf("Last batch should only contain the commit record and head, not %d keys", len(last))
+	}
+	for i, key := range expected {
+		if !bytes.Equal(last[i], key) {
+			t.Fatalf("Key %d of the last batch should be %x, not %x", i, key, last[i])
+		}
+	}
+
+	meta := false
+	for _, batch := range db.batches[:len(db.batches)-1] {
+		for _, key := range batch {
+			for _, head := range expected {
+				if bytes.Equal(key, head) {
+					t.Fatalf("Key %x should only be written in the last batch", key)
+				}
+			}
+			if bytes.Equal(key, commitMetaKey(number)) {
+				meta = true
+			}
+		}
+	}
+
+	if !meta {
+		t.Fatal("Commit metadata should be written before the commit record")
+	}
+}
+
+//------------------------------------------------------------------------------
+// downgradeSchema moves the records of a database back to the layout of
+// version 0.
+func downgradeSchema(s *State, t *testing.T) {
+	db := s.db
+
+	legacyPrefixes := [][2][]byte{
+		{_txPrefix, nil},
+		{_receiptPrefix, []byte("receipts-")},
+		{_commitPrefix, []byte("commit-")},
+		{prefixedKey(_triePrefix, _preimagePrefix), []byte("secure-key-")},
+		{_triePrefix, nil},
+	}
+
+	batch := db.NewBatch()
+
+	it := db.NewIteratorWithPrefix(nil)
+	for it.Next() {
+		key := it.Key()
+		for _, p := range legacyPrefixes {
+			if bytes.HasPrefix(key, p[0]) {
+				batch.Put(prefixedKey(p[1], key[len(p[0]):]), common.CopyBytes(it.Value()))
+				batch.Delete(common.CopyBytes(key))
+				break
+			}
+		}
+	}
+	it.Release()
+
+	batch.Delete(_schemaVersionKey)
+
+	if err := batch.Write(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestMigrate(t *testing.T) {
+	os.RemoveAll("test_data/eth/chaindata")
+	defer os.RemoveAll("test_data/eth/chaindata")
+
+	testLogger := bcommon.NewTestEntry(t)
+
+	test := NewTest("test_data/eth", testLogger, t)
+
+	if err := test.Init(); err != nil {
+		test.state.Close()
+		t.Fatal(err)
+	}
+
+	from := test.keyStore.Accounts()[0]
+	to := test.keyStore.Accounts()[1]
+
+	txHash := commitTransfer(test, from, to, big.NewInt(1000), t)
+	root := test.state.GetRoot()
+	balance := test.state.GetBalance(to.Address, false)
+
+	downgradeSchema(test.state, t)
+
+	if version, err := ReadSchemaVersion(test.db); err != nil || version != 0 {
+		t.Fatalf("Schema version should be 0, not %d (%v)", version, err)
+	}
+	// Open a new State on the same database, as a restarted node would
+	state, err := NewState(test.db, test.state.genesisFile, testLogger)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer state.Close()
+
+	if version, err := ReadSchemaVersion(state.db); err != nil || version != SchemaVersion {
+		t.Fatalf("Schema version should be %d, not %d (%v)", SchemaVersion, version, err)
+	}
+
+	if state.GetRoot() != root {
+		t.Fatalf("Root should be %s, not %s", root.Hex(), state.GetRoot().Hex())
+	}
+
+	if b := state.GetBalance(to.Address, false); b.Cmp(balance) != 0 {
+		t.Fatalf("Balance should be %v, not %v", balance, b)
+	}
+
+	if _, err := state.GetTransaction(txHash); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := state.GetReceipt(txHash); err != nil {
+		t.Fatal(err)
+	}
+
+	// No record is left in the keyspace of trie nodes
+	it := state.db.NewIteratorWithPrefix(nil)
+	defer it.Release()
+	for it.Next() {
+		if len(it.Key()) == common.HashLength {
+			t.Fatalf("Unexpected bare key %x", it.Key())
+		}
+	}
+}
+
+//------------------------------------------------------------------------------
+
+// benchmarkReads measures the throughput of concurrent reads. If withWrites is
+// set, a goroutine applies and commits transfers for the whole benchmark.
+func benchmarkReads(b *testing.B, withWrites bool, read func(test *Test, addr common.Address) error) {
+	os.RemoveAll("test_data/eth/chaindata")
+	defer os.RemoveAll("test_data/eth/chaindata")
+
+	logger := logrus.New()
+	logger.Level = logrus.WarnLevel
+
+	test := NewTest("test_data/eth", logrus.NewEntry(logger), b)
+	defer test.state.main.db.Close()
+
+	if err := test.Init(); err != nil {
+		b.Fatal(err)
+	}
+
+	from := test.keyStore.Accounts()[0]
+	to := test.keyStore.Accounts()[1]
+
+	stop := make(chan struct{})
+	done := make(chan error, 1)
+
+	if withWrites {
+		go func() {
+			for {
+				select {
+				case <-stop:
+					done <- nil
+					return
+				default:
+				}
+
+				if _, err := transfer(test, from, to, big.NewInt(1)); err != nil {
+					done <- err
+					return
+				}
+			}
+		}()
+	} else {
+		done <- nil
+	}
+
+	b.ResetTimer()
+
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			if err := read(test, to.Address); err != nil {
+				b.Error(err)
+				return
+			}
+		}
+	})
+
+	b.StopTimer()
+
+	close(stop)
+	if err := <-done; err != nil {
+		b.Fatal(err)
+	}
+}
+
+func readBalance(test *Test, addr common.Address) error {
+	test.state.GetBalance(addr, false)
+	return nil
+}
+
+func readPOA(test *Test, addr common.Address) error {
+	_, err := test.state.CheckAuthorised(addr)
+	return err
+}
+
+func BenchmarkGetBalance(b *testing.B) {
+	benchmarkReads(b, false, readBalance)
+}
+
+func BenchmarkGetBalanceUnderWrites(b *testing.B) {
+	benchmarkReads(b, true, readBalance)
+}
+
+func BenchmarkCall(b *testing.B) {
+	benchmarkReads(b, false, readPOA)
+}
+
+func BenchmarkCallUnderWrites(b *testing.B) {
+	benchmarkReads(b, true, readPOA)
+}
+
+// benchmarkApply measures the throughput of contract calls applied to the WAS,
+// and committed every 100 transactions, with the WAS configured by the given
+// function.
+func benchmarkApply(b *testing.B, configure func(s *State)) {
+	os.RemoveAll("test_data/eth/chaindata")
+	defer os.RemoveAll("test_data/eth/chaindata")
+
+	logger := logrus.New()
+	logger.Level = logrus.WarnLevel
+
+	test := NewTest("test_data/eth", logrus.NewEntry(logger), b)
+	defer test.state.main.db.Close()
+
+	if err := test.Init(); err != nil {
+		b.Fatal(err)
+	}
+
+	from := test.keyStore.Accounts()[0]
+
+	contract := dummyContract()
+	contract.parseABI(b)
+	test.deployContract(from, contract, b)
+
+	callData, err := contract.jsonABI.Pack("testAsync", big.NewInt(1))
+	if err != nil {
+		b.Fatal(err)
+	}
+
+	configure(test.state)
+
+	nonce := test.state.GetNonce(from.Address, false)
+	txs := make([][]byte, b.N)
+	for i := range txs {
+		txs[i] = signTransaction(test, from, &contract.address, nonce+uint64(i), _defaultValue, _defaultGasPrice, callData, b)
+	}
+
+	b.ResetTimer()
+
+	for i, tx := range txs {
+		if err := test.state.ApplyTransaction(tx, i%100, common.Hash{}, common.Address{}); err != nil {
+			b.Fatal(err)
+		}
+
+		if i%100 == 99 || i == len(txs)-1 {
+			if _, err := test.state.Commit(); err != nil {
+				b.Fatal(err)
+			}
+		}
+	}
+}
+
+func BenchmarkApplyTransaction(b *testing.B) {
+	benchmarkApply(b, func(s *State) {})
+}
+
+// BenchmarkApplyTransactionStructLogger traces every transaction with a shared
+// struct logger, as the WAS used to be configured
+func BenchmarkApplyTransactionStructLogger(b *testing.B) {
+	benchmarkApply(b, func(s *State) {
+		s.was.vmConfig = vm.Config{Debug: true, Tracer: vm.NewStructLogger(nil)}
+	})
+}
+
+func BenchmarkApplyTransactionVMDebug(b *testing.B) {
+	benchmarkApply(b, func(s *State) {
+		s.SetVMDebug(ioutil.Discard)
+	})
+}
+
+func BenchmarkApplyTransactionInternalTxs(b *testing.B) {
+	benchmarkApply(b, func(s *State) {
+		s.SetInternalTxs(true)
+	})
+}
+
+//------------------------------------------------------------------------------
+
+// signTransaction returns a signed and encoded transaction with an explicit
+// nonce, so that blocks can be prepared before being applied
+func signTransaction(test *Test,
+	from accounts.Account,
+	to *common.Address,
+	nonce uint64,
+	value *big.Int,
+	gasPrice *big.Int,
+	data []byte,
+	t testing.TB) []byte {
+
+	return signTransactionWithGas(test, from, to, nonce, value, _defaultGas, gasPrice, data, t)
+}
+
+// signTransactionWithGas is like signTransaction, with an explicit gas
+func signTransactionWithGas(test *Test,
+	from accounts.Account,
+	to *common.Address,
+	nonce uint64,
+	value *big.Int,
+	gas uint64,
+	gasPrice *big.Int,
+	data []byte,
+	t testing.TB) []byte {
+
+	var tx *ethTypes.Transaction
+	if to == nil {
+		tx = ethTypes.NewContractCreation(nonce, value, gas, gasPrice, data)
+	} else {
+		tx = ethTypes.NewTransaction(nonce, *to, value, gas, gasPrice, data)
+	}
+
+	signer := test.state.GetSigner()
+
+	signature, err := test.keyStore.SignHash(from, signer.Hash(tx).Bytes())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	signedTx, err := tx.WithSignature(signer, signature)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	data, err = rlp.EncodeToBytes(signedTx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return data
+}
+
+// TestParallelExecution applies the same blocks sequentially and in parallel,
+// and checks that they produce the same roots and receipts
+func TestParallelExecution(t *testing.T) {
+	os.RemoveAll("test_data/eth/chaindata")
+	defer os.RemoveAll("test_data/eth/chaindata")
+
+	test := NewTest("test_data/eth", bcommon.NewTestEntry(t), t)
+	defer test.state.main.db.Close()
+
+	if err := test.Init(); err != nil {
+		t.Fatal(err)
+	}
+
+	parallel, _ := newTestWithGenesis(test, func(*bcommon.Genesis) {}, t)
+	defer os.RemoveAll(parallel.dataDir)
+	defer parallel.state.main.db.Close()
+
+	parallel.state.SetParallelism(4)
+
+	test.state.SetStateDiffs(true)
+	parallel.state.SetStateDiffs(true)
+
+	a := test.keyStore.Accounts()[0]
+	b := test.keyStore.Accounts()[1]
+	coinbase := common.HexToAddress("0xc0ffee")
+
+	contract := dummyContract()
+	contract.parseABI(t)
+	contractAddress := crypto.CreateAddress(a.Address, 0)
+
+	increment, err := contract.jsonABI.Pack("testAsync", big.NewInt(10))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	fresh := func(i int) *common.Address {
+		addr := common.BigToAddress(big.NewInt(int64(1000 + i)))
+		return &addr
+	}
+
+	blocks := [][][]byte{
+		{
+			signTransaction(test, a, nil, 0, big.NewInt(0), big.NewInt(0), common.FromHex(contract.code), t),
+			signTransaction(test, b, &a.Address, 0, big.NewInt(10), big.NewInt(0), nil, t),
+		},
+		{
+			// independent transfers to new accounts, with fees to the coinbase
+			signTransaction(test, a, fresh(0), 1, big.NewInt(100), big.NewInt(1), nil, t),
+			signTransaction(test, b, fresh(1), 1, big.NewInt(200), big.NewInt(1), nil, t),
+			// the same recipient
+			signTransaction(test, a, fresh(2), 2, big.NewInt(300), big.NewInt(1), nil, t),
+			signTransaction(test, b, fresh(2), 2, big.NewInt(400), big.NewInt(1), nil, t),
+			// conflicting storage updates
+			signTransaction(test, a, &contractAddress, 3, big.NewInt(0), big.NewInt(0), increment, t),
+			signTransaction(test, b, &contractAddress, 3, big.NewInt(0), big.NewInt(0), increment, t),
+			// transfers between the senders
+			signTransaction(test, a, &b.Address, 4, big.NewInt(500), big.NewInt(2), nil, t),
+			signTransaction(test, b, &a.Address, 4, big.NewInt(600), big.NewInt(0), nil, t),
+			// a contract creation
+			signTransaction(test, b, nil, 5, big.NewInt(0), big.NewInt(0), common.FromHex(contract.code), t),
+			// a consensus error
+			signTransaction(test, a, fresh(3), 10, big.NewInt(1), big.NewInt(0), nil, t),
+			// undecodable
+			[]byte("not a transaction"),
+			signTransaction(test, a, &contractAddress, 5, big.NewInt(0), big.NewInt(0), increment, t),
+		},
+	}
+
+	for n, block := range blocks {
+		blockHash := common.BigToHash(big.NewInt(int64(n)))
+
+		sequentialErrs := test.state.ApplyBlock(block, blockHash, coinbase)
+		parallelErrs := parallel.state.ApplyBlock(block, blockHash, coinbase)
+
+		for i := range block {
+			if (sequentialErrs[i] == nil) != (parallelErrs[i] == nil) {
+				t.Fatalf("Block %d tx %d: errors differ: %v, %v", n, i, sequentialErrs[i], parallelErrs[i])
+			}
+		}
+
+		sequentialRoot, err := test.state.Commit()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		parallelRoot, err := parallel.state.Commit()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if sequentialRoot != parallelRoot {
+			t.Fatalf("Block %d: root should be %s, not %s", n, sequentialRoot.Hex(), parallelRoot.Hex())
+		}
+
+		for i, data := range block {
+			if sequentialErrs[i] != nil {
+				continue
+			}
+
+			var tx ethTypes.Transaction
+			if err := rlp.DecodeBytes(data, &tx); err != nil {
+				t.Fatal(err)
+			}
+
+			sequentialReceipt, err := test.state.GetReceipt(tx.Hash())
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			parallelReceipt, err := parallel.state.GetReceipt(tx.Hash())
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			sequentialJSON, _ := json.Marshal(sequentialReceipt)
+			parallelJSON, _ := json.Marshal(parallelReceipt)
+
+			if !bytes.Equal(sequentialJSON, parallelJSON) {
+				t.Fatalf("Block %d tx %d: receipts differ:\n%s\n%s", n, i, sequentialJSON, parallelJSON)
+			}
+
+			sequentialDiff, err := test.state.GetStateDiff(tx.Hash())
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			parallelDiff, err := parallel.state.GetStateDiff(tx.Hash())
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			sequentialJSON, _ = json.Marshal(sequentialDiff)
+			parallelJSON, _ = json.Marshal(parallelDiff)
+
+			if !bytes.Equal(sequentialJSON, parallelJSON) {
+				t.Fatalf("Block %d tx %d: state diffs differ:\n%s\n%s", n, i, sequentialJSON, parallelJSON)
+			}
+		}
+	}
+
+	callDummyContractTest(parallel, a, &Contract{address: contractAddress, jsonABI: contract.jsonABI}, big.NewInt(310), t)
+}
+
+//------------------------------------------------------------------------------
+func TestStateDiff(t *testing.T) {
+	os.RemoveAll("test_data/eth/chaindata")
+	defer os.RemoveAll("test_data/eth/chaindata")
+
+	test := NewTest("test_data/eth", bcommon.NewTestEntry(t), t)
+	defer test.state.main.db.Close()
+
+	if err := test.Init(); err != nil {
+		t.Fatal(err)
+	}
+
+	from := test.keyStore.Accounts()[0]
+	to := test.keyStore.Accounts()[1]
+
+	// Not recorded
+	untraced := commitTransfer(test, from, to, big.NewInt(10), t)
+	if _, err := test.state.GetStateDiff(untraced); err == nil {
+		t.Fatal("State diff should not be recorded by default")
+	}
+
+	test.state.SetStateDiffs(true)
+
+	fromBalance := test.state.GetBalance(from.Address, false)
+	toBalance := test.state.GetBalance(to.Address, false)
+	nonce := test.state.GetNonce(from.Address, false)
+
+	hash := commitTransfer(test, from, to, big.NewInt(1000), t)
+
+	diff, err := test.state.GetStateDiff(hash)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sender, ok := diff[from.Address]
+	if !ok || sender.Pre == nil || sender.Post == nil {
+		t.Fatalf("Sender should be in the state diff: %v", diff)
+	}
+
+	if sender.Pre.Balance.ToInt().Cmp(fromBalance) != 0 || sender.Pre.Nonce != nonce {
+		t.Fatalf("Sender pre-state should be %v/%d, not %v/%d", fromBalance, nonce, sender.Pre.Balance, sender.Pre.Nonce)
+	}
+
+	if sender.Post.Nonce != nonce+1 {
+		t.Fatalf("Sender nonce should be %d, not %d", nonce+1, sender.Post.Nonce)
+	}
+
+	recipient := diff[to.Address]
+	expected := new(big.Int).Add(toBalance, big.NewInt(1000))
+	if recipient == nil || recipient.Post.Balance.ToInt().Cmp(expected) != 0 {
+		t.Fatalf("Recipient balance should be %v: %v", expected, recipient)
+	}
+
+	// Storage slots
+	contract := dummyContract()
+	contract.parseABI(t)
+	test.deployContract(from, contract, t)
+
+	callData, err := contract.jsonABI.Pack("testAsync", big.NewInt(10))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tx, err := test.prepareTransaction(&from,
+		&accounts.Account{Address: contract.address},
+		_defaultValue,
+		_defaultGas,
+		_defaultGasPrice,
+		callData)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	data, err := rlp.EncodeToBytes(tx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := test.state.ApplyTransaction(data, 0, common.Hash{}, common.Address{}); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := test.state.Commit(); err != nil {
+		t.Fatal(err)
+	}
+
+	diff, err = test.state.GetStateDiff(tx.Hash())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	account := diff[contract.address]
+	if account == nil || account.Pre == nil || account.Post == nil {
+		t.Fatalf("Contract should be in the state diff: %v", diff)
+	}
+
+	slot := common.Hash{}
+	if pre := account.Pre.Storage[slot]; pre != common.BigToHash(big.NewInt(1)) {
+		t.Fatalf("Slot should be 1 before, not %s", pre.Hex())
+	}
+	if post := account.Post.Storage[slot]; post != common.BigToHash(big.NewInt(11)) {
+		t.Fatalf("Slot should be 11 after, not %s", post.Hex())
+	}
+
+	if len(account.Pre.Code) == 0 {
+		t.Fatal("Contract code should be in the pre-state")
+	}
+
+	prestate := diff.Prestate()
+	if prestate[contract.address].Storage[slot] != common.BigToHash(big.NewInt(1)) {
+		t.Fatalf("Prestate should contain the slot before the transaction: %v", prestate[contract.address])
+	}
+}
+
+// TestInternalTxs deploys a contract whose constructor sends value to an
+// address and creates another contract, and checks that both internal
+// transactions are recorded and indexed by address
+func TestInternalTxs(t *testing.T) {
+	os.RemoveAll("test_data/eth/chaindata")
+	defer os.RemoveAll("test_data/eth/chaindata")
+
+	test := NewTest("test_data/eth", bcommon.NewTestEntry(t), t)
+	defer test.state.main.db.Close()
+
+	if err := test.Init(); err != nil {
+		t.Fatal(err)
+	}
+
+	from := test.keyStore.Accounts()[0]
+	to := test.keyStore.Accounts()[1]
+
+	// Not recorded
+	untraced := commitTransfer(test, from, to, big.NewInt(10), t)
+	if _, err := test.state.GetInternalTxs(untraced); err == nil {
+		t.Fatal("Internal transactions should not be recorded by default")
+	}
+
+	test.state.SetInternalTxs(true)
+
+	recipient := common.HexToAddress("0x1234567890123456789012345678901234567890")
+
+	// CALL(0xffff, recipient, 5, 0, 0, 0, 0) POP
+	// CREATE(0, 0, 0) POP
+	// STOP
+	code := []byte{0x60, 0x00, 0x60, 0x00, 0x60, 0x00, 0x60, 0x00, 0x60, 0x05, 0x73}
+	code = append(code, recipient.Bytes()...)
+	code = append(code, 0x61, 0xff, 0xff, 0xf1, 0x50)
+	code = append(code, 0x60, 0x00, 0x60, 0x00, 0x60, 0x00, 0xf0, 0x50)
+	code = append(code, 0x00)
+
+	nonce := test.state.GetNonce(from.Address, false)
+	data := signTransaction(test, from, nil, nonce, big.NewInt(10), _defaultGasPrice, code, t)
+
+	var tx ethTypes.Transaction
+	if err := rlp.DecodeBytes(data, &tx); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := test.state.ApplyTransaction(data, 0, common.Hash{}, common.Address{}); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := test.state.Commit(); err != nil {
+		t.Fatal(err)
+	}
+
+	contractAddress := crypto.CreateAddress(from.Address, nonce)
+
+	txs, err := test.state.GetInternalTxs(tx.Hash())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(txs) != 2 {
+		t.Fatalf("There should be 2 internal transactions, not %d: %v", len(txs), txs)
+	}
+
+	call := txs[0]
+	if call.Type != "CALL" || call.From != contractAddress || call.To != recipient ||
+		call.Value.ToInt().Cmp(big.NewInt(5)) != 0 || call.Depth != 1 ||
+		call.Error != "" || call.Reverted {
+		t.Fatalf("Unexpected internal call: %+v", call)
+	}
+
+	create := txs[1]
+	if create.Type != "CREATE" || create.From != contractAddress || create.To == (common.Address{}) ||
+		create.Error != "" || create.Reverted {
+		t.Fatalf("Unexpected internal create: %+v", create)
+	}
+
+	indexed, err := test.state.GetAddressInternalTxs(recipient, 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(indexed) != 1 || indexed[0].TxHash != tx.Hash() || indexed[0].To != recipient {
+		t.Fatalf("Recipient should have 1 internal transaction: %v", indexed)
+	}
+
+	indexed, err = test.state.GetAddressInternalTxs(contractAddress, 0, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(indexed) != 1 {
+		t.Fatalf("Query should be limited to 1 internal transaction: %v", indexed)
+	}
+
+	indexed, err = test.state.GetAddressInternalTxs(contractAddress, indexed[0].Commit+1, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(indexed) != 0 {
+		t.Fatalf("Query should not return earlier commits: %v", indexed)
+	}
+}
+
+// TestTracing checks that traced calls and the VM debug log use their own
+// tracers
+func TestTracing(t *testing.T) {
+	os.RemoveAll("test_data/eth/chaindata")
+	defer os.RemoveAll("test_data/eth/chaindata")
+
+	test := NewTest("test_data/eth", bcommon.NewTestEntry(t), t)
+	defer test.state.main.db.Close()
+
+	if err := test.Init(); err != nil {
+		t.Fatal(err)
+	}
+
+	if test.state.was.vmConfig.Debug || test.state.was.vmConfig.Tracer != nil {
+		t.Fatal("Transactions should not be traced by default")
+	}
+
+	from := test.keyStore.Accounts()[0]
+
+	contract := dummyContract()
+	contract.parseABI(t)
+	test.deployContract(from, contract, t)
+
+	callData, err := contract.jsonABI.Pack("test", big.NewInt(10))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	callMsg := ethTypes.NewMessage(from.Address,
+		&contract.address,
+		0,
+		_defaultValue,
+		_defaultGas,
+		_defaultGasPrice,
+		callData,
+		false)
+
+	logger := vm.NewStructLogger(nil)
+	if _, err := test.state.TraceCall(callMsg, logger); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(logger.StructLogs()) == 0 {
+		t.Fatal("Traced call should have struct logs")
+	}
+
+	// The VM debug log
+	var debugLog bytes.Buffer
+	test.state.SetVMDebug(&debugLog)
+
+	callData, err = contract.jsonABI.Pack("testAsync", big.NewInt(10))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	nonce := test.state.GetNonce(from.Address, false)
+	data := signTransaction(test, from, &contract.address, nonce, _defaultValue, _defaultGasPrice, callData, t)
+
+	var tx ethTypes.Transaction
+	if err := rlp.DecodeBytes(data, &tx); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := test.state.ApplyTransaction(data, 0, common.Hash{}, common.Address{}); err != nil {
+		t.Fatal(err)
+	}
+
+	lines := strings.Split(strings.TrimSpace(debugLog.String()), "\n")
+	if len(lines) < 2 {
+		t.Fatalf("Transaction should be traced: %q", debugLog.String())
+	}
+
+	var header struct {
+		TxHash common.Hash `json:"txHash"`
+	}
+	if err := json.Unmarshal([]byte(lines[0]), &header); err != nil {
+		t.Fatal(err)
+	}
+
+	if header.TxHash != tx.Hash() {
+		t.Fatalf("Trace should start with the transaction hash %s, not %s", tx.Hash().Hex(), header.TxHash.Hex())
+	}
+
+	if _, err := test.state.Commit(); err != nil {
+		t.Fatal(err)
+	}
+
+	test.state.SetVMDebug(nil)
+	debugLog.Reset()
+
+	callDummyContractTestAsync(test, from, contract, t)
+
+	if debugLog.Len() != 0 {
+		t.Fatal("Transactions should not be traced once the VM debug log is disabled")
+	}
+}
+
+// TestPrecompiles enables precompiles from the genesis file and at runtime, and
+// calls them. The precompiles of a State must not affect the other States.
+func TestPrecompiles(t *testing.T) {
+	os.RemoveAll("test_data/eth/chaindata")
+	defer os.RemoveAll("test_data/eth/chaindata")
+
+	test := NewTest("test_data/eth", bcommon.NewTestEntry(t), t)
+	defer test.state.main.db.Close()
+
+	repeat := Precompile{
+		Name: "test-repeat",
+		Gas: func(input []byte) uint64 {
+			return 100 + uint64(len(input))
+		},
+		Run: func(state PrecompileState, input []byte) ([]byte, error) {
+			return append(common.CopyBytes(input), input...), nil
+		},
+	}
+
+	balance := Precompile{
+		Name: "test-balance",
+		Gas: func(input []byte) uint64 {
+			return 400
+		},
+		Run: func(state PrecompileState, input []byte) ([]byte, error) {
+			return math.PaddedBigBytes(state.GetBalance(common.BytesToAddress(input)), 32), nil
+		},
+	}
+
+	for _, p := range []Precompile{repeat, balance} {
+		if err := RegisterPrecompile(p); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := RegisterPrecompile(repeat); err == nil {
+		t.Fatal("Registering a precompile twice should fail")
+	}
+
+	addr := common.HexToAddress("0x0000000000000000000000000000000000000100")
+	balanceAddr := common.HexToAddress("0x0000000000000000000000000000000000000101")
+
+	other, _ := newTestWithGenesis(test, func(g *bcommon.Genesis) {
+		g.Precompiles = map[string]string{addr.Hex(): repeat.Name}
+	}, t)
+	defer os.RemoveAll(other.dataDir)
+	defer other.state.main.db.Close()
+
+	if name := other.state.Precompiles()[addr]; name != repeat.Name {
+		t.Fatalf("Precompile at %s should be %s, not %q", addr.Hex(), repeat.Name, name)
+	}
+
+	call := func(s *State, to common.Address, input []byte) []byte {
+		callMsg := ethTypes.NewMessage(common.Address{},
+			&to,
+			0,
+			_defaultValue,
+			_defaultGas,
+			_defaultGasPrice,
+			input,
+			false)
+
+		res, err := s.Call(callMsg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return res
+	}
+
+	if res := call(other.state, addr, []byte{1, 2}); !bytes.Equal(res, []byte{1, 2, 1, 2}) {
+		t.Fatalf("Precompile should return 0x01020102, not %x", res)
+	}
+
+	// The precompile is only enabled in the State created with it
+	if len(test.state.Precompiles()) != 0 {
+		t.Fatalf("Precompiles should not be enabled in another State: %v", test.state.Precompiles())
+	}
+
+	if res := call(test.state, addr, []byte{1, 2}); len(res) != 0 {
+		t.Fatalf("Precompile should not be called from another State, returned %x", res)
+	}
+
+	if err := other.state.EnablePrecompile(addr, repeat.Name); err != nil {
+		t.Fatalf("Enabling a precompile again should not fail: %v", err)
+	}
+
+	if err := other.state.EnablePrecompile(addr, balance.Name); err == nil {
+		t.Fatal("Enabling another precompile at the same address should fail")
+	}
+
+	if err := other.state.EnablePrecompile(common.BytesToAddress([]byte{1}), repeat.Name); err == nil {
+		t.Fatal("Enabling a precompile at the address of ecrecover should fail")
+	}
+
+	if err := other.state.EnablePrecompile(common.BytesToAddress([]byte{2, 0}), "unknown"); err == nil {
+		t.Fatal("Enabling an unknown precompile should fail")
+	}
+
+	// Precompiles read the state of the transaction
+	if err := other.state.EnablePrecompile(balanceAddr, balance.Name); err != nil {
+		t.Fatal(err)
+	}
+
+	account := test.keyStore.Accounts()[0].Address
+	expected := other.state.GetBalance(account)
+
+	res := call(other.state, balanceAddr, account.Bytes())
+	if got := new(big.Int).SetBytes(res); got.Cmp(expected) != 0 {
+		t.Fatalf("Precompile should return the balance %v, not %v", expected, got)
+	}
+
+	if err := other.state.DisablePrecompile(addr); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := other.state.DisablePrecompile(addr); err == nil {
+		t.Fatal("Disabling a precompile twice should fail")
+	}
+
+	if res := call(other.state, addr, []byte{1, 2}); len(res) != 0 {
+		t.Fatalf("Disabled precompile should not be called, returned %x", res)
+	}
+}
+
+// applyWithFee applies and commits a transfer which pays a fee of 21000, with
+// the given coinbase. It returns the number of the commit.
+func applyWithFee(test *Test, coinbase common.Address, t *testing.T) uint64 {
+	from := test.keyStore.Accounts()[0]
+	to := test.keyStore.Accounts()[1].Address
+
+	nonce := test.state.GetNonce(from.Address, false)
+	data := signTransaction(test, from, &to, nonce, big.NewInt(1), big.NewInt(1), nil, t)
+
+	if err := test.state.ApplyTransaction(data, 0, common.Hash{}, coinbase); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := test.state.Commit(); err != nil {
+		t.Fatal(err)
+	}
+
+	number, _ := test.state.GetCommitNumber()
+
+	return number
+}
+
+func TestFeePolicies(t *testing.T) {
+	os.RemoveAll("test_data/eth/chaindata")
+	defer os.RemoveAll("test_data/eth/chaindata")
+
+	test := NewTest("test_data/eth", bcommon.NewTestEntry(t), t)
+	defer test.state.main.db.Close()
+
+	if err := test.Init(); err != nil {
+		t.Fatal(err)
+	}
+
+	fee := big.NewInt(21000)
+	coinbase := common.HexToAddress("0x00000000000000000000000000000000000c0ffe")
+	treasury := common.HexToAddress("0x0000000000000000000000000000000000007ea5")
+	validator := common.HexToAddress("0x89acCD6b63d6eE73550eca0Cba16C2027c13FDa6")
+
+	testCases := []struct {
+		fees       *bcommon.FeeMap
+		recipients map[common.Address]*big.Int
+	}{
+		{
+			fees:       nil,
+			recipients: map[common.Address]*big.Int{coinbase: fee},
+		},
+		{
+			fees:       &bcommon.FeeMap{Policy: FeeBurn},
+			recipients: map[common.Address]*big.Int{},
+		},
+		{
+			fees:       &bcommon.FeeMap{Policy: FeeTreasury, Treasury: treasury.Hex()},
+			recipients: map[common.Address]*big.Int{treasury: fee},
+		},
+		{
+			fees:       &bcommon.FeeMap{Policy: FeeValidators},
+			recipients: map[common.Address]*big.Int{validator: fee},
+		},
+	}
+
+	for _, tc := range testCases {
+		other, _ := newTestWithGenesis(test, func(g *bcommon.Genesis) {
+			g.Fees = tc.fees
+			// The only address authorised by the POA contract
+			g.Alloc[validator.Hex()] = bcommon.GenesisAccount{Balance: "0"}
+		}, t)
+		other.keyStore = test.keyStore
+
+		policy := FeeCoinbase
+		if tc.fees != nil {
+			policy = tc.fees.Policy
+		}
+
+		number := applyWithFee(other, coinbase, t)
+
+		meta, err := other.state.GetCommitMeta(number)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if meta.FeePolicy != policy || meta.Fees.ToInt().Cmp(fee) != 0 {
+			t.Fatalf("%s: commit metadata should report fees of %v, not %+v", policy, fee, meta)
+		}
+
+		for _, addr := range []common.Address{coinbase, treasury, validator} {
+			expected, ok := tc.recipients[addr]
+			if !ok {
+				expected = new(big.Int)
+			}
+
+			if balance := other.state.GetBalance(addr, false); balance.Cmp(expected) != 0 {
+				t.Fatalf("%s: balance of %s should be %v, not %v", policy, addr.Hex(), expected, balance)
+			}
+
+			if policy != FeeCoinbase && ok && meta.FeeRecipients[addr].ToInt().Cmp(expected) != 0 {
+				t.Fatalf("%s: commit metadata should credit %v to %s: %+v", policy, expected, addr.Hex(), meta.FeeRecipients)
+			}
+		}
+
+		other.state.main.db.Close()
+		os.RemoveAll(other.dataDir)
+	}
+}
+
+/*
+
+This test verifies that a POA contract which fails does not stop the chain with
+the validators fee policy. The contract below reverts every call, so the fees
+go to the treasury, if any, or are burnt:
+
+	PUSH1 0x00 PUSH1 0x00 REVERT
+
+*/
+func TestFeeValidatorsFallback(t *testing.T) {
+	os.RemoveAll("test_data/eth/chaindata")
+	defer os.RemoveAll("test_data/eth/chaindata")
+
+	test := NewTest("test_data/eth", bcommon.NewTestEntry(t), t)
+	defer test.state.main.db.Close()
+
+	if err := test.Init(); err != nil {
+		t.Fatal(err)
+	}
+
+	poaABI := `[
+		{"type":"function","name":"getWhiteListCount","inputs":[],"outputs":[{"name":"","type":"uint256"}]},
+		{"type":"function","name":"getWhiteListAddressFromIdx","inputs":[{"name":"idx","type":"uint256"}],"outputs":[{"name":"","type":"address"}]}
+	]`
+
+	fee := big.NewInt(21000)
+	coinbase := common.HexToAddress("0x00000000000000000000000000000000000c0ffe")
+	treasury := common.HexToAddress("0x0000000000000000000000000000000000007ea5")
+
+	testCases := []struct {
+		treasury   string
+		recipients map[common.Address]*big.Int
+	}{
+		{
+			treasury:   "",
+			recipients: map[common.Address]*big.Int{},
+		},
+		{
+			treasury:   treasury.Hex(),
+			recipients: map[common.Address]*big.Int{treasury: fee},
+		},
+	}
+
+	for _, tc := range testCases {
+		other, _ := newTestWithGenesis(test, func(g *bcommon.Genesis) {
+			g.Fees = &bcommon.FeeMap{Policy: FeeValidators, Treasury: tc.treasury}
+			g.Poa.Abi = poaABI
+			g.Poa.Code = "60006000fd"
+		}, t)
+		other.keyStore = test.keyStore
+
+		if _, err := other.state.GetValidators(); err == nil {
+			t.Fatal("GetValidators should fail with a reverting POA contract")
+		}
+
+		number := applyWithFee(other, coinbase, t)
+
+		meta, err := other.state.GetCommitMeta(number)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if meta.Fees.ToInt().Cmp(fee) != 0 || len(meta.FeeRecipients) != len(tc.recipients) {
+			t.Fatalf("Commit metadata should credit %v to %v, not %+v", fee, tc.recipients, meta)
+		}
+
+		for _, addr := range []common.Address{coinbase, treasury} {
+			expected, ok := tc.recipients[addr]
+			if !ok {
+				expected = new(big.Int)
+			}
+
+			if balance := other.state.GetBalance(addr, false); balance.Cmp(expected) != 0 {
+				t.Fatalf("Balance of %s should be %v, not %v", addr.Hex(), expected, balance)
+			}
+		}
+
+		other.state.main.db.Close()
+		os.RemoveAll(other.dataDir)
+	}
+}
+
+func TestSplitFees(t *testing.T) {
+	a := common.HexToAddress("0x01")
+	b := common.HexToAddress("0x02")
+	c := common.HexToAddress("0x03")
+
+	shares := splitFees(big.NewInt(11), []Validator{{Address: c}, {Address: a}, {Address: b}})
+
+	expected := map[common.Address]int64{a: 4, b: 4, c: 3}
+	for addr, amount := range expected {
+		if shares[addr].Int64() != amount {
+			t.Fatalf("Share of %s should be %d, not %v", addr.Hex(), amount, shares[addr])
+		}
+	}
+
+	if len(splitFees(big.NewInt(11), nil)) != 0 {
+		t.Fatal("Fees should not be credited to anyone without validators")
+	}
+}
+
+func TestBlockGasLimit(t *testing.T) {
+	os.RemoveAll("test_data/eth/chaindata")
+	defer os.RemoveAll("test_data/eth/chaindata")
+
+	test := NewTest("test_data/eth", bcommon.NewTestEntry(t), t)
+	defer test.state.main.db.Close()
+
+	if err := test.Init(); err != nil {
+		t.Fatal(err)
+	}
+
+	other, _ := newTestWithGenesis(test, func(g *bcommon.Genesis) {
+		g.GasLimit = 50000
+	}, t)
+	defer os.RemoveAll(other.dataDir)
+	defer other.state.main.db.Close()
+	other.keyStore = test.keyStore
+
+	if limit := other.state.GetGasLimit(); limit != 50000 {
+		t.Fatalf("Gas limit should be 50000, not %d", limit)
+	}
+
+	from := test.keyStore.Accounts()[0]
+	to := test.keyStore.Accounts()[1].Address
+	nonce := other.state.GetNonce(from.Address, false)
+
+	// A transaction which can never fit in a block
+	tooBig := signTransactionWithGas(other, from, &to, nonce, big.NewInt(1), 60000, big.NewInt(0), nil, t)
+
+	tx, err := NewEVMLTransaction(tooBig, other.state.GetSigner())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := other.state.CheckTx(tx); err == nil {
+		t.Fatal("CheckTx should reject a transaction whose gas exceeds the block gas limit")
+	}
+
+	err = other.state.ApplyTransaction(tooBig, 0, common.Hash{}, common.Address{})
+	if _, ok := err.(*GasLimitError); !ok || IsDeferrable(err) {
+		t.Fatalf("Transaction should be rejected with a GasLimitError which cannot be deferred, not %v", err)
+	}
+
+	// The second transaction does not fit in the gas left in the block
+	first := signTransactionWithGas(other, from, &to, nonce, big.NewInt(1), 30000, big.NewInt(0), nil, t)
+	second := signTransactionWithGas(other, from, &to, nonce+1, big.NewInt(1), 30000, big.NewInt(0), nil, t)
+
+	if err := other.state.ApplyTransaction(first, 0, common.Hash{}, common.Address{}); err != nil {
+		t.Fatal(err)
+	}
+
+	err = other.state.ApplyTransaction(second, 1, common.Hash{}, common.Address{})
+	if !IsDeferrable(err) {
+		t.Fatalf("Second transaction should be deferred, not %v", err)
+	}
+
+	if _, err := other.state.Commit(); err != nil {
+		t.Fatal(err)
+	}
+
+	number, _ := other.state.GetCommitNumber()
+
+	meta, err := other.state.GetCommitMeta(number)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if meta.GasUsed != 21000 || meta.GasLimit != 50000 {
+		t.Fatalf("Commit should use 21000 gas of 50000, not %d of %d", meta.GasUsed, meta.GasLimit)
+	}
+
+	// It fits in the next block
+	if err := other.state.ApplyTransaction(second, 0, common.Hash{}, common.Address{}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestCallLimits(t *testing.T) {
+	os.RemoveAll("test_data/eth/chaindata")
+	defer os.RemoveAll("test_data/eth/chaindata")
+
+	test := NewTest("test_data/eth", bcommon.NewTestEntry(t), t)
+	defer test.state.main.db.Close()
+
+	if err := test.Init(); err != nil {
+		t.Fatal(err)
+	}
+
+	from := test.keyStore.Accounts()[0]
+
+	// Deploys JUMPDEST PUSH1 0 JUMP, an infinite loop
+	code := []byte{0x63, 0x5b, 0x60, 0x00, 0x56, 0x60, 0x00, 0x52, 0x60, 0x04, 0x60, 0x1c, 0xf3}
+
+	nonce := test.state.GetNonce(from.Address, false)
+	data := signTransaction(test, from, nil, nonce, big.NewInt(0), _defaultGasPrice, code, t)
+
+	if err := test.state.ApplyTransaction(data, 0, common.Hash{}, common.Address{}); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := test.state.Commit(); err != nil {
+		t.Fatal(err)
+	}
+
+	loop := crypto.CreateAddress(from.Address, nonce)
+
+	callMsg := func(to common.Address, gas uint64) ethTypes.Message {
+		return ethTypes.NewMessage(from.Address, &to, 0, big.NewInt(0), gas, big.NewInt(0), nil, false)
+	}
+
+	test.state.SetCallLimits(1000000000, 50*time.Millisecond, 1)
+
+	// Gas cap
+	_, err := test.state.LimitedCall(callMsg(loop, 1000000001), nil)
+	if _, ok := err.(*CallGasCapError); !ok {
+		t.Fatalf("Call should exceed the gas cap, not %v", err)
+	}
+
+	// Calls without gas get the gas cap
+	if _, err := test.state.LimitedCall(callMsg(test.keyStore.Accounts()[1].Address, 0), nil); err != nil {
+		t.Fatal(err)
+	}
+
+	// Timeout
+	start := time.Now()
+	if _, err := test.state.LimitedCall(callMsg(loop, 1000000000), nil); err != ErrCallTimeout {
+		t.Fatalf("Call should time out, not %v", err)
+	}
+
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Fatalf("Call should be cancelled after the timeout, not after %v", elapsed)
+	}
+
+	// Concurrency
+	test.state.callLimits.slots <- struct{}{}
+
+	if _, err := test.state.LimitedCall(callMsg(loop, 100000), nil); err != ErrTooManyCalls {
+		t.Fatalf("Call should exceed the concurrency limit, not %v", err)
+	}
+
+	// Internal calls are not limited
+	if _, err := test.state.Call(callMsg(loop, 100000)); err != nil {
+		t.Fatal(err)
+	}
+
+	<-test.state.callLimits.slots
+}
+
+func TestEstimateGas(t *testing.T) {
+	os.RemoveAll("test_data/eth/chaindata")
+	defer os.RemoveAll("test_data/eth/chaindata")
+
+	test := NewTest("test_data/eth", bcommon.NewTestEntry(t), t)
+	defer test.state.main.db.Close()
+
+	if err := test.Init(); err != nil {
+		t.Fatal(err)
+	}
+
+	from := test.keyStore.Accounts()[0]
+	to := test.keyStore.Accounts()[1].Address
+
+	test.state.SetCallLimits(10000000, time.Second, 0)
+
+	transfer := ethTypes.NewMessage(from.Address, &to, 0, big.NewInt(1), 0, big.NewInt(0), nil, false)
+
+	gas, err := test.state.EstimateGas(transfer)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if gas != 21000 {
+		t.Fatalf("A transfer should need 21000 gas, not %d", gas)
+	}
+
+	// With a gas price, the search is bounded by the gas which the sender can
+	// pay for after the value, instead of the gas cap
+	available := new(big.Int).Sub(test.state.GetBalance(from.Address, false), big.NewInt(1))
+
+	affordable := new(big.Int).Div(available, big.NewInt(30000))
+	transfer = ethTypes.NewMessage(from.Address, &to, 0, big.NewInt(1), 0, affordable, nil, false)
+
+	gas, err = test.state.EstimateGas(transfer)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if gas != 21000 {
+		t.Fatalf("A transfer with a gas price should need 21000 gas, not %d", gas)
+	}
+
+	expensive := new(big.Int).Div(available, big.NewInt(20000))
+	transfer = ethTypes.NewMessage(from.Address, &to, 0, big.NewInt(1), 0, expensive, nil, false)
+
+	if _, err := test.state.EstimateGas(transfer); err == nil {
+		t.Fatal("Estimating the gas of a transfer which the sender cannot pay for should fail")
+	}
+
+	contract := dummyContract()
+	contract.parseABI(t)
+	test.deployContract(from, contract, t)
+
+	callData, err := contract.jsonABI.Pack("testAsync", big.NewInt(10))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	call := ethTypes.NewMessage(from.Address, &contract.address, 0, big.NewInt(0), 0, big.NewInt(0), callData, false)
+
+	gas, err = test.state.EstimateGas(call)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The estimate is the lowest gas with which the transaction succeeds
+	nonce := test.state.GetNonce(from.Address, false)
+	gases := []uint64{gas - 1, gas}
+	hashes := make([]common.Hash, len(gases))
+
+	for i, g := range gases {
+		data := signTransactionWithGas(test, from, &contract.address, nonce+uint64(i), big.NewInt(0), g, big.NewInt(0), callData, t)
+
+		var tx ethTypes.Transaction
+		if err := rlp.DecodeBytes(data, &tx); err != nil {
+			t.Fatal(err)
+		}
+		hashes[i] = tx.Hash()
+
+		if err := test.state.ApplyTransaction(data, i, common.Hash{}, common.Address{}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if _, err := test.state.Commit(); err != nil {
+		t.Fatal(err)
+	}
+
+	for i, g := range gases {
+		receipt, err := test.state.GetReceipt(hashes[i])
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if failed := receipt.Status == ethTypes.ReceiptStatusFailed; failed != (g < gas) {
+			t.Fatalf("Transaction with %d gas of %d estimated should fail: %v, not %v", g, gas, g < gas, failed)
+		}
+	}
+}
+
+func TestChainID(t *testing.T) {
+	os.RemoveAll("test_data/eth/chaindata")
+	defer os.RemoveAll("test_data/eth/chaindata")
+
+	test := NewTest("test_data/eth", bcommon.NewTestEntry(t), t)
+	defer test.state.main.db.Close()
+
+	if err := test.Init(); err != nil {
+		t.Fatal(err)
+	}
+
+	if chainID := test.state.GetChainID(); chainID.Cmp(big.NewInt(1)) != 0 {
+		t.Fatalf("Chain ID should default to 1, not %v", chainID)
+	}
+
+	other, _ := newTestWithGenesis(test, func(g *bcommon.Genesis) {
+		g.ChainID = 5
+	}, t)
+	defer os.RemoveAll(other.dataDir)
+	defer other.state.main.db.Close()
+	other.keyStore = test.keyStore
+
+	if chainID := other.state.GetChainID(); chainID.Cmp(big.NewInt(5)) != 0 {
+		t.Fatalf("Chain ID should be 5, not %v", chainID)
+	}
+
+	if CustomChainConfig.ChainID.Cmp(big.NewInt(1)) != 0 {
+		t.Fatal("The default chain config should not be modified")
+	}
+
+	from := test.keyStore.Accounts()[0]
+	to := test.keyStore.Accounts()[1].Address
+	nonce := other.state.GetNonce(from.Address, false)
+
+	wrongChain := signTransaction(test, from, &to, nonce, big.NewInt(1), big.NewInt(0), nil, t)
+	if err := other.state.ApplyTransaction(wrongChain, 0, common.Hash{}, common.Address{}); err == nil {
+		t.Fatal("Transaction signed for another chain should be rejected")
+	}
+
+	rightChain := signTransaction(other, from, &to, nonce, big.NewInt(1), big.NewInt(0), nil, t)
+	if err := other.state.ApplyTransaction(rightChain, 0, common.Hash{}, common.Address{}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestGenesisTools(t *testing.T) {
+	os.RemoveAll("test_data/eth/chaindata")
+	defer os.RemoveAll("test_data/eth/chaindata")
+
+	test := NewTest("test_data/eth", bcommon.NewTestEntry(t), t)
+	defer test.state.main.db.Close()
+
+	// SSTORE(0, 42) MSTORE8(0, 0x5b) RETURN(0, 1)
+	creationCode := []byte{0x60, 0x2a, 0x60, 0x00, 0x55, 0x60, 0x5b, 0x60, 0x00, 0x53, 0x60, 0x01, 0x60, 0x00, 0xf3}
+
+	code, storage, err := DeployGenesisContract(creationCode)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if code != "5b" {
+		t.Fatalf("Runtime code should be 5b, not %s", code)
+	}
+
+	slot := common.Bytes2Hex(common.Hash{}.Bytes())
+	if len(storage) != 1 || storage[slot] != "2a" {
+		t.Fatalf("Storage should hold 42 in slot 0: %v", storage)
+	}
+
+	genesis, err := test.state.GetGenesis()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := ValidateGenesis(genesis); err != nil {
+		t.Fatal(err)
+	}
+
+	genesis.Poa.Code = code
+	genesis.Poa.Storage = storage
+
+	if err := ValidateGenesis(genesis); err != nil {
+		t.Fatal(err)
+	}
+
+	invalid := []func(g *bcommon.Genesis){
+		func(g *bcommon.Genesis) {
+			g.Alloc["not an address"] = bcommon.GenesisAccount{Balance: "1"}
+		},
+		func(g *bcommon.Genesis) {
+			g.Alloc["0x1234567890123456789012345678901234567890"] = bcommon.GenesisAccount{Balance: "lots"}
+		},
+		func(g *bcommon.Genesis) {
+			g.Alloc["0x1234567890123456789012345678901234567890"] = bcommon.GenesisAccount{Balance: "1", Code: "0x60"}
+		},
+		func(g *bcommon.Genesis) {
+			g.Alloc[strings.TrimPrefix(g.Poa.Address, "0X")] = bcommon.GenesisAccount{Balance: "1"}
+		},
+		func(g *bcommon.Genesis) {
+			g.Poa.Abi = "not an abi"
+		},
+		func(g *bcommon.Genesis) {
+			g.Fees = &bcommon.FeeMap{Policy: "unknown"}
+		},
+	}
+
+	for i, modify := range invalid {
+		genesis, err := test.state.GetGenesis()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		modify(&genesis)
+
+		if err := ValidateGenesis(genesis); err == nil {
+			t.Fatalf("Genesis %d should be invalid", i)
+		}
+	}
+}
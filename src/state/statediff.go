@@ -0,0 +1,142 @@
+package state
+
+import (
+	"encoding/json"
+	"fmt"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/common/hexutil"
+	"github.com/ethereum/go-ethereum/ethdb"
+)
+
+// AccountState is the state of an account, with the storage slots accessed by a
+// transaction. It uses the format of go-ethereum's prestate tracer.
+type AccountState struct {
+	Balance *hexutil.Big                `json:"balance"`
+	Nonce   uint64                      `json:"nonce"`
+	Code    hexutil.Bytes               `json:"code,omitempty"`
+	Storage map[common.Hash]common.Hash `json:"storage,omitempty"`
+}
+
+// AccountDiff is the state of an account before and after a transaction. Pre is
+// nil if the account did not exist, and Post is nil if it was deleted.
+type AccountDiff struct {
+	Pre  *AccountState `json:"pre"`
+	Post *AccountState `json:"post"`
+}
+
+// StateDiff records every account and storage slot accessed by a transaction,
+// with their values before and after it.
+type StateDiff map[common.Address]*AccountDiff
+
+// Prestate returns the state of the accounts accessed by the transaction before
+// it was applied, as the prestate tracer of go-ethereum does. Accounts which
+// did not exist have a zero balance.
+func (d StateDiff) Prestate() map[common.Address]*AccountState {
+	prestate := make(map[common.Address]*AccountState)
+
+	for addr, diff := range d {
+		if diff.Pre != nil {
+			prestate[addr] = diff.Pre
+		} else {
+			prestate[addr] = &AccountState{Balance: new(hexutil.Big)}
+		}
+	}
+
+	return prestate
+}
+
+// stateDiff returns the StateDiff of the accesses recorded with diff set, once
+// the transaction is applied to the recorder's stateDB.
+func (r *accessRecorder) stateDiff() StateDiff {
+	diff := make(StateDiff)
+
+	for addr, before := range r.accounts {
+		after := readAccountValue(r.StateDB, addr)
+
+		d := &AccountDiff{}
+
+		if before.exist {
+			d.Pre = &AccountState{
+				Balance: (*hexutil.Big)(before.balance),
+				Nonce:   before.nonce,
+				Code:    r.code[addr],
+			}
+		}
+
+		if after.exist {
+			d.Post = &AccountState{
+				Balance: (*hexutil.Big)(after.balance),
+				Nonce:   after.nonce,
+				Code:    common.CopyBytes(r.StateDB.GetCode(addr)),
+			}
+		}
+
+		diff[addr] = d
+	}
+
+	for k, before := range r.slots {
+		d := diff[k.addr]
+
+		if d.Pre != nil {
+			if d.Pre.Storage == nil {
+				d.Pre.Storage = make(map[common.Hash]common.Hash)
+			}
+			d.Pre.Storage[k.key] = before
+		}
+
+		if d.Post != nil {
+			if d.Post.Storage == nil {
+				d.Post.Storage = make(map[common.Hash]common.Hash)
+			}
+			d.Post.Storage[k.key] = r.StateDB.GetState(k.addr, k.key)
+		}
+	}
+
+	return diff
+}
+
+// WriteStateDiffs adds the state diffs of a set of transactions to a batch.
+// Transactions applied without recording state diffs are skipped.
+func (bs *BaseState) WriteStateDiffs(batch ethdb.Batch, txs map[common.Hash]*EVMLTransaction) error {
+	for hash, tx := range txs {
+		if tx.stateDiff == nil {
+			continue
+		}
+
+		data, err := json.Marshal(tx.stateDiff)
+		if err != nil {
+			return err
+		}
+
+		if err := batch.Put(stateDiffKey(hash), data); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// GetStateDiff fetches the state diff of a transaction from the DB
+func (bs *BaseState) GetStateDiff(hash common.Hash) (StateDiff, error) {
+	has, err := bs.db.Has(stateDiffKey(hash))
+	if err != nil {
+		return nil, err
+	}
+
+	if !has {
+		return nil, fmt.Errorf("No state diff for transaction %s", hash.Hex())
+	}
+
+	data, err := bs.db.Get(stateDiffKey(hash))
+	if err != nil {
+		return nil, err
+	}
+
+	var diff StateDiff
+	if err := json.Unmarshal(data, &diff); err != nil {
+		return nil, err
+	}
+
+	return diff, nil
+}
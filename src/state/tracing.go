@@ -0,0 +1,101 @@
+package state
+
+import (
+	"encoding/json"
+	"io"
+	"math/big"
+	"time"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/vm"
+)
+
+/*
+Tracing is opt-in. The EVMs run without a tracer unless a feature requires one:
+internal transactions, traced calls, which get their own tracer instance for
+every request, and the VM debug log, which traces every transaction applied by
+the consensus system to a writer.
+*/
+
+// multiTracer forwards the events of an EVM to several tracers
+type multiTracer []vm.Tracer
+
+// CaptureStart implements vm.Tracer
+func (t multiTracer) CaptureStart(from common.Address, to common.Address, create bool, input []byte, gas uint64, value *big.Int) error {
+	for _, tracer := range t {
+		if err := tracer.CaptureStart(from, to, create, input, gas, value); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// CaptureState implements vm.Tracer
+func (t multiTracer) CaptureState(env *vm.EVM, pc uint64, op vm.OpCode, gas, cost uint64, memory *vm.Memory, stack *vm.Stack, contract *vm.Contract, depth int, err error) error {
+	for _, tracer := range t {
+		if err := tracer.CaptureState(env, pc, op, gas, cost, memory, stack, contract, depth, err); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// CaptureFault implements vm.Tracer
+func (t multiTracer) CaptureFault(env *vm.EVM, pc uint64, op vm.OpCode, gas, cost uint64, memory *vm.Memory, stack *vm.Stack, contract *vm.Contract, depth int, err error) error {
+	for _, tracer := range t {
+		if err := tracer.CaptureFault(env, pc, op, gas, cost, memory, stack, contract, depth, err); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// CaptureEnd implements vm.Tracer
+func (t multiTracer) CaptureEnd(output []byte, gasUsed uint64, d time.Duration, err error) error {
+	for _, tracer := range t {
+		if err := tracer.CaptureEnd(output, gasUsed, d, err); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// withTracers returns a copy of a vm.Config which runs the given tracers. The
+// copy is unchanged if there are none.
+func withTracers(config vm.Config, tracers ...vm.Tracer) vm.Config {
+	switch len(tracers) {
+	case 0:
+		return config
+	case 1:
+		config.Tracer = tracers[0]
+	default:
+		config.Tracer = multiTracer(tracers)
+	}
+	config.Debug = true
+
+	return config
+}
+
+// debugLogger writes the struct logs of every transaction to a writer, as JSON
+// lines, each transaction starting with a line containing its hash. It is only
+// used by the WAS, under its lock.
+type debugLogger struct {
+	w       io.Writer
+	encoder *json.Encoder
+	*vm.JSONLogger
+}
+
+func newDebugLogger(w io.Writer) *debugLogger {
+	return &debugLogger{
+		w:          w,
+		encoder:    json.NewEncoder(w),
+		JSONLogger: vm.NewJSONLogger(&vm.LogConfig{}, w),
+	}
+}
+
+// begin marks the start of the trace of a transaction
+func (l *debugLogger) begin(txHash common.Hash) {
+	l.encoder.Encode(struct {
+		TxHash common.Hash `json:"txHash"`
+	}{txHash})
+}
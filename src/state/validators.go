@@ -0,0 +1,57 @@
+package state
+
+import (
+	"github.com/ethereum/go-ethereum/common"
+)
+
+// Validator is a member of the POA whitelist
+type Validator struct {
+	Address common.Address `json:"address"`
+	Moniker string         `json:"moniker,omitempty"`
+}
+
+// ValidatorChangeType is the type of a change to the validator set
+type ValidatorChangeType int
+
+const (
+	// ValidatorAdded is when an address joins the whitelist
+	ValidatorAdded ValidatorChangeType = iota
+	// ValidatorRemoved is when an address leaves the whitelist, either
+	// voluntarily or by eviction
+	ValidatorRemoved
+)
+
+// String returns the string representation of a ValidatorChangeType
+func (t ValidatorChangeType) String() string {
+	switch t {
+	case ValidatorAdded:
+		return "added"
+	case ValidatorRemoved:
+		return "removed"
+	default:
+		return "unknown"
+	}
+}
+
+// ValidatorChange is a change to the validator set, derived from an event
+// emitted by the POA smart-contract.
+type ValidatorChange struct {
+	Type    ValidatorChangeType
+	Address common.Address
+	// Event is the name of the event which produced the change
+	Event string
+	// TxHash is the hash of the transaction which emitted the event
+	TxHash common.Hash
+}
+
+// ValidatorSetUpdate is delivered to the consensus system after a Commit which
+// changed the validator set. Changes are listed in the order in which they
+// were applied, which is the same on every node.
+type ValidatorSetUpdate struct {
+	// Root is the state root of the Commit
+	Root    common.Hash
+	Changes []ValidatorChange
+}
+
+// ValidatorSetCallback is called with every ValidatorSetUpdate
+type ValidatorSetCallback func(ValidatorSetUpdate)
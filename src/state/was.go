@@ -2,9 +2,11 @@ package state
 
 import (
 	"fmt"
+	"math/big"
 	"sync"
 
 	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/common/hexutil"
 	ethTypes "github.com/ethereum/go-ethereum/core/types"
 	"github.com/sirupsen/logrus"
 )
@@ -19,8 +21,17 @@ type WriteAheadState struct {
 	txIndex int
 
 	// a local cache of transactions
-	txs     map[common.Hash]*EVMLTransaction
-	allLogs []*ethTypes.Log
+	txs      map[common.Hash]*EVMLTransaction
+	txHashes []common.Hash
+	allLogs  []*ethTypes.Log
+
+	// commitNumber is the number of the next commit
+	commitNumber uint64
+
+	// feePolicy is the name of the fee policy, and feeRecipients the amounts
+	// credited by creditFees, recorded in the metadata of the commit
+	feePolicy     string
+	feeRecipients map[common.Address]*big.Int
 
 	receiptPromises map[common.Hash]*ReceiptPromise
 	promiseLock     sync.Mutex
@@ -34,6 +45,7 @@ func NewWriteAheadState(base BaseState, logger *logrus.Entry) *WriteAheadState {
 		BaseState:       base,
 		txs:             make(map[common.Hash]*EVMLTransaction),
 		receiptPromises: make(map[common.Hash]*ReceiptPromise),
+		feePolicy:       FeeCoinbase,
 		logger:          logger,
 	}
 }
@@ -49,7 +61,9 @@ func (was *WriteAheadState) Reset(root common.Hash) error {
 
 	was.txIndex = 0
 	was.txs = make(map[common.Hash]*EVMLTransaction)
+	was.txHashes = nil
 	was.allLogs = []*ethTypes.Log{}
+	was.feeRecipients = nil
 
 	return nil
 }
@@ -67,6 +81,27 @@ func (was *WriteAheadState) CreateReceiptPromise(hash common.Hash) *ReceiptPromi
 	return p
 }
 
+// PendingPromises returns the number of receipt promises which are not resolved
+// yet
+func (was *WriteAheadState) PendingPromises() int {
+	was.promiseLock.Lock()
+	defer was.promiseLock.Unlock()
+
+	return len(was.receiptPromises)
+}
+
+// DropReceiptPromise forgets a receipt promise which nobody waits for anymore,
+// for example because the wait timed out. A promise which was replaced by a new
+// promise for the same transaction is ignored.
+func (was *WriteAheadState) DropReceiptPromise(p *ReceiptPromise) {
+	was.promiseLock.Lock()
+	defer was.promiseLock.Unlock()
+
+	if was.receiptPromises[p.Hash] == p {
+		delete(was.receiptPromises, p.Hash)
+	}
+}
+
 // ApplyTransaction executes the transaction on the WAS BaseState. If the
 // transaction returns a "consensus" error (an error that is not due to EVM
 // execution), it will not produce a receipt, and will not be saved; if there is
@@ -79,19 +114,63 @@ func (was *WriteAheadState) ApplyTransaction(
 	blockHash common.Hash,
 	coinbase common.Address) error {
 
-	txHash := tx.Hash()
-
 	// Apply the transaction to the current state (included in the env). This
 	// populates tx.Receipt
 	err := was.BaseState.ApplyTransaction(tx, txIndex, blockHash, coinbase, false)
+
+	return was.record(tx, err)
+}
+
+// ApplyTransactions executes the transactions of a block on the WAS BaseState,
+// speculatively in parallel with the given number of workers. The result is
+// the same as calling ApplyTransaction with every transaction in order. Nil
+// transactions are skipped.
+func (was *WriteAheadState) ApplyTransactions(
+	txs []*EVMLTransaction,
+	blockHash common.Hash,
+	coinbase common.Address,
+	workers int) []error {
+
+	errs, reexecuted := was.BaseState.ApplyTransactionsParallel(txs, blockHash, coinbase, workers)
+
+	for i, tx := range txs {
+		if tx != nil {
+			errs[i] = was.record(tx, errs[i])
+		}
+	}
+
+	if was.logger.Level > logrus.InfoLevel {
+		was.logger.WithFields(logrus.Fields{
+			"txs":        len(txs),
+			"workers":    workers,
+			"reexecuted": reexecuted,
+		}).Debug("Applied block to WAS")
+	}
+
+	return errs
+}
+
+// record records a transaction applied to the WAS BaseState, and its receipt,
+// unless it returned a consensus error. The promise of a transaction which did
+// not fit in the block is kept, as it can be applied in a later block.
+func (was *WriteAheadState) record(tx *EVMLTransaction, err error) error {
+	txHash := tx.Hash()
+
+	if IsDeferrable(err) {
+		was.logger.WithError(err).WithField("hash", txHash.Hex()).Info("Transaction does not fit in block")
+		return err
+	}
+
 	if err != nil || tx.receipt == nil {
 		was.logger.WithError(err).Error("Applying transaction to WAS")
 
 		// Respond to the promise immediately if we got a "consensus" error
+		was.promiseLock.Lock()
 		if promise, ok := was.receiptPromises[txHash]; ok {
 			promise.Respond(nil, err)
 			delete(was.receiptPromises, txHash)
 		}
+		was.promiseLock.Unlock()
 
 		return err
 	}
@@ -99,6 +178,7 @@ func (was *WriteAheadState) ApplyTransaction(
 	was.txIndex++
 
 	was.txs[txHash] = tx
+	was.txHashes = append(was.txHashes, txHash)
 
 	was.allLogs = append(was.allLogs, tx.receipt.Logs...)
 
@@ -109,30 +189,74 @@ func (was *WriteAheadState) ApplyTransaction(
 	return nil
 }
 
-// Commit commits everything to the underlying database.
+// Commit commits everything to the underlying database. The trie nodes,
+// transactions, receipts, and metadata of the commit are written first, and its
+// record and the head pointers last, in a small batch of their own. The commit
+// is only visible once its record is written, so a crash, or a database which
+// splits the first batch in several transactions, cannot leave a partially
+// written commit: the head still points to the previous one.
 func (was *WriteAheadState) Commit() (common.Hash, error) {
 	was.logger.WithFields(logrus.Fields{
-		"txs":  was.txIndex,
-		"logs": len(was.allLogs),
+		"txs":       was.txIndex,
+		"logs":      len(was.allLogs),
+		"gas":       was.GasUsed(),
+		"gas_limit": was.gasLimit,
 	}).Info("Commit")
 
-	// Commit all state changes to the database
-	root, err := was.BaseState.Commit()
+	batch := was.db.NewBatch()
+
+	// Commit all state changes to the batch
+	root, err := was.BaseState.CommitToBatch(batch)
 	if err != nil {
 		was.logger.WithError(err).Error("Committing state")
 		return common.Hash{}, err
 	}
 
-	if err := was.BaseState.WriteTransactions(was.txs); err != nil {
+	if err := was.BaseState.WriteTransactions(batch, was.txs); err != nil {
 		was.logger.WithError(err).Error("Writing txs")
 		return common.Hash{}, err
 	}
 
-	if err := was.BaseState.WriteReceipts(was.txs); err != nil {
+	if err := was.BaseState.WriteReceipts(batch, was.txs); err != nil {
 		was.logger.WithError(err).Error("Writing receipts")
 		return common.Hash{}, err
 	}
 
+	if err := was.BaseState.WriteStateDiffs(batch, was.txs); err != nil {
+		was.logger.WithError(err).Error("Writing state diffs")
+		return common.Hash{}, err
+	}
+
+	if err := was.BaseState.WriteInternalTxs(batch, was.commitNumber, was.txs); err != nil {
+		was.logger.WithError(err).Error("Writing internal txs")
+		return common.Hash{}, err
+	}
+
+	meta := &CommitMeta{
+		GasUsed:       was.GasUsed(),
+		GasLimit:      was.gasLimit,
+		Fees:          (*hexutil.Big)(was.Fees()),
+		FeePolicy:     was.feePolicy,
+		FeeRecipients: toHexBigs(was.feeRecipients),
+	}
+
+	if err := writeCommitMeta(batch, was.commitNumber, meta); err != nil {
+		was.logger.WithError(err).Error("Writing commit metadata")
+		return common.Hash{}, err
+	}
+
+	if err := batch.Write(); err != nil {
+		was.logger.WithError(err).Error("Writing batch")
+		return common.Hash{}, err
+	}
+	was.BaseState.BatchWritten()
+
+	if err := was.BaseState.WriteCommit(was.commitNumber, root, was.txHashes); err != nil {
+		was.logger.WithError(err).Error("Writing commit")
+		return common.Hash{}, err
+	}
+	was.commitNumber++
+
 	// respond to receipts once committed with no errors
 	if err := was.respondReceiptPromises(); err != nil {
 		was.logger.WithError(err).Error("Responding receipt promises")
@@ -142,6 +266,19 @@ func (was *WriteAheadState) Commit() (common.Hash, error) {
 	return root, nil
 }
 
+// creditFees credits the fees distributed according to the fee policy, before
+// the commit
+func (was *WriteAheadState) creditFees(recipients map[common.Address]*big.Int) {
+	was.Lock()
+	defer was.Unlock()
+
+	for addr, amount := range recipients {
+		was.stateDB.AddBalance(addr, amount)
+	}
+
+	was.feeRecipients = recipients
+}
+
 func (was *WriteAheadState) respondReceiptPromises() error {
 	was.promiseLock.Lock()
 	defer was.promiseLock.Unlock()